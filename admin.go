@@ -0,0 +1,175 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//
+// With "-admin-token", the HTTP server also serves an admin API, to see
+// which tests are running on a shared server, and to end stuck ones:
+// GET /admin/tests lists the tests of all sessions.
+// POST /admin/kill?key=<remote> ends all tests from the given remote
+// address, the key of its session, or only one of them with "&id=<test id>".
+// Tests run by a client are ended by closing their control connection, so
+// they end as if the client went away, and the client is told that the
+// server ended the session. Requests must send the token as "Authorization:
+// Bearer". The allow list doesn't apply, so that the server can be managed
+// from hosts that don't run tests.
+//
+var gAdminToken string
+
+type adminTest struct {
+	Key       string `json:"key"`
+	Id        string `json:"id,omitempty"`
+	Protocol  string `json:"protocol"`
+	Type      string `json:"type"`
+	Label     string `json:"label,omitempty"`
+	Active    bool   `json:"active"`
+	Paused    bool   `json:"paused"`
+	StartTime string `json:"start_time,omitempty"`
+	Rest      bool   `json:"rest"`
+	Session   string `json:"session,omitempty"`
+	Detached  bool   `json:"detached"`
+}
+
+type adminKillResult struct {
+	Killed []adminTest `json:"killed"`
+}
+
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(gAdminToken)) != 1 {
+		writeRestError(w, http.StatusUnauthorized, "invalid admin token")
+		return false
+	}
+	return true
+}
+
+//
+// Tests are listed in the order their sessions were created, and by protocol
+// and type within a session.
+//
+func listAdminTests() []*ethrTest {
+	gSessionLock.RLock()
+	defer gSessionLock.RUnlock()
+	var tests []*ethrTest
+	for _, key := range gSessionKeys {
+		session := gSessions[key]
+		n := len(tests)
+		for _, test := range session.tests {
+			tests = append(tests, test)
+		}
+		sort.Slice(tests[n:], func(i, j int) bool {
+			a, b := tests[n+i].testParam.TestId, tests[n+j].testParam.TestId
+			return a.Protocol < b.Protocol || a.Protocol == b.Protocol && a.Type < b.Type
+		})
+	}
+	return tests
+}
+
+//
+// The start time is only set once a test is active.
+//
+func getAdminTest(test *ethrTest) adminTest {
+	gSessionLock.RLock()
+	active := test.isActive
+	name, detached := test.name, test.detached
+	gSessionLock.RUnlock()
+	t := adminTest{
+		Key:      test.session.remoteAddr,
+		Id:       test.uuid,
+		Protocol: protoToString(test.testParam.TestId.Protocol),
+		Type:     resultLineTestName[test.testParam.TestId.Type],
+		Label:    test.testParam.Label,
+		Active:   active,
+		Paused:   test.isPaused(),
+		Rest:     test.ctrlConn == nil,
+		Session:  name,
+		Detached: detached,
+	}
+	if active {
+		t.StartTime = test.startTime.UTC().Format(time.RFC3339)
+	}
+	return t
+}
+
+func handleAdminTests(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeRestError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	results := make([]adminTest, 0)
+	for _, test := range listAdminTests() {
+		results = append(results, getAdminTest(test))
+	}
+	writeRestJson(w, http.StatusOK, results)
+}
+
+func handleAdminKill(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeRestError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	key := r.URL.Query().Get("key")
+	id := r.URL.Query().Get("id")
+	if key == "" {
+		writeRestError(w, http.StatusBadRequest, "missing key")
+		return
+	}
+	result := adminKillResult{Killed: make([]adminTest, 0)}
+	for _, test := range listAdminTests() {
+		if test.session.remoteAddr != key || (id != "" && test.uuid != id) {
+			continue
+		}
+		t := getAdminTest(test)
+		if !killTest(test) {
+			continue
+		}
+		result.Killed = append(result.Killed, t)
+	}
+	if len(result.Killed) == 0 {
+		writeRestError(w, http.StatusNotFound, "no such test")
+		return
+	}
+	writeRestJson(w, http.StatusOK, result)
+}
+
+//
+// A test run by a client ends when its control connection is closed, see
+// handleRequest, which cleans it up. Tests started through the REST API have
+// no control connection, and are stopped as by DELETE /tests/<id>. It returns
+// false if the test was already being stopped.
+//
+func killTest(test *ethrTest) bool {
+	if test.ctrlConn == nil && !removeRestTest(test) {
+		return false
+	}
+	ui.printMsg("Killing " + protoToString(test.testParam.TestId.Protocol) + " " +
+		testToString(test.testParam.TestId.Type) + " test from " + test.remoteWithId() +
+		" through the admin API")
+	if test.ctrlConn != nil {
+		if !killNamedTest(test) {
+			test.ctrlConn.Close()
+		}
+	} else {
+		stopRestTest(test, "admin API")
+	}
+	return true
+}
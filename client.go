@@ -6,36 +6,158 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"encoding/gob"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"os/signal"
-	"sort"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
 )
 
 func runClient(testParam EthrTestParam, server string, d time.Duration) {
 	initClient()
-	err, test := establishSession(testParam, server)
+	if gNumeric && gAddrFamily == familyAny {
+		addr, err := resolveNumeric(server)
+		if err != nil {
+			ui.printErr("Error: %v", err)
+			os.Exit(1)
+		}
+		if addr != server {
+			ui.printMsg("Using %s for %s.", addr, server)
+		}
+		server = addr
+	}
+	if testParam.TestId.Type == Pps && gFragMode == fragReject {
+		err := validatePpsPacketSize(server, testParam.BufferSize)
+		if err != nil {
+			ui.printErr("Error: %v", err)
+			os.Exit(1)
+		}
+	}
+	if gAddrFamily == familyBoth {
+		runFamilies(testParam, server, d)
+		outputFini()
+		hdrFini()
+		rawLatencyFini()
+		influxFini()
+		otlpFini()
+		return
+	}
+	if gAddrFamily != familyAny {
+		addr, err := resolveFamily(server, gAddrFamily)
+		if err != nil {
+			ui.printErr("Error: %v", err)
+			os.Exit(1)
+		}
+		server = addr
+	}
+	if gValidate {
+		runValidation(testParam, server)
+		return
+	}
+	if len(gSweepSizes) > 0 {
+		runSweep(testParam, server, d)
+		outputFini()
+		hdrFini()
+		rawLatencyFini()
+		influxFini()
+		otlpFini()
+		return
+	}
+	err, test := establishSessionWithRetry(testParam, server)
+	if err == errDuplicateTest {
+		ui.printErr("Error: %v", err)
+		os.Exit(1)
+	}
 	if err != nil {
 		ui.printErr("%v", err)
 		return
 	}
-	runTest(test, d)
+	var loadTest *ethrTest
+	if gLoadedLatency {
+		loadParam := testParam
+		loadParam.TestId = EthrTestId{Tcp, Bandwidth}
+		loadParam.OneWay = false
+		err, loadTest = establishSessionWithRetry(loadParam, server)
+		if err != nil {
+			ui.printErr("Unable to start bandwidth test for latency under load: %v", err)
+			return
+		}
+	}
+	runTest(test, d, loadTest)
+	passed := checkThresholds(test)
+	outputFini()
+	hdrFini()
+	rawLatencyFini()
+	influxFini()
+	otlpFini()
+	if !passed {
+		os.Exit(1)
+	}
 }
 
 func initClient() {
 	initClientUi()
 }
 
+//
+// Errors for tests that the server rejected, which are not worth retrying.
+//
+type ethrRejectedError struct {
+	msg string
+}
+
+func (e *ethrRejectedError) Error() string {
+	return e.msg
+}
+
+var gRetries int
+var gRetryDelay = time.Second
+
+const maxRetryDelay = 30 * time.Second
+
+//
+// With "-retries", failures to connect to the server or to complete the
+// handshake are retried with exponential backoff, starting at "-retry-delay",
+// as they are often transient on flaky networks.
+//
+func establishSessionWithRetry(testParam EthrTestParam, server string) (err error, test *ethrTest) {
+	delay := gRetryDelay
+	for attempt := 1; ; attempt++ {
+		err, test = establishSession(testParam, server)
+		if err == nil || err == errDuplicateTest || err == os.ErrExist || attempt > gRetries {
+			return
+		}
+		if _, ok := err.(*ethrRejectedError); ok {
+			return
+		}
+		ui.printMsg("Unable to establish session with %s: %v. Retrying in %v (%d of %d).",
+			server, err, delay, attempt, gRetries)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
 func establishSession(testParam EthrTestParam, server string) (err error, test *ethrTest) {
-	conn, err := net.Dial(protoTCP, server+":"+ctrlPort)
+	conn, err := net.Dial(protoTCP, joinHostPort(server, ctrlPort))
 	if err != nil {
 		return
 	}
@@ -44,9 +166,16 @@ func establishSession(testParam EthrTestParam, server string) (err error, test *
 			conn.Close()
 		}
 	}()
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-	ethrMsg := createSynMsg(testParam)
+	err = setKeepAlive(conn, gCtrlKeepAlive)
+	if err != nil {
+		return
+	}
+	enc, dec, err := newCtrlCodec(conn)
+	if err != nil {
+		return
+	}
+	testUuid := newTestUuid()
+	ethrMsg := createSynMsg(testParam, testUuid)
 	err = sendSessionMsg(enc, ethrMsg)
 	if err != nil {
 		return
@@ -57,22 +186,53 @@ func establishSession(testParam EthrTestParam, server string) (err error, test *
 		sendSessionMsg(enc, ethrMsg)
 		return
 	}
-	ethrMsg = recvSessionMsg(test.dec)
+	test.uuid = testUuid
+	ethrMsg, err = recvSessionMsg(test.dec)
+	if err != nil {
+		err = fmt.Errorf("Error receiving response from the server: %v", err)
+		deleteTest(test)
+		return
+	}
 	if ethrMsg.Type != EthrAck {
 		if ethrMsg.Type == EthrFin {
-			err = fmt.Errorf("%s", ethrMsg.Fin.Message)
+			if strings.HasPrefix(ethrMsg.Fin.Message, rejectedDuplicateMsg) {
+				ui.printDbg("%s", ethrMsg.Fin.Message)
+				err = errDuplicateTest
+			} else {
+				err = &ethrRejectedError{ethrMsg.Fin.Message}
+			}
 		} else {
 			err = fmt.Errorf("Unexpected control message received. %v", ethrMsg)
 		}
 		deleteTest(test)
+	} else if ethrMsg.Ack != nil {
+		if ethrMsg.Ack.Port != "" {
+			useServerPort(testParam.TestId, ethrMsg.Ack.Port)
+		}
+		test.dataToken = ethrMsg.Ack.DataToken
+		test.connCounts = ethrMsg.Ack.ConnCounts
 	}
 	return
 }
 
+//
+// The port is only changed if it differs, as it is shared with the server
+// in the self-test.
+//
+func useServerPort(testId EthrTestId, port string) {
+	p := testPort(testId)
+	if p != nil && *p != port {
+		ui.printDbg("Using port %s for %s %s test, as sent by the server", port,
+			protoToString(testId.Protocol), testToString(testId.Type))
+		*p = port
+	}
+}
+
 const (
-	timeout    = 0
-	interrupt  = 1
-	serverDone = 2
+	timeout       = 0
+	interrupt     = 1
+	serverDone    = 2
+	intervalsDone = 3
 )
 
 func handleCtrlC(toStop chan int) {
@@ -100,21 +260,90 @@ func runDurationTimer(d time.Duration, toStop chan int) {
 	}()
 }
 
+func runIntervalCounter(toStop chan int) {
+	go func() {
+		<-gIntervalsDone
+		toStop <- intervalsDone
+	}()
+}
+
+//
+// With "-interactive", the test can be paused, resumed and stopped with
+// commands read from stdin, one per line: "p" or a space to pause, "r" to
+// resume and "q" to quit. Statistics are kept while the test is paused.
+//
+var gInteractive bool
+
+func handleKeyboard(test *ethrTest, toStop chan int) {
+	ui.printMsg("Enter \"p\" to pause, \"r\" to resume or \"q\" to quit the test.")
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			switch strings.TrimRight(scanner.Text(), "\r") {
+			case "p", " ":
+				if test.isPaused() {
+					continue
+				}
+				test.setPaused(true)
+				test.sendMsg(createPauseMsg(test.testParam.TestId, true))
+				ui.printMsg("Test paused.")
+			case "r":
+				if !test.isPaused() {
+					continue
+				}
+				test.sendMsg(createPauseMsg(test.testParam.TestId, false))
+				test.setPaused(false)
+				ui.printMsg("Test resumed.")
+			case "q":
+				toStop <- interrupt
+				return
+			}
+		}
+	}()
+}
+
+//
+// The server sends nothing after the Ack, except EthrEnd when it ends the
+// test itself, e.g. once the p99 of a latency test is stable, see
+// endStableLatencyTest. Older servers just close the connection.
+//
 func monitorControlChannel(test *ethrTest, toStop chan int) {
 	go func() {
-		var b [1]byte
-		_, _ = test.ctrlConn.Read(b[0:])
+		ethrMsg, _ := recvSessionMsg(test.dec)
+		if ethrMsg.Type == EthrEnd {
+			if ethrMsg.End.Message != "" {
+				ui.printMsg("Server ended the test: %s.", ethrMsg.End.Message)
+			}
+			test.serverEnd <- ethrMsg.End
+		}
 		toStop <- serverDone
 	}()
 }
 
-func runTest(test *ethrTest, d time.Duration) {
+//
+// If loadTest is not nil, it is a TCP bandwidth test that runs in parallel to
+// the main test, e.g. to measure latency under load.
+//
+func runTest(test *ethrTest, d time.Duration, loadTest *ethrTest) int {
+	if test.uuid != "" {
+		ui.printMsg("Test id %s", test.uuid)
+	}
+	if gLabel != "" {
+		ui.printMsg("Label %s", gLabel)
+	}
+	ui.printMsg("Control connection to %s (%s)", test.ctrlConn.RemoteAddr(),
+		addrFamily(test.ctrlConn.RemoteAddr()))
 	startStatsTimer()
 	if test.testParam.TestId.Protocol == Tcp {
 		if test.testParam.TestId.Type == Bandwidth {
 			go runBandwidthTest(test)
 		} else if test.testParam.TestId.Type == Cps {
 			go runCpsTest(test)
+		} else if test.testParam.TestId.Type == PingPong {
+			go runPingPongTest(test)
+		} else if test.testParam.TestId.Type == ConnLatency {
+			ui.emitLatencyHdr()
+			go runConnLatencyTest(test)
 		} else if test.testParam.TestId.Type == Latency {
 			ui.emitLatencyHdr()
 			go runLatencyTest(test)
@@ -124,102 +353,633 @@ func runTest(test *ethrTest, d time.Duration) {
 			go runPpsTest(test)
 		}
 	} else if test.testParam.TestId.Protocol == Http {
-		go runHttpTest(test)
+		if test.testParam.TestId.Type == Download {
+			go runHttpDownloadTest(test)
+		} else if test.testParam.TestId.Type == Echo {
+			go runHttpEchoTest(test)
+		} else {
+			go runHttpTest(test)
+		}
+	} else if test.testParam.TestId.Protocol == Quic {
+		if test.testParam.TestId.Type == Download {
+			go runQuicDownloadTest(test)
+		} else {
+			go runQuicTest(test)
+		}
+	} else if test.testParam.TestId.Protocol == Grpc {
+		go runGrpcTest(test)
+	} else if test.testParam.TestId.Protocol == Sctp {
+		if test.testParam.TestId.Type == Bandwidth {
+			go runBandwidthTest(test)
+		} else if test.testParam.TestId.Type == Latency {
+			ui.emitLatencyHdr()
+			go runLatencyTest(test)
+		}
 	}
-	test.isActive = true
-	ethrMsg := createAckMsg()
+	test.setActive(true)
+	ethrMsg := createAckMsg("")
 	err := sendSessionMsg(test.enc, ethrMsg)
 	if err != nil {
 		os.Exit(1)
 	}
+	start := time.Now()
 	toStop := make(chan int, 1)
+	if loadTest != nil {
+		ui.printMsg("Measuring latency under load, running TCP bandwidth test in parallel.")
+		go runBandwidthTest(loadTest)
+		loadTest.setActive(true)
+		err = sendSessionMsg(loadTest.enc, createAckMsg(""))
+		if err != nil {
+			os.Exit(1)
+		}
+		monitorControlChannel(loadTest, toStop)
+	}
 	runDurationTimer(d, toStop)
+	runIntervalCounter(toStop)
 	monitorControlChannel(test, toStop)
 	handleCtrlC(toStop)
+	if gInteractive {
+		handleKeyboard(test, toStop)
+	}
 	reason := <-toStop
-	close(test.done)
-	test.ctrlConn.Close()
+	stopTest(test, reason)
+	if loadTest != nil {
+		stopTest(loadTest, reason)
+	}
 	stopStatsTimer()
+	if test.testParam.TestId.Type == Bandwidth || test.testParam.TestId.Type == Download {
+		emitBandwidthSummary(test)
+		emitStreamSummary(test)
+		emitHttpTimingSummary(test)
+	} else if test.testParam.TestId.Type == Cps {
+		emitCpsSummary(test)
+	} else if test.testParam.TestId.Type == PingPong {
+		emitPingPongSummary(test)
+	} else if test.testParam.TestId.Type == Echo {
+		emitEchoSummary(test)
+	} else if test.testParam.TestId.Type == Latency || test.testParam.TestId.Type == ConnLatency {
+		emitLatencySummary(test)
+	}
+	if loadTest != nil {
+		emitBandwidthSummary(loadTest)
+	}
 	switch reason {
 	case timeout:
 		ui.printMsg("Ethr done, duration: " + d.String() + ".")
 	case interrupt:
 		ui.printMsg("Ethr done, received interrupt signal.")
 	case serverDone:
-		ui.printMsg("Ethr done, server terminated the session.")
+		if limit := test.testParam.TotalBytes; limit > 0 && clientBytesSent(test) >= limit {
+			// The server ends the test once it received all bytes.
+			ui.printMsg("Ethr done, transferred %sBytes in %s.", numberToUnit(limit),
+				durationToString(time.Since(start)))
+		} else {
+			ui.printMsg("Ethr done, server terminated the session.")
+		}
+	case intervalsDone:
+		ui.printMsg("Ethr done, reported %d intervals.", gIntervalCount)
+	}
+	return reason
+}
+
+func clientBytesSent(test *ethrTest) uint64 {
+	sent := atomic.LoadUint64(&test.testResult.total)
+	if counter := test.intervalCounter(); counter != nil {
+		sent += atomic.LoadUint64(counter)
 	}
+	return sent
+}
+
+var gSweepSizes []uint32
+
+//
+// Pause between the phases of a sweep, so the server is done tearing down
+// the previous test before the next one starts.
+//
+const sweepPause = 2 * time.Second
+
+//
+// With "-sweep", a bandwidth test is run for each buffer size in turn, each
+// with its own session, and the results are compared at the end to help
+// find the buffer size that gives the best bandwidth.
+//
+func runSweep(testParam EthrTestParam, server string, d time.Duration) {
+	type sweepResult struct {
+		size                  uint32
+		n                     int
+		min, avg, max, stddev uint64
+	}
+	var results []sweepResult
+	for i, size := range gSweepSizes {
+		if i > 0 {
+			time.Sleep(sweepPause)
+		}
+		ui.printMsg("Sweep %d of %d: running bandwidth test with buffer size %sB.",
+			i+1, len(gSweepSizes), numberToUnit(uint64(size)))
+		testParam.BufferSize = size
+		err, test := establishSessionWithRetry(testParam, server)
+		if err != nil {
+			ui.printErr("Error: %v", err)
+			break
+		}
+		gInterval = 0
+		reason := runTest(test, d, nil)
+		deleteTest(test)
+		r := sweepResult{size: size}
+		r.n, r.min, r.avg, r.max, r.stddev = getBandwidthSummary(test)
+		results = append(results, r)
+		if reason == interrupt {
+			break
+		}
+	}
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	ui.printMsg("%10s %10s %10s %10s %10s", "Buffer", "Min", "Avg", "Max", "StdDev")
+	best := -1
+	for i, r := range results {
+		if r.n == 0 {
+			ui.printMsg("%10s %10s", numberToUnit(uint64(r.size))+"B", "-")
+			continue
+		}
+		if best < 0 || r.avg > results[best].avg {
+			best = i
+		}
+		ui.printMsg("%10s %10s %10s %10s %10s", numberToUnit(uint64(r.size))+"B",
+			bytesToRate(r.min), bytesToRate(r.avg), bytesToRate(r.max), bytesToRate(r.stddev))
+	}
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	if best >= 0 {
+		ui.printMsg("Best average bandwidth ("+rateUnit()+") %s with buffer size %sB.",
+			bytesToRate(results[best].avg), numberToUnit(uint64(results[best].size)))
+	}
+}
+
+//
+// With "-family both", the test runs over IPv4 and then over IPv6, each for
+// the duration, and the results are shown side by side, to compare the paths
+// of both families to the server.
+//
+func runFamilies(testParam EthrTestParam, server string, d time.Duration) {
+	type familyResult struct {
+		family int
+		addr   string
+		result string
+	}
+	var results []familyResult
+	for i, family := range []int{family4, family6} {
+		addr, err := resolveFamily(server, family)
+		if err != nil {
+			ui.printErr("Skipping %s test: %v", familyToString(family), err)
+			results = append(results, familyResult{family, "-", "-"})
+			continue
+		}
+		if i > 0 {
+			time.Sleep(sweepPause)
+		}
+		ui.printMsg("Running test over %s, to %s.", familyToString(family), addr)
+		err, test := establishSessionWithRetry(testParam, addr)
+		if err != nil {
+			ui.printErr("Error: %v", err)
+			results = append(results, familyResult{family, addr, "-"})
+			continue
+		}
+		gInterval = 0
+		start := time.Now()
+		reason := runTest(test, d, nil)
+		deleteTest(test)
+		results = append(results, familyResult{family, addr, familyResultString(test, time.Since(start))})
+		if reason == interrupt {
+			break
+		}
+	}
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	ui.printMsg("%-6s %-40s %s", "Family", "Address", testToString(testParam.TestId.Type))
+	for _, r := range results {
+		ui.printMsg("%-6s %-40s %s", familyToString(r.family), r.addr, r.result)
+	}
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+}
+
+func familyResultString(test *ethrTest, elapsed time.Duration) string {
+	switch test.testParam.TestId.Type {
+	case Bandwidth, Download:
+		n, min, avg, max, _ := getBandwidthSummary(test)
+		if n == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("avg %s, min %s, max %s %s", bytesToRate(avg), bytesToRate(min), bytesToRate(max),
+			strings.ToLower(rateUnit()))
+	case Echo:
+		n, _, avg, _, _ := getBandwidthSummary(test)
+		if n == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("upload avg %s, download avg %s %s", bytesToRate(avg),
+			bytesToRate(atomic.LoadUint64(&test.testResult.echoTotal)/uint64(n)), strings.ToLower(rateUnit()))
+	case Latency, ConnLatency:
+		if test.digest == nil {
+			return "-"
+		}
+		n, avg, _, _ := test.digest.summary()
+		if n == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("avg %s, p50 %s, p99 %s", latencyToString(avg),
+			latencyToString(test.digest.quantile(0.5)), latencyToString(test.digest.quantile(0.99)))
+	}
+	rate := uint64(float64(atomic.LoadUint64(&test.testResult.total)) / elapsed.Seconds())
+	switch test.testParam.TestId.Type {
+	case Cps:
+		return "avg " + cpsToString(rate) + " conn/s"
+	case Pps:
+		return "avg " + ppsToString(rate) + " pkt/s"
+	case PingPong:
+		return "avg " + numberToUnit(rate) + " trans/s"
+	}
+	return "-"
+}
+
+//
+// With "-session", the client leaves without stopping the test, so that the
+// server keeps it for the next client to reattach, see reattachTest.
+//
+func stopTest(test *ethrTest, reason int) {
+	close(test.done)
+	if gSessionName != "" && reason != serverDone {
+		ui.printMsg("Detaching from session %s, the server keeps the test for a client to reattach.",
+			gSessionName)
+	} else if reason != serverDone {
+		test.sendMsg(createStopMsg(test.testParam.TestId))
+		if test.connCounts && test.testParam.TestId.Type == Cps {
+			waitServerConnCounts(test)
+		}
+	}
+	test.ctrlConn.Close()
+}
+
+//
+// The server sends its counts of connections in reply to EthrStop, which the
+// goroutine reading the control connection hands over, see
+// monitorControlChannel. They are kept in serverEnd for the summary.
+//
+const serverCountsTimeout = 2 * time.Second
+
+func waitServerConnCounts(test *ethrTest) {
+	select {
+	case end := <-test.serverEnd:
+		test.serverEnd <- end
+	case <-time.After(serverCountsTimeout):
+		ui.printDbg("No connection counts received from the server within %v", serverCountsTimeout)
+	}
+}
+
+//
+// With "-ramp", the streams of a bandwidth test are started one after the
+// other, evenly spread over the given time, rather than all at once, so that
+// the first intervals are not skewed by all of them connecting and ramping up
+// together. The first stream starts right away, and the last one at the end
+// of the ramp.
+//
+var gRamp time.Duration
+
+func rampDelay(th, numThreads uint32) time.Duration {
+	if gRamp == 0 || numThreads < 2 {
+		return 0
+	}
+	return gRamp * time.Duration(th) / time.Duration(numThreads-1)
 }
 
 func runBandwidthTest(test *ethrTest) {
 	server := test.session.remoteAddr
-	ui.printMsg("Connecting to host %s, port %s", server, tcpBandwidthPort)
+	port := tcpBandwidthPort
+	if test.testParam.TestId.Protocol == Sctp {
+		port = sctpBandwidthPort
+	}
+	ui.printMsg("Connecting to host %s, port %s", server, port)
+	start := time.Now()
+	var connected uint32
 	for th := uint32(0); th < test.testParam.NumThreads; th++ {
 		buff := make([]byte, test.testParam.BufferSize)
 		for i := uint32(0); i < test.testParam.BufferSize; i++ {
 			buff[i] = byte(i)
 		}
-		go func() {
-			conn, err := net.Dial(protoTCP, server+":"+tcpBandwidthPort)
+		go func(th uint32) {
+			if d := rampDelay(th, test.testParam.NumThreads); d > 0 {
+				select {
+				case <-test.done:
+					return
+				case <-time.After(d):
+				}
+			}
+			// The server checks the pattern with "-verify", so after a
+			// partial write, the next write continues where it stopped.
+			offset := 0
+			conn, err := dialStream(test.testParam.TestId.Protocol, server, port)
 			if err != nil {
 				ui.printErr("%v", err)
 				os.Exit(1)
 				return
 			}
+			err = writeDataToken(conn, test)
+			if err != nil {
+				conn.Close()
+				ui.printErr("Error sending the token of a bandwidth connection: %v", err)
+				os.Exit(1)
+				return
+			}
+			tconn, err := tlsClientConn(conn, test)
+			if err != nil {
+				conn.Close()
+				ui.printErr("Error in the TLS handshake of a bandwidth connection: %v", err)
+				os.Exit(1)
+				return
+			}
+			conn = tconn
 			defer conn.Close()
+			err = setKeepAlive(conn, gDataKeepAlive)
+			if err != nil {
+				ui.printDbg("Unable to set keepalive on bandwidth connection: %v", err)
+			}
 			ec := test.newConn(conn)
 			rserver, rport, _ := net.SplitHostPort(conn.RemoteAddr().String())
 			lserver, lport, _ := net.SplitHostPort(conn.LocalAddr().String())
-			ui.printMsg("[%3d] local %s port %s connected to %s port %s",
-				ec.fd, lserver, lport, rserver, rport)
-			blen := len(buff)
+			ui.printMsg("[%3d] local %s port %s connected to %s port %s (%s)",
+				ec.fd, lserver, lport, rserver, rport, addrFamily(conn.RemoteAddr()))
+			if s := tlsConnString(conn); s != "" {
+				ui.printMsg("[%3d] using %s", ec.fd, s)
+			}
+			if gRamp > 0 && atomic.AddUint32(&connected, 1) == test.testParam.NumThreads {
+				ui.printMsg("All %d streams running, %s after the start of the test.",
+					test.testParam.NumThreads, durationToString(time.Since(start)))
+			}
 		ExitForLoop:
 			for {
 				select {
 				case <-test.done:
 					break ExitForLoop
 				default:
-					n, err := conn.Write(buff)
-					if err != nil {
-						// ui.printErr(err)
-						// test.ctrlConn.Close()
-						// return
+					if test.isPaused() {
+						time.Sleep(pausePollInterval)
 						continue
 					}
-					if n < blen {
-						// ui.printErr("Partial write: " + strconv.Itoa(n))
+					// Count partial writes as well, so the total matches
+					// the bytes that were actually sent.
+					n, err := conn.Write(buff[offset:])
+					offset = (offset + n) % len(buff)
+					atomic.AddUint64(&ec.data, uint64(n))
+					atomic.AddUint64(&test.testResult.bytes, uint64(n))
+					if err != nil {
+						// ui.printErr(err)
 						// test.ctrlConn.Close()
 						// return
 						continue
 					}
-					atomic.AddUint64(&ec.data, uint64(blen))
-					atomic.AddUint64(&test.testResult.data, uint64(blen))
 				}
 			}
-		}()
+		}(th)
 	}
 }
 
+//
+// If a local port range is specified, connections/s tests cycle through it
+// with SO_REUSEADDR set, instead of consuming the ephemeral port range. As
+// connections are reset on close, the server doesn't accumulate TIME_WAIT
+// state either way, but it sees a bounded set of client ports.
+//
+var gCpsPortMin, gCpsPortMax uint16
+var gCpsPortNext uint32
+var gPortExhaustionReported uint32
+
+func dialCpsConn(server string) (net.Conn, error) {
+	d := net.Dialer{}
+	if gCpsPortMin != 0 {
+		n := atomic.AddUint32(&gCpsPortNext, 1)
+		port := int(gCpsPortMin) + int(n%(uint32(gCpsPortMax-gCpsPortMin)+1))
+		d.LocalAddr = &net.TCPAddr{Port: port}
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setReuseAddr(fd)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+	return d.Dial(protoTCP, joinHostPort(server, tcpCpsPort))
+}
+
 func runCpsTest(test *ethrTest) {
 	server := test.session.remoteAddr
 	for th := uint32(0); th < test.testParam.NumThreads; th++ {
 		go func() {
+			pacer := newCpsPacer(test.testParam.NumThreads)
 		ExitForLoop:
 			for {
 				select {
 				case <-test.done:
 					break ExitForLoop
 				default:
-					conn, err := net.Dial(protoTCP, server+":"+tcpCpsPort)
-					if err == nil {
-						atomic.AddUint64(&test.testResult.data, 1)
+					if pacer != nil && !pacer.wait(test.done) {
+						break ExitForLoop
+					}
+					start := time.Now()
+					conn, err := dialCpsConn(server)
+					if err == nil && test.testParam.CpsCloseWait {
+						atomic.AddUint64(&test.testResult.connections, 1)
+						waitCpsClose(test, conn, start)
+					} else if err == nil {
+						atomic.AddUint64(&test.testResult.connections, 1)
 						tcpconn, ok := conn.(*net.TCPConn)
 						if ok {
 							tcpconn.SetLinger(0)
 						}
 						conn.Close()
+					} else if isAddrNotAvailError(err) {
+						atomic.AddUint64(&test.testResult.connectFailed, 1)
+						if atomic.CompareAndSwapUint32(&gPortExhaustionReported, 0, 1) {
+							ui.printErr("Error: Local port space exhausted, unable to open new connections. " +
+								portExhaustionAdvice)
+						}
+					} else if isConnRefusedError(err) {
+						atomic.AddUint64(&test.testResult.refused, 1)
+					} else {
+						atomic.AddUint64(&test.testResult.connectFailed, 1)
 					}
 				}
 			}
+			if pacer != nil {
+				pacer.flush()
+			}
+		}()
+	}
+}
+
+//
+// The server closes the connection as soon as it accepts it, so the close
+// phase is the time from connecting to reading the server's FIN and closing
+// the connection in turn. Connections the server doesn't close within
+// cpsCloseTimeout are reset, and not counted in the close latency.
+//
+const cpsCloseTimeout = 5 * time.Second
+
+func waitCpsClose(test *ethrTest, conn net.Conn, start time.Time) {
+	connected := time.Now()
+	conn.SetReadDeadline(connected.Add(cpsCloseTimeout))
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	if err != io.EOF {
+		ui.printDbg("Connection not closed by the server in conn/s test: %v", err)
+		if tcpconn, ok := conn.(*net.TCPConn); ok {
+			tcpconn.SetLinger(0)
+		}
+		conn.Close()
+		return
+	}
+	conn.Close()
+	closed := time.Now()
+	atomic.AddUint64(&test.testResult.cpsInterval.connectNs, uint64(connected.Sub(start)))
+	atomic.AddUint64(&test.testResult.cpsInterval.closeNs, uint64(closed.Sub(connected)))
+	atomic.AddUint64(&test.testResult.cpsInterval.count, 1)
+}
+
+//
+// The connection latency test measures the whole life of a connection, from
+// connecting to closing it gracefully. As with "-cps-close", the server closes
+// each connection as soon as it accepts it, and the client closes it once it
+// sees the FIN. Each connection is one sample, so results are computed and
+// shown as for the latency test. Failed connects are retried after a delay
+// doubled for each failure in a row, up to connLatencyMaxBackoff, so that a
+// server that is down or out of ports isn't hammered.
+//
+const (
+	connLatencyMinBackoff = 10 * time.Millisecond
+	connLatencyMaxBackoff = time.Second
+)
+
+func runConnLatencyTest(test *ethrTest) {
+	server := test.session.remoteAddr
+	ui.printMsg("Connecting to host %s, port %s", server, tcpCpsPort)
+	rttCount := test.testParam.RttCount
+	latencyNumbers := make([]time.Duration, 0, rttCount)
+	windowSize := test.testParam.LatencyWindow
+	if windowSize == 0 {
+		windowSize = rttCount
+	}
+	window := newLatencyWindow(windowSize)
+	var b [1]byte
+	backoff := connLatencyMinBackoff
+	for {
+		batchStart := time.Now()
+		latencyNumbers = latencyNumbers[:0]
+		for i := uint32(0); i < rttCount; i++ {
+			select {
+			case <-test.done:
+				return
+			default:
+			}
+			s1 := time.Now()
+			conn, err := dialCpsConn(server)
+			if err != nil {
+				ui.printDbg("Error connecting in connection latency test: %v", err)
+				if isAddrNotAvailError(err) &&
+					atomic.CompareAndSwapUint32(&gPortExhaustionReported, 0, 1) {
+					ui.printErr("Error: Local port space exhausted, unable to open new connections. " +
+						portExhaustionAdvice)
+				}
+				select {
+				case <-test.done:
+					return
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > connLatencyMaxBackoff {
+					backoff = connLatencyMaxBackoff
+				}
+				continue
+			}
+			backoff = connLatencyMinBackoff
+			conn.SetReadDeadline(s1.Add(cpsCloseTimeout))
+			_, err = conn.Read(b[:])
+			if err != io.EOF {
+				ui.printDbg("Connection not closed by the server in connection latency test: %v", err)
+				if tcpconn, ok := conn.(*net.TCPConn); ok {
+					tcpconn.SetLinger(0)
+				}
+				conn.Close()
+				continue
+			}
+			conn.Close()
+			e2 := time.Since(s1)
+			atomic.AddUint64(&test.testResult.connections, 1)
+			latencyNumbers = append(latencyNumbers, e2)
+			window.add(e2)
+		}
+		if len(latencyNumbers) == 0 {
+			continue
+		}
+		test.addLatencySamples(latencyNumbers)
+		avg, min, max, p50, p90, p95, p99, p999, p9999, stddev := calcLatencyResults(window.values())
+		if hdrEnabled() {
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev =
+				hdrRecordLatency(server, batchStart, latencyNumbers, window.values())
+		}
+		ui.emitLatencyResults(server, protoToString(test.testParam.TestId.Protocol),
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
+	}
+}
+
+//
+// Each thread sends a full buffer and waits for the server to echo all of
+// it, before sending the next one, see runPingPongHandler.
+//
+func runPingPongTest(test *ethrTest) {
+	server := test.session.remoteAddr
+	ui.printMsg("Connecting to host %s, port %s", server, tcpPingPongPort)
+	for th := uint32(0); th < test.testParam.NumThreads; th++ {
+		go func() {
+			conn, err := net.Dial(protoTCP, joinHostPort(server, tcpPingPongPort))
+			if err != nil {
+				ui.printErr("%v", err)
+				os.Exit(1)
+				return
+			}
+			defer conn.Close()
+			err = setNoDelay(conn, !test.testParam.EnableNagle)
+			if err != nil {
+				ui.printDbg("Unable to set TCP_NODELAY for ping-pong test: %v", err)
+			}
+			ec := test.newConn(conn)
+			rserver, rport, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			lserver, lport, _ := net.SplitHostPort(conn.LocalAddr().String())
+			ui.printMsg("[%3d] local %s port %s connected to %s port %s (%s)",
+				ec.fd, lserver, lport, rserver, rport, addrFamily(conn.RemoteAddr()))
+			req := make([]byte, test.testParam.BufferSize)
+			for i := range req {
+				req[i] = byte(i)
+			}
+			resp := make([]byte, len(req))
+		ExitForLoop:
+			for {
+				select {
+				case <-test.done:
+					break ExitForLoop
+				default:
+					if test.isPaused() {
+						time.Sleep(pausePollInterval)
+						continue
+					}
+					_, err = conn.Write(req)
+					if err == nil {
+						_, err = io.ReadFull(conn, resp)
+					}
+					if err != nil {
+						ui.printDbg("Error in ping-pong exchange: %v", err)
+						break ExitForLoop
+					}
+					atomic.AddUint64(&test.testResult.transactions, 1)
+				}
+			}
 		}()
 	}
 }
@@ -229,7 +989,7 @@ func runPpsTest(test *ethrTest) {
 	for th := uint32(0); th < test.testParam.NumThreads; th++ {
 		go func() {
 			buff := make([]byte, test.testParam.BufferSize)
-			conn, err := net.Dial(protoUDP, server+":"+udpPpsPort)
+			conn, err := net.Dial(protoUDP, joinHostPort(server, udpPpsPort))
 			if err != nil {
 				ui.printErr("%v", err)
 				os.Exit(1)
@@ -238,8 +998,17 @@ func runPpsTest(test *ethrTest) {
 			defer conn.Close()
 			rserver, rport, _ := net.SplitHostPort(conn.RemoteAddr().String())
 			lserver, lport, _ := net.SplitHostPort(conn.LocalAddr().String())
-			ui.printMsg("[udp] local %s port %s connected to %s port %s",
-				lserver, lport, rserver, rport)
+			ui.printMsg("[udp] local %s port %s connected to %s port %s (%s)",
+				lserver, lport, rserver, rport, addrFamily(conn.RemoteAddr()))
+			if gFragMode == fragDontFragment {
+				ipv6 := conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil
+				err = setDontFragment(getFd(conn), ipv6)
+				if err != nil {
+					ui.printErr("Unable to set the DF bit: %v", err)
+					os.Exit(1)
+				}
+			}
+			var mtuReported sync.Once
 			/*
 			   ethrMsg := createBgnMsg(lport)
 			   sendSessionMsg(test.enc, ethrMsg)
@@ -254,6 +1023,12 @@ func runPpsTest(test *ethrTest) {
 				default:
 					n, err := conn.Write(buff)
 					if err != nil {
+						if gFragMode == fragDontFragment && isMsgSizeError(err) {
+							mtuReported.Do(func() {
+								ui.printErr("UDP packets of %d bytes exceed the path MTU to %s "+
+									"and can't be sent with the DF bit set.", blen, rserver)
+							})
+						}
 						// ui.printErr(err)
 						// return
 						continue
@@ -263,33 +1038,103 @@ func runPpsTest(test *ethrTest) {
 						// return
 						continue
 					}
-					atomic.AddUint64(&test.testResult.data, 1)
+					atomic.AddUint64(&test.testResult.packets, 1)
 				}
 			}
 		}()
 	}
 }
 
+//
+// Datagrams larger than the path MTU would be silently fragmented by the IP
+// layer, which changes what is being measured. Reject such sizes up front,
+// using the MTU of the local interface the server is routed through.
+//
+const (
+	fragReject = iota
+	fragAllow
+	fragDontFragment
+)
+
+var gFragMode = fragReject
+
+func validatePpsPacketSize(server string, size uint32) error {
+	conn, err := net.Dial(protoUDP, joinHostPort(server, udpPpsPort))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	laddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	mtu := getInterfaceMtu(laddr.IP)
+	if mtu == 0 {
+		ui.printDbg("Unable to determine MTU for local address %s", laddr.IP)
+		return nil
+	}
+	// IP header + UDP header.
+	hdrLen := 20 + 8
+	if laddr.IP.To4() == nil {
+		hdrLen = 40 + 8
+	}
+	maxSize := mtu - hdrLen
+	if int(size) > maxSize {
+		return fmt.Errorf("UDP packet size %d bytes exceeds the maximum of %d bytes "+
+			"allowed without fragmentation (interface MTU %d)", size, maxSize, mtu)
+	}
+	return nil
+}
+
 func runLatencyTest(test *ethrTest) {
+	// Keep the latency measurement on its own OS thread, so it isn't
+	// multiplexed with other goroutines, e.g. the ones generating load.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
 	server := test.session.remoteAddr
-	conn, err := net.Dial(protoTCP, server+":"+tcpLatencyPort)
+	port := tcpLatencyPort
+	if test.testParam.TestId.Protocol == Sctp {
+		port = sctpLatencyPort
+	}
+	conn, err := dialStream(test.testParam.TestId.Protocol, server, port)
 	if err != nil {
 		ui.printErr("Error dialing the latency connection: %v", err)
 		os.Exit(1)
 		return
 	}
+	tconn, err := tlsClientConn(conn, test)
+	if err != nil {
+		conn.Close()
+		ui.printErr("Error in the TLS handshake of the latency connection: %v", err)
+		os.Exit(1)
+		return
+	}
+	conn = tconn
 	defer conn.Close()
+	if s := tlsConnString(conn); s != "" {
+		ui.printMsg("Latency connection using %s", s)
+	}
+	err = setNoDelay(conn, !test.testParam.EnableNagle)
+	if err != nil {
+		ui.printDbg("Unable to set TCP_NODELAY for latency test: %v", err)
+	}
 	buffSize := test.testParam.BufferSize
 	// TODO Override buffer size to 1 for now. Evaluate if we need to allow
 	// client to specify the buffer size in future.
-	buffSize = 1
+	buffSize = uint32(latencyMsgSize(test.testParam))
 	buff := make([]byte, buffSize)
 	for i := uint32(0); i < buffSize; i++ {
 		buff[i] = byte(i)
 	}
+	oneWay := test.testParam.OneWay
 	blen := len(buff)
 	rttCount := test.testParam.RttCount
 	latencyNumbers := make([]time.Duration, rttCount)
+	windowSize := test.testParam.LatencyWindow
+	if windowSize == 0 {
+		windowSize = rttCount
+	}
+	window := newLatencyWindow(windowSize)
 ExitForLoop:
 	for {
 	ExitSelect:
@@ -297,8 +1142,12 @@ ExitForLoop:
 		case <-test.done:
 			break ExitForLoop
 		default:
+			batchStart := time.Now()
 			for i := uint32(0); i < rttCount; i++ {
 				s1 := time.Now()
+				if oneWay {
+					stampLatencyMsg(buff)
+				}
 				n, err := conn.Write(buff)
 				if err != nil {
 					// ui.printErr(err)
@@ -318,83 +1167,369 @@ ExitForLoop:
 				}
 				e2 := time.Since(s1)
 				latencyNumbers[i] = e2
+				window.add(e2)
 			}
 			// TODO temp code, fix it better, this is to allow server to do
 			// server side latency measurements as well.
+			if oneWay {
+				stampLatencyMsg(buff)
+			}
 			_, _ = conn.Write(buff)
-			sum := int64(0)
-			for _, d := range latencyNumbers {
-				sum += d.Nanoseconds()
+			test.addLatencySamples(latencyNumbers)
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev := calcLatencyResults(window.values())
+			if hdrEnabled() {
+				avg, min, max, p50, p90, p95, p99, p999, p9999, stddev =
+					hdrRecordLatency(test.session.remoteAddr, batchStart, latencyNumbers, window.values())
 			}
-			elapsed := time.Duration(sum / int64(rttCount))
-			sort.SliceStable(latencyNumbers, func(i, j int) bool {
-				return latencyNumbers[i] < latencyNumbers[j]
-			})
-			//
-			// Special handling for rttCount == 1. This prevents negative index
-			// in the latencyNumber index. The other option is to use
-			// roundUpToZero() but that is more expensive.
-			//
-			rttCountFixed := rttCount
-			if rttCountFixed == 1 {
-				rttCountFixed = 2
-			}
-			avg := elapsed
-			min := latencyNumbers[0]
-			max := latencyNumbers[rttCount-1]
-			p50 := latencyNumbers[((rttCountFixed*50)/100)-1]
-			p90 := latencyNumbers[((rttCountFixed*90)/100)-1]
-			p95 := latencyNumbers[((rttCountFixed*95)/100)-1]
-			p99 := latencyNumbers[((rttCountFixed*99)/100)-1]
-			p999 := latencyNumbers[uint64(((float64(rttCountFixed)*99.9)/100)-1)]
-			p9999 := latencyNumbers[uint64(((float64(rttCountFixed)*99.99)/100)-1)]
 			ui.emitLatencyResults(
 				test.session.remoteAddr,
 				protoToString(test.testParam.TestId.Protocol),
-				avg, min, max, p50, p90, p95, p99, p999, p9999)
+				avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
 		}
 	}
 }
 
+//
+// All threads share one transport, limited to one connection per thread, so
+// that each thread keeps its own connection busy, like the streams of the TCP
+// bandwidth test. Connections are registered on the test as they are dialed,
+// so that results are shown per connection.
+//
+type httpConn struct {
+	net.Conn
+	ec *ethrConn
+}
+
 func runHttpTest(test *ethrTest) {
 	uri := test.session.remoteAddr
-	uri = "http://" + uri + ":" + httpBandwidthPort
+	uri = "http://" + joinHostPort(uri, httpBandwidthPort)
+	numConns := int(test.testParam.NumThreads)
+	tr := &http.Transport{
+		DisableCompression:  true,
+		MaxConnsPerHost:     numConns,
+		MaxIdleConnsPerHost: numConns,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			d := net.Dialer{KeepAlive: dataKeepAlivePeriod()}
+			conn, err := d.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			ec := test.newConn(conn)
+			rserver, rport, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			lserver, lport, _ := net.SplitHostPort(conn.LocalAddr().String())
+			ui.printMsg("[%3d] local %s port %s connected to %s port %s (%s)",
+				ec.fd, lserver, lport, rserver, rport, addrFamily(conn.RemoteAddr()))
+			return &httpConn{conn, ec}, nil
+		},
+	}
+	client := &http.Client{Transport: tr}
 	for th := uint32(0); th < test.testParam.NumThreads; th++ {
-		buff := make([]byte, test.testParam.BufferSize)
-		for i := uint32(0); i < test.testParam.BufferSize; i++ {
-			// buff[i] = byte(i)
-			buff[i] = 'x'
+		runHttpUploadLoop(test, client, uri)
+	}
+}
+
+func runQuicTest(test *ethrTest) {
+	uri := test.session.remoteAddr
+	uri = "https://" + joinHostPort(uri, quicBandwidthPort)
+	for th := uint32(0); th < test.testParam.NumThreads; th++ {
+		tr := &http3.Transport{
+			TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+			DisableCompression: true,
 		}
-		tr := &http.Transport{DisableCompression: true}
 		client := &http.Client{Transport: tr}
-		go func() {
-		ExitForLoop:
-			for {
-				select {
-				case <-test.done:
+		runHttpUploadLoop(test, client, uri)
+	}
+}
+
+func runHttpUploadLoop(test *ethrTest, client *http.Client, uri string) {
+	buff := make([]byte, test.testParam.BufferSize)
+	for i := uint32(0); i < test.testParam.BufferSize; i++ {
+		// buff[i] = byte(i)
+		buff[i] = 'x'
+	}
+	go func() {
+		var ec *ethrConn
+		trace := &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				ec = nil
+				if hc, ok := info.Conn.(*httpConn); ok {
+					ec = hc.ec
+				}
+			},
+		}
+		startRequest := addHttpTimingHooks(trace)
+		ctx := httptrace.WithClientTrace(context.Background(), trace)
+	ExitForLoop:
+		for {
+			select {
+			case <-test.done:
+				break ExitForLoop
+			default:
+				// response, err := http.Get(uri)
+				req, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewBuffer(buff))
+				if err != nil {
+					ui.printErr("Error creating HTTP request: %v", err)
 					break ExitForLoop
-				default:
-					// response, err := http.Get(uri)
-					response, err := client.Post(uri, "text/plain", bytes.NewBuffer(buff))
+				}
+				req.Header.Set("Content-Type", "text/plain")
+				startRequest()
+				response, err := client.Do(req)
+				if err != nil {
+					// ui.printErr("%v", err)
+					continue
+				} else {
+					if response.StatusCode != http.StatusOK {
+						continue
+					}
+					// contents, err := ioutil.ReadAll(response.Body)
+					_, err = ioutil.ReadAll(response.Body)
+					response.Body.Close()
 					if err != nil {
 						// ui.printErr("%v", err)
 						continue
-					} else {
-						if response.StatusCode != http.StatusOK {
-							continue
-						}
-						// contents, err := ioutil.ReadAll(response.Body)
-						_, err = ioutil.ReadAll(response.Body)
-						response.Body.Close()
-						if err != nil {
-							// ui.printErr("%v", err)
-							continue
-						}
-						// ui.printMsg("%s", string(contents))
 					}
-					atomic.AddUint64(&test.testResult.data, uint64(test.testParam.BufferSize))
+					// ui.printMsg("%s", string(contents))
+				}
+				atomic.AddUint64(&test.testResult.bytes, uint64(test.testParam.BufferSize))
+				if ec != nil {
+					atomic.AddUint64(&ec.data, uint64(test.testParam.BufferSize))
+				}
+			}
+		}
+	}()
+}
+
+func runHttpDownloadTest(test *ethrTest) {
+	uri := test.session.remoteAddr
+	uri = "http://" + joinHostPort(uri, httpBandwidthPort) + "/download?size=" +
+		strconv.FormatUint(uint64(test.testParam.BufferSize), 10)
+	for th := uint32(0); th < test.testParam.NumThreads; th++ {
+		d := &net.Dialer{KeepAlive: dataKeepAlivePeriod()}
+		tr := &http.Transport{DisableCompression: true, DialContext: d.DialContext}
+		client := &http.Client{Transport: tr}
+		go runHttpDownloadLoop(test, client, uri)
+	}
+}
+
+func runQuicDownloadTest(test *ethrTest) {
+	uri := test.session.remoteAddr
+	uri = "https://" + joinHostPort(uri, quicBandwidthPort) + "/download?size=" +
+		strconv.FormatUint(uint64(test.testParam.BufferSize), 10)
+	for th := uint32(0); th < test.testParam.NumThreads; th++ {
+		tr := &http3.Transport{
+			TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+			DisableCompression: true,
+		}
+		client := &http.Client{Transport: tr}
+		go runHttpDownloadLoop(test, client, uri)
+	}
+}
+
+//
+// Received bytes are counted as they are read, rather than per response, so
+// that large responses are spread over the intervals they arrive in.
+//
+func runHttpDownloadLoop(test *ethrTest, client *http.Client, uri string) {
+	buff := make([]byte, 64*1024)
+	trace := &httptrace.ClientTrace{}
+	startRequest := addHttpTimingHooks(trace)
+	ctx := httptrace.WithClientTrace(context.Background(), trace)
+	for {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+		if err != nil {
+			ui.printErr("Error creating HTTP request: %v", err)
+			return
+		}
+		startRequest()
+		response, err := client.Do(req)
+		if err != nil {
+			ui.printDbg("Error in HTTP download: %v", err)
+			time.Sleep(pausePollInterval)
+			continue
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			ui.printDbg("Unexpected HTTP status in download: %s", response.Status)
+			time.Sleep(pausePollInterval)
+			continue
+		}
+		for {
+			n, err := response.Body.Read(buff)
+			atomic.AddUint64(&test.testResult.bytes, uint64(n))
+			if err != nil {
+				break
+			}
+		}
+		response.Body.Close()
+	}
+}
+
+//
+// Each thread keeps one request open for the whole test, streaming its body
+// from a pipe while it reads the response, which the server echoes as it
+// reads the body, see handleHttpEcho. Bytes are counted as they are written
+// to the pipe and read from the response, so both directions are reported
+// in the intervals they are transferred in.
+//
+func runHttpEchoTest(test *ethrTest) {
+	uri := test.session.remoteAddr
+	uri = "http://" + joinHostPort(uri, httpBandwidthPort) + "/echo"
+	for th := uint32(0); th < test.testParam.NumThreads; th++ {
+		d := &net.Dialer{KeepAlive: dataKeepAlivePeriod()}
+		tr := &http.Transport{DisableCompression: true, DialContext: d.DialContext}
+		client := &http.Client{Transport: tr}
+		go runHttpEchoLoop(test, client, uri)
+	}
+}
+
+func runHttpEchoLoop(test *ethrTest, client *http.Client, uri string) {
+	buff := make([]byte, test.testParam.BufferSize)
+	for i := range buff {
+		buff[i] = 'x'
+	}
+	rbuff := make([]byte, 64*1024)
+	for {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		pr, pw := io.Pipe()
+		go func() {
+			for {
+				n, err := pw.Write(buff)
+				atomic.AddUint64(&test.testResult.bytes, uint64(n))
+				if err != nil {
+					return
 				}
 			}
 		}()
+		req, err := http.NewRequest("POST", uri, pr)
+		if err != nil {
+			ui.printErr("Error creating HTTP request: %v", err)
+			pw.Close()
+			return
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		response, err := client.Do(req)
+		if err != nil {
+			pw.CloseWithError(err)
+			ui.printDbg("Error in HTTP echo: %v", err)
+			time.Sleep(pausePollInterval)
+			continue
+		}
+		if response.StatusCode != http.StatusOK {
+			pw.Close()
+			response.Body.Close()
+			ui.printDbg("Unexpected HTTP status in echo: %s", response.Status)
+			time.Sleep(pausePollInterval)
+			continue
+		}
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-test.done:
+				pw.Close()
+				response.Body.Close()
+			case <-stop:
+			}
+		}()
+		for {
+			n, err := response.Body.Read(rbuff)
+			atomic.AddUint64(&test.testResult.echoBytes, uint64(n))
+			if err != nil {
+				break
+			}
+		}
+		close(stop)
+		pw.Close()
+		response.Body.Close()
+	}
+}
+
+//
+// If onDemand is set, the server only listens on the port while a test of
+// type testId is running, so it is checked only if that is the test requested.
+//
+type ethrPortCheck struct {
+	name     string
+	proto    string
+	port     string
+	testId   EthrTestId
+	onDemand bool
+}
+
+var gPortChecks = []ethrPortCheck{
+	{"TCP bandwidth", protoTCP, tcpBandwidthPort, EthrTestId{Tcp, Bandwidth}, false},
+	{"TCP conn/s", protoTCP, tcpCpsPort, EthrTestId{Tcp, Cps}, false},
+	{"TCP latency", protoTCP, tcpLatencyPort, EthrTestId{Tcp, Latency}, false},
+	{"TCP ping-pong", protoTCP, tcpPingPongPort, EthrTestId{Tcp, PingPong}, false},
+	{"TCP conn latency", protoTCP, tcpCpsPort, EthrTestId{Tcp, ConnLatency}, false},
+	{"UDP pkt/s", protoUDP, udpPpsPort, EthrTestId{Udp, Pps}, true},
+	{"HTTP bandwidth", protoTCP, httpBandwidthPort, EthrTestId{Http, Bandwidth}, false},
+	{"HTTP download", protoTCP, httpBandwidthPort, EthrTestId{Http, Download}, false},
+	{"QUIC bandwidth", protoUDP, quicBandwidthPort, EthrTestId{Quic, Bandwidth}, false},
+	{"gRPC", protoTCP, grpcPort, EthrTestId{Grpc, Bandwidth}, false},
+}
+
+//
+// Validation performs the control channel handshake and then opens one
+// connection to each data port while the session is established, tearing
+// everything down without running the test.
+//
+func runValidation(testParam EthrTestParam, server string) {
+	ui.printMsg("Validating connectivity to %s", server)
+	err, test := establishSession(testParam, server)
+	if err != nil {
+		ui.printErr("[ blocked ] Control channel (tcp/%s): %v", ctrlPort, err)
+		os.Exit(1)
+	}
+	ui.printMsg("[reachable] Control channel (tcp/%s), handshake succeeded", ctrlPort)
+	failed := false
+	for _, pc := range gPortChecks {
+		if pc.onDemand && pc.testId != testParam.TestId {
+			continue
+		}
+		status, ok := checkPort(server, pc.proto, pc.port)
+		if !ok {
+			failed = true
+		}
+		ui.printMsg("%s %s (%s/%s)", status, pc.name, pc.proto, pc.port)
+	}
+	test.ctrlConn.Close()
+	deleteTest(test)
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func checkPort(server, proto, port string) (string, bool) {
+	conn, err := net.DialTimeout(proto, joinHostPort(server, port), 3*time.Second)
+	if err != nil {
+		return "[ blocked ]", false
+	}
+	defer conn.Close()
+	if proto == protoTCP {
+		return "[reachable]", true
+	}
+	//
+	// UDP is connectionless, so the best that can be done is to detect an
+	// ICMP port unreachable. No response means the port is open or filtered.
+	//
+	conn.Write([]byte{0})
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, 1)
+	_, err = conn.Read(b)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return "[open/filtered]", true
+	}
+	if err != nil {
+		return "[ blocked ]", false
 	}
+	return "[reachable]", true
 }
@@ -7,6 +7,7 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -48,25 +49,30 @@ func (u *clientUi) emitTestResult(s []string) {
 */
 
 func (u *clientUi) emitTestHdr() {
-	s := []string{"ServerAddress", "Proto", "Bits/s", "Conn/s", "Pkt/s"}
+	s := []string{"ServerAddress", "Proto", rateUnit(), "Conn/s", "Pkt/s"}
 	fmt.Println("-----------------------------------------------------------")
 	fmt.Printf("%-15s %-5s %7s %7s %7s\n", s[0], s[1], s[2], s[3], s[4])
 }
 
 func (u *clientUi) emitLatencyHdr() {
-	s := []string{"Avg", "Min", "50%", "90%", "95%", "99%", "99.9%", "99.99%", "Max"}
+	s := []string{"Avg", "Min", "50%", "90%", "95%", "99%", "99.9%", "99.99%", "Max", "StdDev", "CV"}
 	fmt.Println("-----------------------------------------------------------")
-	fmt.Printf("%8s %8s %8s %8s %8s %8s %8s %8s %8s\n", s[0], s[1], s[2], s[3], s[4], s[5], s[6], s[7], s[8])
+	fmt.Printf("%8s %8s %8s %8s %8s %8s %8s %8s %8s %8s %5s\n", s[0], s[1], s[2], s[3], s[4], s[5], s[6], s[7],
+		s[8], s[9], s[10])
 }
 
-func (u *clientUi) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999 time.Duration) {
-	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999)
-	fmt.Printf("%8s %8s %8s %8s %8s %8s %8s %8s %8s\n",
-		durationToString(avg), durationToString(min),
-		durationToString(p50), durationToString(p90),
-		durationToString(p95), durationToString(p99),
-		durationToString(p999), durationToString(p9999),
-		durationToString(max))
+func (u *clientUi) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999,
+	p9999, stddev time.Duration) {
+	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
+	fmt.Printf("%8s %8s %8s %8s %8s %8s %8s %8s %8s %8s %5.2f\n",
+		latencyToString(avg), latencyToString(min),
+		latencyToString(p50), latencyToString(p90),
+		latencyToString(p95), latencyToString(p99),
+		latencyToString(p999), latencyToString(p9999),
+		latencyToString(max), latencyToString(stddev),
+		latencyCv(avg, stddev))
+	gLatencyInterval++
+	checkIntervalCount(gLatencyInterval)
 }
 
 func (u *clientUi) emitTestResultEnd() {
@@ -85,72 +91,178 @@ func initClientUi() {
 
 var gInterval uint64
 
+//
+// If gIntervalCount is non-zero, gIntervalsDone is closed once that many
+// result intervals have been reported, which stops the test.
+//
+var gIntervalCount uint64
+var gIntervalsDone = make(chan struct{})
+var gIntervalsDoneOnce sync.Once
+var gLatencyInterval uint64
+
+func checkIntervalCount(count uint64) {
+	if gIntervalCount > 0 && count >= gIntervalCount {
+		gIntervalsDoneOnce.Do(func() {
+			close(gIntervalsDone)
+		})
+	}
+}
+
+//
+// Bits/s is the goodput, i.e. the payload that the application transferred.
+// With "-wire", which is on by default, the rate on the wire including the
+// protocol headers, as estimated by estimateWireBytes, is shown as well.
+//
+var gWireRate = true
+
+func wireRateHdr() string {
+	if !gWireRate {
+		return ""
+	}
+	return "      Wire"
+}
+
+func wireRateStr(test *ethrTest, payload, packets uint64) string {
+	if !gWireRate {
+		return ""
+	}
+	return fmt.Sprintf("   %7s", bytesToRate(estimateWireBytes(test, payload, packets)))
+}
+
 func printTestResult(test *ethrTest, value uint64) {
-	if test.testParam.TestId.Type == Bandwidth && test.testParam.TestId.Protocol == Tcp {
+	if test.testParam.TestId.Type == Bandwidth && (test.testParam.TestId.Protocol == Tcp ||
+		test.testParam.TestId.Protocol == Sctp || test.testParam.TestId.Protocol == Http) {
 		if gInterval == 0 {
 			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
-			ui.printMsg("[ ID]   Protocol    Interval      Bits/s")
+			ui.printMsg("[ ID]   Protocol    Interval     %7s"+wireRateHdr(), rateUnit())
 		}
 		cvalue := uint64(0)
-		ccount := 0
+		var rates []uint64
 		test.connListDo(func(ec *ethrConn) {
 			value = atomic.SwapUint64(&ec.data, 0)
-			ui.printMsg("[%3d]     %-5s    %03d-%03d sec   %7s", ec.fd,
+			ui.printMsg("[%3d]     %-5s    %03d-%03d sec   %7s%s", ec.fd,
 				protoToString(test.testParam.TestId.Protocol),
-				gInterval, gInterval+1, bytesToRate(value))
+				gInterval, gInterval+1, bytesToRate(value), wireRateStr(test, value, 0))
+			ec.total += value
 			cvalue += value
-			ccount++
+			rates = append(rates, value)
 		})
-		if ccount > 1 {
-			ui.printMsg("[SUM]     %-5s    %03d-%03d sec   %7s",
+		if !test.isPaused() {
+			test.addBandwidthSample(cvalue)
+		}
+		if len(rates) > 1 {
+			ui.printMsg("[SUM]     %-5s    %03d-%03d sec   %7s%s",
 				protoToString(test.testParam.TestId.Protocol),
-				gInterval, gInterval+1, bytesToRate(cvalue))
+				gInterval, gInterval+1, bytesToRate(cvalue), wireRateStr(test, cvalue, 0))
+			min, max, stddev, jain := streamFairness(rates)
+			ui.printMsg("[FAIR]    %-5s    %03d-%03d sec   Min %s, Max %s, StdDev %s, Jain's index %.3f",
+				protoToString(test.testParam.TestId.Protocol), gInterval, gInterval+1,
+				bytesToRate(min), bytesToRate(max), bytesToRate(stddev), jain)
 			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
 		}
 		logResults([]string{test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
 			bytesToRate(cvalue), "", "", ""})
+		influxWrite(test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			"bandwidth", map[string]uint64{"bits_per_second": cvalue * 8})
+		emitHttpTimings(test)
+	} else if test.testParam.TestId == (EthrTestId{Udp, Bandwidth}) {
+		printMcastResult(test)
 	} else if test.testParam.TestId.Type == Cps {
 		if gInterval == 0 {
 			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
-			ui.printMsg("Protocol    Interval      Conn/s")
+			if test.testParam.CpsCloseWait {
+				ui.printMsg("Protocol    Interval      Conn/s    Connect      Close")
+			} else {
+				ui.printMsg("Protocol    Interval      Conn/s")
+			}
+		}
+		if test.testParam.CpsCloseWait {
+			connectAvg, closeAvg := test.swapCpsPhases()
+			ui.printMsg("  %-5s    %03d-%03d sec   %7s   %8s   %8s",
+				protoToString(test.testParam.TestId.Protocol),
+				gInterval, gInterval+1, cpsToString(value),
+				latencyToString(connectAvg), latencyToString(closeAvg))
+		} else {
+			ui.printMsg("  %-5s    %03d-%03d sec   %7s",
+				protoToString(test.testParam.TestId.Protocol),
+				gInterval, gInterval+1, cpsToString(value))
 		}
-		ui.printMsg("  %-5s    %03d-%03d sec   %7s",
-			protoToString(test.testParam.TestId.Protocol),
-			gInterval, gInterval+1, cpsToString(value))
 		logResults([]string{test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
 			"", cpsToString(value), "", ""})
+		influxWrite(test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			"cps", map[string]uint64{"connections_per_second": value})
 	} else if test.testParam.TestId.Type == Pps {
 		if gInterval == 0 {
 			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
-			ui.printMsg("Protocol    Interval      Pkts/s")
+			ui.printMsg("Protocol    Interval      Pkts/s   %7s"+wireRateHdr(), rateUnit())
+		}
+		bw := value * uint64(test.testParam.BufferSize)
+		ui.printMsg("  %-5s    %03d-%03d sec   %7s   %7s%s",
+			protoToString(test.testParam.TestId.Protocol),
+			gInterval, gInterval+1, ppsToString(value), bytesToRate(bw),
+			wireRateStr(test, bw, value))
+		logResults([]string{test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			bytesToRate(bw), "", ppsToString(value), ""})
+		influxWrite(test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			"pps", map[string]uint64{"packets_per_second": value, "bits_per_second": bw * 8})
+	} else if test.testParam.TestId.Type == PingPong {
+		if gInterval == 0 {
+			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
+			ui.printMsg("Protocol    Interval     Trans/s   %7s", rateUnit())
+		}
+		// Bytes echoed back per second, the same number is sent.
+		bw := value * uint64(test.testParam.BufferSize)
+		ui.printMsg("  %-5s    %03d-%03d sec   %7s   %7s",
+			protoToString(test.testParam.TestId.Protocol),
+			gInterval, gInterval+1, numberToUnit(value), bytesToRate(bw))
+		logResults([]string{test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			bytesToRate(bw), "", "", ""})
+		influxWrite(test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			"pingpong", map[string]uint64{"transactions_per_second": value, "bits_per_second": bw * 8})
+	} else if test.testParam.TestId.Type == Echo {
+		if gInterval == 0 {
+			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
+			ui.printMsg("Protocol    Interval     %9s   %9s", "TX "+rateUnit(), "RX "+rateUnit())
 		}
-		ui.printMsg("  %-5s    %03d-%03d sec   %7s",
+		rx := atomic.SwapUint64(&test.testResult.echoBytes, 0)
+		atomic.AddUint64(&test.testResult.echoTotal, rx)
+		test.addBandwidthSample(value)
+		ui.printMsg("  %-5s    %03d-%03d sec   %9s   %9s",
 			protoToString(test.testParam.TestId.Protocol),
-			gInterval, gInterval+1, ppsToString(value))
+			gInterval, gInterval+1, bytesToRate(value), bytesToRate(rx))
 		logResults([]string{test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
-			"", "", ppsToString(value), ""})
-	} else if test.testParam.TestId.Type == Bandwidth && test.testParam.TestId.Protocol == Http {
+			bytesToRate(value + rx), "", "", ""})
+		influxWrite(test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			"echo", map[string]uint64{"tx_bits_per_second": value * 8, "rx_bits_per_second": rx * 8})
+	} else if test.testParam.TestId.Type == Download || test.testParam.TestId.Type == Bandwidth &&
+		(test.testParam.TestId.Protocol == Quic || test.testParam.TestId.Protocol == Grpc) {
 		if gInterval == 0 {
 			ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
-			ui.printMsg("Protocol    Interval      Bits/s")
+			ui.printMsg("Protocol    Interval     %7s"+wireRateHdr(), rateUnit())
 		}
-		ui.printMsg("  %-5s    %03d-%03d sec   %7s",
+		test.addBandwidthSample(value)
+		ui.printMsg("  %-5s    %03d-%03d sec   %7s%s",
 			protoToString(test.testParam.TestId.Protocol),
-			gInterval, gInterval+1, bytesToRate(value))
+			gInterval, gInterval+1, bytesToRate(value), wireRateStr(test, value, 0))
 		logResults([]string{test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
 			bytesToRate(value), "", "", ""})
+		influxWrite(test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			resultLineTestName[test.testParam.TestId.Type], map[string]uint64{"bits_per_second": value * 8})
+		emitHttpTimings(test)
 	}
 	gInterval++
+	checkIntervalCount(gInterval)
 }
 
 func (u *clientUi) emitTestResult(s *ethrSession, proto EthrProtocol) {
 	var data uint64
-	var testList = []EthrTestType{Bandwidth, Cps, Pps}
+	var testList = []EthrTestType{Bandwidth, Cps, Pps, Download, PingPong, Echo}
 
 	for _, testType := range testList {
 		test, found := s.tests[EthrTestId{proto, testType}]
 		if found && test.isActive {
-			data = atomic.SwapUint64(&test.testResult.data, 0)
+			data = atomic.SwapUint64(test.intervalCounter(), 0)
+			atomic.AddUint64(&test.testResult.total, data)
 			printTestResult(test, data)
 		}
 	}
@@ -0,0 +1,109 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+)
+
+//
+// Control messages are gob-encoded by default. With "-ctrl-codec json", the
+// client sends ctrlJsonMagic as the first byte of the control connection, and
+// both ends then send each EthrMsg as JSON, with the field names of the Go
+// structs, after its length as a 4-byte big-endian integer, so that clients
+// in other languages can talk to the server, and the messages can be read in
+// a packet capture. A gob stream starts with the length of its first message,
+// as a byte below 0x80, or the negated count of the bytes that follow, from
+// 0xf8 up, so the server tells the codecs apart by the first byte. Servers
+// that predate it fail to decode the Syn and close the connection.
+//
+const (
+	ctrlJsonMagic = 0xca
+	maxJsonMsgLen = 1 << 16
+	ctrlCodecGob  = "gob"
+	ctrlCodecJson = "json"
+)
+
+var gCtrlCodec = ctrlCodecGob
+
+type ethrMsgEncoder interface {
+	Encode(e interface{}) error
+}
+
+type ethrMsgDecoder interface {
+	Decode(e interface{}) error
+}
+
+type jsonMsgEncoder struct {
+	w io.Writer
+}
+
+func (enc *jsonMsgEncoder) Encode(e interface{}) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if len(body) > maxJsonMsgLen {
+		return fmt.Errorf("message of %d bytes is larger than %d bytes", len(body), maxJsonMsgLen)
+	}
+	msg := make([]byte, 4, 4+len(body))
+	binary.BigEndian.PutUint32(msg, uint32(len(body)))
+	_, err = enc.w.Write(append(msg, body...))
+	return err
+}
+
+type jsonMsgDecoder struct {
+	r io.Reader
+}
+
+func (dec *jsonMsgDecoder) Decode(e interface{}) error {
+	hdr := make([]byte, 4)
+	_, err := io.ReadFull(dec.r, hdr)
+	if err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(hdr)
+	if n > maxJsonMsgLen {
+		return fmt.Errorf("message of %d bytes is larger than %d bytes", n, maxJsonMsgLen)
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(dec.r, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, e)
+}
+
+func newCtrlCodec(conn net.Conn) (ethrMsgEncoder, ethrMsgDecoder, error) {
+	if gCtrlCodec != ctrlCodecJson {
+		return gob.NewEncoder(conn), gob.NewDecoder(conn), nil
+	}
+	_, err := conn.Write([]byte{ctrlJsonMagic})
+	if err != nil {
+		return nil, nil, err
+	}
+	return &jsonMsgEncoder{conn}, &jsonMsgDecoder{conn}, nil
+}
+
+//
+// It reads the first byte from the client, and returns the codec it picked.
+//
+func acceptCtrlCodec(conn net.Conn) (ethrMsgEncoder, ethrMsgDecoder, error) {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if b[0] == ctrlJsonMagic {
+		return &jsonMsgEncoder{conn}, &jsonMsgDecoder{conn}, nil
+	}
+	return gob.NewEncoder(conn), gob.NewDecoder(&prefixConn{conn, b}), nil
+}
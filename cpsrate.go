@@ -0,0 +1,144 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+//
+// With "-cps-rate", connections/s threads don't dial back to back, which makes
+// them synchronize into bursts, but at random times, so that all threads
+// together offer a Poisson process at the given rate. Each thread draws the
+// gap to its next connection from an exponential distribution with a mean of
+// threads/rate. Dial times are scheduled from the previous scheduled time,
+// not from when the previous connection completed, so the time spent
+// connecting doesn't lower the rate. A thread that falls behind dials without
+// waiting until it catches up, unless it is more than cpsRateMaxLag behind,
+// e.g. after a stall, in which case it starts over rather than bursting.
+//
+var gCpsRate uint64
+
+const cpsRateMaxLag = time.Second
+
+type cpsPacer struct {
+	meanGap time.Duration
+	next    time.Time
+	last    time.Time
+	rnd     *rand.Rand
+	gaps    []time.Duration
+}
+
+//
+// Gaps between the connections of each thread, to report the distribution
+// that was achieved.
+//
+type cpsGapStats struct {
+	lock   sync.Mutex
+	start  time.Time
+	digest *tDigest
+	sum    float64
+	sumSq  float64
+}
+
+const cpsGapBatch = 256
+
+var cpsGaps cpsGapStats
+
+func newCpsPacer(threads uint32) *cpsPacer {
+	if gCpsRate == 0 {
+		return nil
+	}
+	now := time.Now()
+	cpsGaps.lock.Lock()
+	if cpsGaps.digest == nil {
+		cpsGaps.digest = newTDigest(tdigestCompression)
+		cpsGaps.start = now
+	}
+	cpsGaps.lock.Unlock()
+	return &cpsPacer{
+		meanGap: time.Duration(float64(time.Second) * float64(threads) / float64(gCpsRate)),
+		next:    now,
+		rnd:     rand.New(rand.NewSource(now.UnixNano() + rand.Int63())),
+		gaps:    make([]time.Duration, 0, cpsGapBatch),
+	}
+}
+
+//
+// It waits until the next connection is due, and records the gap since the
+// previous one. It returns false if the test ended while waiting.
+//
+func (p *cpsPacer) wait(done chan struct{}) bool {
+	p.next = p.next.Add(time.Duration(p.rnd.ExpFloat64() * float64(p.meanGap)))
+	now := time.Now()
+	if d := p.next.Sub(now); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-done:
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+		now = time.Now()
+	} else if -d > cpsRateMaxLag {
+		p.next = now
+	}
+	if !p.last.IsZero() {
+		p.gaps = append(p.gaps, now.Sub(p.last))
+		if len(p.gaps) == cap(p.gaps) {
+			p.flush()
+		}
+	}
+	p.last = now
+	return true
+}
+
+func (p *cpsPacer) flush() {
+	if len(p.gaps) == 0 {
+		return
+	}
+	cpsGaps.digest.addSamples(p.gaps)
+	cpsGaps.lock.Lock()
+	for _, g := range p.gaps {
+		cpsGaps.sum += float64(g)
+		cpsGaps.sumSq += float64(g) * float64(g)
+	}
+	cpsGaps.lock.Unlock()
+	p.gaps = p.gaps[:0]
+}
+
+//
+// For a Poisson process, gaps are exponentially distributed, so their
+// coefficient of variation is 1, and the median is ln 2 of the mean.
+//
+func emitCpsRateSummary(test *ethrTest, total uint64) {
+	if gCpsRate == 0 || cpsGaps.digest == nil {
+		return
+	}
+	n, avg, _, _ := cpsGaps.digest.summary()
+	if n < 2 {
+		return
+	}
+	cpsGaps.lock.Lock()
+	mean := cpsGaps.sum / float64(n)
+	variance := cpsGaps.sumSq/float64(n) - mean*mean
+	duration := time.Since(cpsGaps.start)
+	cpsGaps.lock.Unlock()
+	cv := float64(0)
+	if mean > 0 && variance > 0 {
+		cv = math.Sqrt(variance) / mean
+	}
+	ui.printMsg("Paced at %s conn/s, achieved %s conn/s.", cpsToString(gCpsRate),
+		cpsToString(uint64(float64(total)/duration.Seconds())))
+	expected := time.Duration(float64(time.Second) * float64(test.testParam.NumThreads) / float64(gCpsRate))
+	ui.printMsg("Gaps between connections of a thread: avg %s (target %s), p50 %s, p90 %s, p99 %s, "+
+		"CV %.2f (1 for Poisson).", latencyToString(avg), latencyToString(expected),
+		latencyToString(cpsGaps.digest.quantile(0.5)), latencyToString(cpsGaps.digest.quantile(0.9)),
+		latencyToString(cpsGaps.digest.quantile(0.99)), cv)
+}
@@ -0,0 +1,97 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+//
+// Data connections are matched to their test by the source address, which
+// fails if it differs from the address of the control connection, e.g. for
+// a multi-homed client, or behind a NAT that maps connections to different
+// addresses. Servers that support it say so in the Ack, and clients then send
+// the id of the test at the start of each bandwidth connection, after
+// dataTokenMagic and its length, so that the server maps the connection to
+// the test regardless of its source address. Data sent by older clients
+// starts with the buffer pattern, 0 first, or a TLS record, and never with
+// the magic, so the server reads what it got back to them, and matches by
+// address.
+//
+var dataTokenMagic = []byte("ETHRTKN")
+
+const (
+	dataTokenTimeout = 5 * time.Second
+	maxDataTokenLen  = 64
+)
+
+//
+// A connection that returns the bytes read ahead of the handler first.
+//
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) == 0 {
+		return c.Conn.Read(b)
+	}
+	n := copy(b, c.prefix)
+	c.prefix = c.prefix[n:]
+	return n, nil
+}
+
+func writeDataToken(conn net.Conn, test *ethrTest) error {
+	if !test.dataToken || test.uuid == "" || len(test.uuid) > maxDataTokenLen {
+		return nil
+	}
+	hdr := append(append([]byte{}, dataTokenMagic...), byte(len(test.uuid)))
+	_, err := conn.Write(append(hdr, test.uuid...))
+	return err
+}
+
+//
+// It returns the test of a new data connection, or nil if there is none, and
+// the connection to hand to the handler. A connection with a token for a test
+// that doesn't exist, or of another type, is not matched by address either.
+//
+func matchDataConn(conn net.Conn, server string, testId EthrTestId) (net.Conn, *ethrTest) {
+	conn.SetReadDeadline(time.Now().Add(dataTokenTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	hdr := make([]byte, len(dataTokenMagic)+1)
+	n, err := io.ReadFull(conn, hdr[:1])
+	if err == nil && hdr[0] == dataTokenMagic[0] {
+		var m int
+		m, err = io.ReadFull(conn, hdr[1:])
+		n += m
+	}
+	if err != nil && n == 0 {
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			return conn, nil
+		}
+	}
+	if n < len(hdr) || !bytes.Equal(hdr[:len(dataTokenMagic)], dataTokenMagic) {
+		return &prefixConn{conn, hdr[:n]}, getTest(server, testId.Protocol, testId.Type)
+	}
+	token := make([]byte, hdr[len(dataTokenMagic)])
+	_, err = io.ReadFull(conn, token)
+	if err != nil {
+		return conn, nil
+	}
+	test := getTestByUuid(string(token))
+	if test == nil || test.testParam.TestId != testId {
+		return conn, nil
+	}
+	if test.session.remoteAddr != server {
+		ui.printDbg("Matched %s %s connection from %s to test %s by its token",
+			protoToString(testId.Protocol), testToString(testId.Type), server, test.remoteWithId())
+	}
+	return conn, test
+}
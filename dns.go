@@ -0,0 +1,265 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//
+// The DNS latency test measures the time a resolver takes to answer queries.
+// It is client only, the target of "-c" is the resolver, so there is no
+// control channel and no Ethr server involved.
+//
+const (
+	dnsPort        = "53"
+	dnsTimeout     = 2 * time.Second
+	dnsHdrLen      = 12
+	dnsMaxMsgLen   = 65535
+	dnsTypeA       = 1
+	dnsTypeAAAA    = 28
+	dnsClassIN     = 1
+	dnsRcodeNxDom  = 3
+	dnsFlagRD      = 0x0100
+	dnsFlagQR      = 0x8000
+	dnsRcodeMask   = 0x000f
+	dnsMaxLabelLen = 63
+	dnsMaxNameLen  = 255
+)
+
+var gDnsName = "example.com"
+var gDnsType uint16 = dnsTypeA
+var gDnsTcp bool
+
+//
+// Queries that time out or that the resolver fails to answer, e.g. with
+// SERVFAIL or REFUSED, are counted separately and not included in latency.
+// NXDOMAIN is a valid answer, so it is included.
+//
+var gDnsTimeouts uint64
+var gDnsErrors uint64
+
+var errDnsTimeout = errors.New("DNS query timed out")
+
+func runDnsClient(testParam EthrTestParam, server string, d time.Duration) {
+	initClient()
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, dnsPort)
+	}
+	test, err := newTest(server, nil, testParam, nil, nil)
+	if err != nil {
+		ui.printErr("Error: %v", err)
+		os.Exit(1)
+	}
+	transport := "UDP"
+	if gDnsTcp {
+		transport = "TCP"
+	}
+	ui.printMsg("Querying resolver %s over %s for %s records of %s", server, transport,
+		dnsTypeToString(gDnsType), gDnsName)
+	startStatsTimer()
+	ui.emitLatencyHdr()
+	go runDnsTest(test)
+	test.setActive(true)
+	toStop := make(chan int, 1)
+	runDurationTimer(d, toStop)
+	handleCtrlC(toStop)
+	reason := <-toStop
+	close(test.done)
+	stopStatsTimer()
+	emitLatencySummary(test)
+	ui.printMsg("DNS queries failed: %d timed out, %d not answered by the resolver.",
+		atomic.LoadUint64(&gDnsTimeouts), atomic.LoadUint64(&gDnsErrors))
+	passed := checkThresholds(test)
+	switch reason {
+	case timeout:
+		ui.printMsg("Ethr done, duration: " + d.String() + ".")
+	case interrupt:
+		ui.printMsg("Ethr done, received interrupt signal.")
+	}
+	deleteTest(test)
+	outputFini()
+	hdrFini()
+	rawLatencyFini()
+	influxFini()
+	otlpFini()
+	if !passed {
+		os.Exit(1)
+	}
+}
+
+func runDnsTest(test *ethrTest) {
+	network := dnsTransport()
+	server := test.session.remoteAddr
+	var conn net.Conn
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+	rttCount := test.testParam.RttCount
+	latencyNumbers := make([]time.Duration, 0, rttCount)
+	windowSize := test.testParam.LatencyWindow
+	if windowSize == 0 {
+		windowSize = rttCount
+	}
+	window := newLatencyWindow(windowSize)
+	resp := make([]byte, dnsMaxMsgLen)
+	id := uint16(rand.Uint32())
+	for {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		batchStart := time.Now()
+		latencyNumbers = latencyNumbers[:0]
+		for i := uint32(0); i < rttCount; i++ {
+			if conn == nil {
+				var err error
+				conn, err = net.DialTimeout(network, server, dnsTimeout)
+				if err != nil {
+					ui.printErr("Error connecting to resolver %s: %v", server, err)
+					atomic.AddUint64(&gDnsErrors, 1)
+					time.Sleep(dnsTimeout)
+					continue
+				}
+			}
+			id++
+			query, err := buildDnsQuery(id, gDnsName, gDnsType)
+			if err != nil {
+				ui.printErr("Error building DNS query: %v", err)
+				os.Exit(1)
+			}
+			s1 := time.Now()
+			rcode, err := dnsExchange(conn, id, query, resp)
+			e2 := time.Since(s1)
+			if err != nil {
+				if err == errDnsTimeout {
+					atomic.AddUint64(&gDnsTimeouts, 1)
+				} else {
+					ui.printDbg("Error in DNS exchange with %s: %v", server, err)
+					atomic.AddUint64(&gDnsErrors, 1)
+				}
+				// Start over with a new connection for TCP, as the stream
+				// may be out of sync after an error.
+				if gDnsTcp || err != errDnsTimeout {
+					conn.Close()
+					conn = nil
+				}
+				continue
+			}
+			if rcode != 0 && rcode != dnsRcodeNxDom {
+				ui.printDbg("DNS query to %s failed with rcode %d", server, rcode)
+				atomic.AddUint64(&gDnsErrors, 1)
+				continue
+			}
+			latencyNumbers = append(latencyNumbers, e2)
+			window.add(e2)
+		}
+		if len(latencyNumbers) == 0 {
+			continue
+		}
+		test.addLatencySamples(latencyNumbers)
+		avg, min, max, p50, p90, p95, p99, p999, p9999, stddev := calcLatencyResults(window.values())
+		if hdrEnabled() {
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev =
+				hdrRecordLatency(server, batchStart, latencyNumbers, window.values())
+		}
+		ui.emitLatencyResults(server, protoToString(test.testParam.TestId.Protocol),
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
+	}
+}
+
+func dnsTransport() string {
+	if gDnsTcp {
+		return protoTCP
+	}
+	return protoUDP
+}
+
+func dnsTypeToString(qtype uint16) string {
+	if qtype == dnsTypeAAAA {
+		return "AAAA"
+	}
+	return "A"
+}
+
+func buildDnsQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name) == 0 || len(name) > dnsMaxNameLen-2 {
+		return nil, errors.New("invalid query name: " + name)
+	}
+	msg := make([]byte, dnsHdrLen, dnsHdrLen+len(name)+6)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], dnsFlagRD)
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(name, ".") {
+		if len(label) == 0 || len(label) > dnsMaxLabelLen {
+			return nil, errors.New("invalid query name: " + name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return msg, nil
+}
+
+//
+// It sends the query and waits for the response with the same id, returning
+// its rcode. Over UDP, late responses to earlier queries that timed out are
+// skipped. Over TCP, messages are prefixed with their length.
+//
+func dnsExchange(conn net.Conn, id uint16, query, resp []byte) (int, error) {
+	_, isTcp := conn.(*net.TCPConn)
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+	if isTcp {
+		msg := make([]byte, 2, 2+len(query))
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		query = append(msg, query...)
+	}
+	_, err := conn.Write(query)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		var n int
+		if isTcp {
+			_, err = io.ReadFull(conn, resp[:2])
+			if err == nil {
+				n = int(binary.BigEndian.Uint16(resp))
+				_, err = io.ReadFull(conn, resp[:n])
+			}
+		} else {
+			n, err = conn.Read(resp)
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return 0, errDnsTimeout
+			}
+			return 0, err
+		}
+		if n < dnsHdrLen {
+			return 0, errors.New("short DNS response")
+		}
+		flags := binary.BigEndian.Uint16(resp[2:])
+		if binary.BigEndian.Uint16(resp) != id || flags&dnsFlagQR == 0 {
+			if isTcp {
+				return 0, errors.New("unexpected DNS response")
+			}
+			continue
+		}
+		return int(flags & dnsRcodeMask), nil
+	}
+}
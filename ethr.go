@@ -8,42 +8,357 @@ package main
 import (
 	"flag"
 	"fmt"
+	"math"
+	"net"
 	"os"
 	"runtime"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 )
 
 const defaultLogFileName = "./ethrs.log for server, ./ethrc.log for client"
 
+var gLoadedLatency bool
+var gValidate bool
+var gCpuAffinity = -1
+var gPpsAffinity bool
+var gCtrlKeepAlive = 15 * time.Second
+var gDataKeepAlive = 15 * time.Second
+var gWarmup time.Duration
+var gAllowList []*net.IPNet
+var gResultLine bool
+var gToken string
+
+//
+// Label of the test set with "-label" on the client, to tag its results.
+//
+var gLabel string
+
 func main() {
 	isServer := flag.Bool("s", false, "Run as server")
 	clientServerIP := flag.String("c", "",
 		"Run as client and connect to server specified by String")
 	testType := flag.String("t", "b",
-		"Test to run (\"b\", \"c\", \"p\" or \"l\")\n"+
+		"Test to run (\"b\", \"c\", \"p\", \"l\", \"d\", \"r\", \"o\" or \"e\")\n"+
 			"b: Bandwidth\n"+
 			"c: Connections/s or Requests/s\n"+
 			"p: Packets/s\n"+
-			"l: Latency, Loss & Jitter")
+			"l: Latency, Loss & Jitter\n"+
+			"d: Download bandwidth, from server to client (HTTP and QUIC only)\n"+
+			"r: Request/response (ping-pong) transactions/s (TCP only)\n"+
+			"o: Connection latency, time to open and close a connection (TCP only)\n"+
+			"e: Echo bandwidth, upload and download at once (HTTP only)")
 	thCount := flag.Int("n", 1,
 		"Number of Threads\n"+
 			"0: Equal to number of CPUs")
 	bufLenStr := flag.String("l", "16KB",
 		"Length of buffer to use (format: <num>[KB | MB | GB])\n"+
-			"Only valid for Bandwidth tests. Max 1GB.")
+			"Only valid for Bandwidth, Packets/s, Download, ping-pong and Echo tests. Max 1GB.\n"+
+			"For Packets/s tests, this is the UDP payload size and defaults to 1B.\n"+
+			"For Download tests, this is the size of each HTTP or HTTP/3 response.\n"+
+			"For ping-pong tests, this is the size of each request and response.")
 	protocol := flag.String("p", "tcp",
-		"Protocol (\"tcp\", \"udp\", \"http\", \"https\", or \"icmp\")")
+		"Protocol (\"tcp\", \"udp\", \"http\", \"https\", \"icmp\", \"quic\", \"grpc\",\n"+
+			"\"sctp\" or \"dns\")\n"+
+			"\"http3\" is accepted as an alias for \"quic\".\n"+
+			"For \"dns\", the client measures the latency of the resolver given\n"+
+			"by \"-c\" (format: <ip>[:<port>]), without an Ethr server.")
+	dnsName := flag.String("dns-name", "example.com",
+		"Name to query in DNS latency tests.")
+	dnsType := flag.String("dns-type", "A",
+		"Record type to query in DNS latency tests (\"A\" or \"AAAA\").")
+	dnsTcp := flag.Bool("dns-tcp", false,
+		"Send queries over TCP rather than UDP in DNS latency tests.")
 	outputFile := flag.String("o", defaultLogFileName,
 		"Name of the file for logging output.\n")
+	hdrFile := flag.String("hdr", "",
+		"Name of the file to write latency results to as an HdrHistogram log.\n"+
+			"Latency percentiles are then computed from the histogram.")
+	rawLatency := flag.String("raw-latency", "",
+		"Name of the file to append every latency sample to, in CSV format,\n"+
+			"with the time it was measured at and the RTT in nanoseconds.")
+	tdigest := flag.Bool("tdigest", false,
+		"Add all latency samples of a test to a t-digest, and show percentiles\n"+
+			"over the whole test when it ends, using bounded memory.")
+	resultFile := flag.String("output", "",
+		"Name of the file to append plain text test results to, in addition\n"+
+			"to showing them on screen.")
+	influx := flag.String("influx", "",
+		"URL to write test results to in InfluxDB line protocol, in addition\n"+
+			"to showing them on screen. Use udp://<host>:<port> for the UDP\n"+
+			"listener or http://<host>:<port>/write?db=<db> for the HTTP API.")
+	otlp := flag.String("otlp", "",
+		"OTLP/HTTP endpoint to export test results to as OpenTelemetry metrics,\n"+
+			"e.g. http://<host>:4318. Results are sent every interval.")
 	debug := flag.Bool("debug", false, "Log debug output. Only valid if \"-o\" is specified.")
 	noOutput := flag.Bool("no", false, "Disable logging output to file.")
+	pmtu := flag.Bool("pmtu", false,
+		"Discover the path MTU to the host given with \"-c\", without an Ethr\n"+
+			"server, by probing with UDP packets of increasing size with the DF bit\n"+
+			"set, or with ICMP echo requests with \"-p icmp\", which needs\n"+
+			"administrator rights. Only valid for client.")
+	selfTest := flag.Bool("selftest", false,
+		"Run the server and a client against it in this process, run each test\n"+
+			"type briefly over loopback, and report which passed. The server uses\n"+
+			"ephemeral ports, so it doesn't clash with a server already running.")
 	durationStr := flag.String("d", "10s",
 		"Duration for the test (format: <num>[s | m | h] \n"+
 			"0: Run forever")
 	showUi := flag.Bool("ui", false, "Show output in text UI. Valid for server only.")
 	rttCount := flag.Int("i", 1000,
 		"Number of round trip iterations for calculating latency.")
+	latencyWindow := flag.Int("latency-window", 0,
+		"Number of most recent round trips to calculate latency percentiles\n"+
+			"over, independent of how often results are reported (\"-i\").\n"+
+			"0: Same as \"-i\"")
+	latencyStable := flag.Float64("stable", 0,
+		"Run a latency test until its p99 moves by no more than the given\n"+
+			"percentage over successive batches of \"-i\" round trips, after which\n"+
+			"the server ends it. The duration (\"-d\") still applies.\n"+
+			"Only valid for TCP and SCTP latency tests on client. 0: Disabled")
+	latencyUnit := flag.String("latency-unit", "",
+		"Unit to show all latency results in (\"ns\", \"us\" or \"ms\").\n"+
+			"Default: The unit that best fits each value")
+	showBits := flag.Bool("rate-bits", false,
+		"Show bandwidth in bits/s. Same as \"-units bits\".")
+	showBytes := flag.Bool("rate-bytes", false,
+		"Show bandwidth in bytes/s. Same as \"-units si\".")
+	rateUnits := flag.String("units", "bits",
+		"Units to show bandwidth in (\"bits\", \"si\" or \"iec\").\n"+
+			"bits: Bits/s, with prefixes for powers of 1000, e.g. 1.50G\n"+
+			"si: Bytes/s, with prefixes for powers of 1000, e.g. 1.50G\n"+
+			"iec: Bytes/s, with prefixes for powers of 1024, e.g. 1.50Gi")
+	rateScale := flag.String("rate-scale", "auto",
+		"Prefix to show all bandwidth results with (\"auto\", \"k\", \"m\" or \"g\").\n"+
+			"auto: The prefix that best fits each value")
+	percentileMethod := flag.String("percentile-method", "nearest",
+		"Method to compute latency percentiles with (\"nearest\" or \"linear\").\n"+
+			"nearest: The sample at the nearest rank\n"+
+			"linear: Linear interpolation between the two closest samples\n"+
+			"Not valid with \"-hdr\", which computes them from the histogram.")
+	intervalCount := flag.Uint64("interval-count", 0,
+		"Number of result intervals to report before stopping the test.\n"+
+			"Only valid for client. 0: Limited by duration (\"-d\") only")
+	cpuAffinity := flag.Int("affinity", -1,
+		"CPU to pin latency test handlers to, to reduce scheduling jitter.\n"+
+			"Only valid for server. -1: No affinity")
+	validate := flag.Bool("validate", false,
+		"Only validate connectivity to the server's control and data ports,\n"+
+			"without running the test. Only valid for client.")
+	cpsPorts := flag.String("cps-ports", "",
+		"Local port range to use for connections/s tests (format: <min>-<max>).\n"+
+			"Ports are reused round robin with SO_REUSEADDR. Only valid for client.")
+	cpsClose := flag.Bool("cps-close", false,
+		"In connections/s tests, have the server close each connection, and\n"+
+			"wait for it before closing it on the client, instead of resetting\n"+
+			"it right away. The time to connect and the time to close are then\n"+
+			"reported separately, and the TIME_WAIT state is on the server.\n"+
+			"Only valid for client.")
+	cpsRateStr := flag.String("cps-rate", "",
+		"Target rate for connections/s tests, e.g. 5K. Connections are opened\n"+
+			"at random, Poisson distributed times instead of back to back, and\n"+
+			"the achieved rate and distribution are reported. Only valid for client.\n"+
+			"Default: Open connections as fast as possible")
+	useTls := flag.Bool("tls", false,
+		"Use TLS for the connections of TCP bandwidth and latency tests, to\n"+
+			"include the overhead of encryption in the results. The server uses a\n"+
+			"self-signed certificate. Only valid for client.")
+	enableNagle := flag.Bool("nagle", false,
+		"Enable Nagle's algorithm (disable TCP_NODELAY) for latency tests.\n"+
+			"By default, Nagle's algorithm is disabled. Only valid for client.")
+	ppsAffinity := flag.Bool("pps-affinity", false,
+		"Pin each packets/s test handler to its own CPU.\n"+
+			"Only valid for server.")
+	fragMode := flag.String("frag", "reject",
+		"Handling of UDP packets larger than the path MTU in packets/s tests\n"+
+			"(\"reject\", \"allow\" or \"df\"). Only valid for client.\n"+
+			"reject: Don't run tests with packets larger than the interface MTU\n"+
+			"allow: Send them and let IP fragment them\n"+
+			"df: Send them with the DF bit set, to probe the path MTU")
+	totalBytesStr := flag.String("bytes", "",
+		"Number of bytes to transfer in a bandwidth test, after which the\n"+
+			"test stops (format: <num>[KB | MB | GB]). The duration (\"-d\")\n"+
+			"still applies. Only valid for TCP bandwidth tests on client.")
+	verify := flag.Bool("verify", false,
+		"Send a known pattern, and have the server check every byte it\n"+
+			"receives against it, to detect corruption on the path. The server\n"+
+			"reports the number of corrupted bytes at the end of the test.\n"+
+			"Only valid for TCP bandwidth tests on client.")
+	oneWay := flag.Bool("one-way", false,
+		"Stamp latency messages with the time they are sent, so that the\n"+
+			"server reports the one-way delay from client to server as well.\n"+
+			"The clocks of client and server must be synchronized, e.g. with\n"+
+			"PTP or NTP, as any offset between them adds to the delay.\n"+
+			"Only valid for TCP and SCTP latency tests on client.")
+	label := flag.String("label", "",
+		"Label to tag the test with, e.g. the name of the experiment. It is\n"+
+			"included in the results and the log, and sent to the server, which\n"+
+			"includes it in its messages and result lines. Only valid for client.")
+	resultLine := flag.Bool("result-line", false,
+		"Print a single line summary of each test when it ends, in a stable\n"+
+			"format for scripts, e.g.\n"+
+			"ETHR_RESULT proto=tcp type=bandwidth remote=<ip> duration=<sec> bytes=<n> avg_bps=<n>\n"+
+			"Only valid for server.")
+	var enable, disable stringList
+	flag.Var(&enable, "enable",
+		"Comma separated list of listeners to start, all others are disabled\n"+
+			"(\"tcp-bandwidth\", \"tcp-cps\", \"tcp-latency\", \"udp-pps\", \"http\",\n"+
+			"\"quic\", \"grpc\" or \"sctp\"), or of test types to allow, all others\n"+
+			"are rejected (\"bandwidth\", \"cps\", \"pps\", \"latency\" or \"download\").\n"+
+			"For test types, only the listeners serving them are started.\n"+
+			"Can be repeated. Only valid for server. Default: All")
+	flag.Var(&disable, "disable",
+		"Comma separated list of listeners not to start, or of test types to\n"+
+			"reject, see \"-enable\". Can be repeated. Only valid for server.")
+	maxRttCount := flag.Int("max-rtt-count", int(gMaxRttCount),
+		"Largest RTT count (\"-i\") and latency window (\"-latency-window\")\n"+
+			"accepted from clients, which the server allocates memory for.\n"+
+			"Larger latency tests are rejected. Only valid for server.")
+	backlog := flag.Int("backlog", 0,
+		"Length of the accept queue of the TCP bandwidth and conn/s listeners,\n"+
+			"to avoid dropped connections in high rate conn/s tests. Capped by\n"+
+			"net.core.somaxconn on Linux. Only valid for server. Default: System")
+	syslogAddr := flag.String("syslog", "",
+		"Syslog server to send messages and results to (format: [udp:// | tcp://]\n"+
+			"<host>:<port>, UDP by default). Only valid for server.")
+	sendfile := flag.Bool("sendfile", false,
+		"Send HTTP downloads from a file, so that they use sendfile and are\n"+
+			"not copied through user space. Only has an effect on Linux.\n"+
+			"Only valid for server.")
+	srcPorts := flag.Bool("src-ports", false,
+		"Count the source ports of the data connections of TCP and SCTP\n"+
+			"tests, and of the packets of UDP tests, and show their distribution\n"+
+			"at the end of each test. Only valid for server.")
+	systemd := flag.Bool("systemd", false,
+		"Notify systemd, as a Type=notify service, once the server is ready\n"+
+			"and when it stops, and ping its watchdog. SIGTERM stops the server\n"+
+			"cleanly. Only valid for server.")
+	restApi := flag.Bool("rest", false,
+		"Serve a REST API on the HTTP port to start and stop tests on the\n"+
+			"server (POST /tests, GET and DELETE /tests/<id>), for traffic not\n"+
+			"sent by an Ethr client. Only valid for server.")
+	adminToken := flag.String("admin-token", "",
+		"Serve an admin API on the HTTP port to list running tests\n"+
+			"(GET /admin/tests) and end them (POST /admin/kill?key=<remote>),\n"+
+			"for requests that send this token as \"Authorization: Bearer\".\n"+
+			"Only valid for server. Default: Disabled")
+	bind := flag.String("bind", "",
+		"Address to listen on, instead of all interfaces. Only valid for server.")
+	port := flag.String("port", ctrlPort,
+		"Port of the control channel. Clients take the ports of the tests from\n"+
+			"the server. For server, 0 binds all listeners to ports chosen by the\n"+
+			"system, and lists them once bound.")
+	behindProxy := flag.Bool("behind-proxy", false,
+		"The server is behind a load balancer or reverse proxy, which sends a\n"+
+			"PROXY protocol v2 header on all TCP connections, and sets\n"+
+			"X-Forwarded-For on HTTP requests. Only valid for server.")
+	token := flag.String("token", "",
+		"Pre-shared token required to run tests. The server rejects tests from\n"+
+			"clients that don't specify the same token. Default: No token")
+	allow := flag.String("allow", "",
+		"Comma separated list of client IP addresses or CIDR ranges that are\n"+
+			"allowed to run tests (e.g. 10.0.0.0/8,192.168.1.5).\n"+
+			"Only valid for server. Default: Allow all clients")
+	keepAliveStr := flag.String("keepalive", "15s",
+		"TCP keepalive interval for the control connection, to detect dead\n"+
+			"peers behind NATs and firewalls (format: <num>[s | m | h])\n"+
+			"0: Disable keepalives")
+	ctrlCodec := flag.String("ctrl-codec", ctrlCodecGob,
+		"Encoding of the control messages (\"gob\" or \"json\"). json sends\n"+
+			"each message as JSON after its length, for clients in other\n"+
+			"languages and packet captures. Servers accept both. Only valid for\n"+
+			"client.")
+	dataKeepAliveStr := flag.String("data-keepalive", "15s",
+		"TCP keepalive interval for the data connections of TCP and HTTP\n"+
+			"bandwidth tests, so that they survive NAT timeouts while idle, e.g.\n"+
+			"while paused. Keepalives carry no data, so they are not counted as\n"+
+			"bandwidth (format: <num>[s | m | h]). 0: Disable keepalives")
+	warmupStr := flag.String("warmup", "0s",
+		"Duration at the start of each bandwidth, download and echo test during\n"+
+			"which transferred data is not counted as bandwidth\n"+
+			"(format: <num>[s | m | h]). Other test types are not affected.\n"+
+			"Only valid for server. 0: No warmup")
+	mcast := flag.String("mcast", "",
+		"Multicast group to also send a stream of UDP packets to, for clients to\n"+
+			"receive with a UDP bandwidth test to the group (format: <ip>[:<port>]).\n"+
+			"Only valid for server. The packet size is set with \"-l\", 1KB by default.")
+	mcastRate := flag.String("mcast-rate", "10M",
+		"Rate in bits/s at which the server sends to the multicast group\n"+
+			"(format: <num>[K | M | G]). Only valid for server.")
+	mcastTtl := flag.Int("mcast-ttl", 1,
+		"TTL of the packets sent to the multicast group. Only valid for server.")
+	mcastIf := flag.String("mcast-if", "",
+		"Name of the interface to join the multicast group on.\n"+
+			"Only valid for UDP bandwidth tests on client.")
+	ackTimeoutStr := flag.String("ack-timeout", "10s",
+		"Time to wait for the client to acknowledge the start of a test, after\n"+
+			"which the test is cleaned up (format: <num>[ms | s]).\n"+
+			"Only valid for server. 0: Wait as long as the connection is up")
+	drainStr := flag.String("drain", "200ms",
+		"Time to keep reading data still in flight when a bandwidth test ends,\n"+
+			"so that it is counted, until no more arrives (format: <num>[ms | s]).\n"+
+			"Only valid for server. 0: Stop counting right away")
+	latencyTimeoutStr := flag.String("latency-timeout", "0s",
+		"Time to wait for the reply to each round trip of a latency test,\n"+
+			"after which it is counted as timed out instead of measured, and\n"+
+			"the test goes on once the reply arrives (format: <num>[s | m | h]).\n"+
+			"Only valid for server. 0: Wait without limit")
+	minBandwidth := flag.String("min-bandwidth", "",
+		"Minimum average bandwidth in bits/s over the test (format: <num>[K | M | G]).\n"+
+			"If not met, the client exits with status 1. Only valid for bandwidth,\n"+
+			"download and echo tests on client.")
+	maxP99Str := flag.String("max-p99", "",
+		"Maximum p99 latency over the test (format: <num>[us | ms | s]).\n"+
+			"If exceeded, the client exits with status 1. Only valid for latency\n"+
+			"and connection latency tests on client.")
+	rampStr := flag.String("ramp", "",
+		"Time over which to start the streams of a bandwidth test one after the\n"+
+			"other, rather than all at once (format: <num>[ms | s]).\n"+
+			"Only valid for TCP and SCTP bandwidth tests on client.")
+	httpTiming := flag.Bool("ttfb", false,
+		"Time the DNS lookup, connect, TLS handshake and first byte of the\n"+
+			"response of each request, and report their p50 and p99 per interval.\n"+
+			"Only valid for HTTP bandwidth and download tests on client.")
+	sessionName := flag.String("session", "",
+		"Name of the test on the server, which keeps it when the client leaves,\n"+
+			"for a client to reattach to with the same name and test type.\n"+
+			"Only valid for client.")
+	sessionLingerStr := flag.String("session-linger", "1m",
+		"Time for which the server keeps a test named with \"-session\" after its\n"+
+			"client left, for a client to reattach (format: <num>[ms | s | m]).\n"+
+			"Only valid for server.")
+	sweep := flag.String("sweep", "",
+		"Comma separated list of buffer sizes to run a bandwidth test with in\n"+
+			"turn, each for the duration (\"-d\"), and compare the results\n"+
+			"(e.g. 1KB,4KB,16KB,64KB,256KB). Only valid for TCP bandwidth tests on client.")
+	family := flag.String("family", "any",
+		"Address family to use if the server's name resolves to both IPv4 and\n"+
+			"IPv6 addresses (\"any\", \"4\", \"6\" or \"both\").\n"+
+			"any: The address the resolver returns first\n"+
+			"both: Run the test over IPv4, then over IPv6, and compare them\n"+
+			"Only valid for client.")
+	numeric := flag.Bool("numeric", false,
+		"Resolve the server's name once, at the start, and show and connect to\n"+
+			"the address it resolves to, so that no data connection waits for DNS.\n"+
+			"The server always shows addresses. Only valid for client.")
+	wireRate := flag.Bool("wire", true,
+		"Show the estimated rate on the wire, including protocol headers, next\n"+
+			"to the bandwidth of the payload. Use \"-wire=false\" to disable it.\n"+
+			"Only valid for client.")
+	retries := flag.Int("retries", 0,
+		"Number of times to retry connecting to the server and starting the\n"+
+			"test if it fails, e.g. on flaky networks. Only valid for client.")
+	retryDelayStr := flag.String("retry-delay", "1s",
+		"Delay before the first retry, doubled for every further retry up to 30s\n"+
+			"(format: <num>[s | m | h]). Only valid for client.")
+	interactive := flag.Bool("interactive", false,
+		"Read commands from stdin to pause (\"p\"), resume (\"r\") or quit (\"q\")\n"+
+			"the test. Only valid for TCP bandwidth tests on client.")
+	loadedLatency := flag.Bool("loaded", false,
+		"Run a TCP bandwidth test in parallel to measure latency under load.\n"+
+			"Only valid for TCP latency tests on client.")
 	ethrUnused(noOutput)
 
 	flag.Parse()
@@ -53,6 +368,15 @@ func main() {
 	// fmt.Println("Number of incorrect arguments: " + strconv.Itoa(flag.NArg()))
 	//
 
+	if *selfTest {
+		if *isServer || *clientServerIP != "" {
+			fmt.Println("Invalid argument, \"-selftest\" runs both the server and the client,\n" +
+				"and can't be combined with \"-s\" or \"-c\".")
+			os.Exit(1)
+		}
+		os.Exit(runSelfTest())
+	}
+
 	if (*isServer && *clientServerIP != "") ||
 		(!*isServer && *clientServerIP == "") {
 		fmt.Println("Please specify either server mode (-s) or client mode (-c).")
@@ -67,6 +391,77 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *latencyWindow < 0 {
+		fmt.Println("Invalid latency window for latency test:", *latencyWindow)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	switch *latencyUnit {
+	case "":
+	case "ns":
+		gLatencyUnit = time.Nanosecond
+	case "us":
+		gLatencyUnit = time.Microsecond
+	case "ms":
+		gLatencyUnit = time.Millisecond
+	default:
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-latency-unit\".\n", *latencyUnit)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	if (*showBits && *showBytes) || ((*showBits || *showBytes) && isFlagPassed("units")) {
+		fmt.Println("Invalid arguments, only one of \"-rate-bits\", \"-rate-bytes\" and \"-units\" " +
+			"can be specified.")
+		os.Exit(1)
+	}
+	if *showBytes {
+		*rateUnits = "si"
+	}
+
+	switch strings.ToLower(*rateUnits) {
+	case "bits":
+		gRateFormat = rateBits
+	case "si":
+		gRateFormat = rateSi
+	case "iec":
+		gRateFormat = rateIec
+	default:
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-units\".\n", *rateUnits)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	switch strings.ToLower(*rateScale) {
+	case "auto":
+	case "k":
+		gRateScale = 1
+	case "m":
+		gRateScale = 2
+	case "g":
+		gRateScale = 3
+	default:
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-rate-scale\".\n", *rateScale)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	switch *percentileMethod {
+	case "nearest":
+	case "linear":
+		// Percentiles from the histogram are computed by the histogram.
+		if *hdrFile != "" {
+			fmt.Println("Invalid argument, \"-percentile-method linear\" can't be used with \"-hdr\".")
+			os.Exit(1)
+		}
+		gPercentileLinear = true
+	default:
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-percentile-method\".\n", *percentileMethod)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
 	if *rttCount <= 0 {
 		fmt.Println("Invalid RTT count for latency test:", *rttCount)
 		flag.PrintDefaults()
@@ -83,6 +478,14 @@ func main() {
 		test = Pps
 	case "l":
 		test = Latency
+	case "d":
+		test = Download
+	case "r":
+		test = PingPong
+	case "o":
+		test = ConnLatency
+	case "e":
+		test = Echo
 	default:
 		fmt.Printf("Invalid value \"%s\" specified for parameter \"-t\".\n"+
 			"Valid parameters and values are:\n", *testType)
@@ -103,6 +506,14 @@ func main() {
 		proto = Https
 	case "ICMP":
 		proto = Icmp
+	case "QUIC", "HTTP3":
+		proto = Quic
+	case "DNS":
+		proto = Dns
+	case "GRPC":
+		proto = Grpc
+	case "SCTP":
+		proto = Sctp
 	default:
 		fmt.Printf("Invalid value \"%s\" specified for parameter \"-p\".\n"+
 			"Valid parameters and values are:\n", *protocol)
@@ -110,6 +521,16 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *pmtu {
+		if !isFlagPassed("p") {
+			proto = Udp
+		}
+		if *isServer || (proto != Udp && proto != Icmp) {
+			fmt.Println("Invalid argument, \"-pmtu\" is only valid for client, with UDP or ICMP.")
+			os.Exit(1)
+		}
+	}
+
 	duration, err := time.ParseDuration(*durationStr)
 	if err != nil {
 		fmt.Printf("Invalid value \"%s\" specified for parameter \"-d\".\n",
@@ -118,19 +539,517 @@ func main() {
 		os.Exit(1)
 	}
 
+	keepAlive, err := time.ParseDuration(*keepAliveStr)
+	if err != nil || keepAlive < 0 {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-keepalive\".\n",
+			*keepAliveStr)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	gCtrlKeepAlive = keepAlive
+
+	if (*ctrlCodec != ctrlCodecGob && *ctrlCodec != ctrlCodecJson) ||
+		(*ctrlCodec != ctrlCodecGob && *isServer) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-ctrl-codec\".\n"+
+			"It must be gob or json, and is only valid for client.\n", *ctrlCodec)
+		os.Exit(1)
+	}
+	gCtrlCodec = *ctrlCodec
+
+	dataKeepAlive, err := time.ParseDuration(*dataKeepAliveStr)
+	if err != nil || dataKeepAlive < 0 {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-data-keepalive\".\n",
+			*dataKeepAliveStr)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	gDataKeepAlive = dataKeepAlive
+
+	latencyTimeout, err := time.ParseDuration(*latencyTimeoutStr)
+	if err != nil || latencyTimeout < 0 || (latencyTimeout > 0 && !*isServer) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-latency-timeout\".\n"+
+			"It is only valid for server.\n", *latencyTimeoutStr)
+		os.Exit(1)
+	}
+	gLatencyTimeout = latencyTimeout
+
+	ackTimeout, err := time.ParseDuration(*ackTimeoutStr)
+	if err != nil || ackTimeout < 0 || (ackTimeout != gAckTimeout && !*isServer) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-ack-timeout\".\n"+
+			"It is only valid for server.\n", *ackTimeoutStr)
+		os.Exit(1)
+	}
+	gAckTimeout = ackTimeout
+
+	drain, err := time.ParseDuration(*drainStr)
+	if err != nil || drain < 0 || (drain != gDrain && !*isServer) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-drain\".\n"+
+			"It is only valid for server.\n", *drainStr)
+		os.Exit(1)
+	}
+	gDrain = drain
+
+	warmup, err := time.ParseDuration(*warmupStr)
+	if err != nil || warmup < 0 || (warmup > 0 && !*isServer) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-warmup\".\n"+
+			"Warmup is only valid for server.\n", *warmupStr)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	gWarmup = warmup
+
+	switch *fragMode {
+	case "reject":
+		gFragMode = fragReject
+	case "allow":
+		gFragMode = fragAllow
+	case "df":
+		gFragMode = fragDontFragment
+	default:
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-frag\".\n"+
+			"Valid parameters and values are:\n", *fragMode)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+	if gFragMode != fragReject && *isServer {
+		fmt.Println("Invalid argument, \"-frag\" is only valid for client.")
+		os.Exit(1)
+	}
+
+	var totalBytes uint64
+	if *totalBytesStr != "" {
+		totalBytes = unitToNumber(*totalBytesStr)
+		if totalBytes == 0 || *isServer || test != Bandwidth || proto != Tcp {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-bytes\".\n"+
+				"It is only valid for TCP bandwidth tests on client.\n", *totalBytesStr)
+			os.Exit(1)
+		}
+	}
+
+	if *latencyStable < 0 || *latencyStable >= 100 ||
+		*latencyStable > 0 && (*isServer || test != Latency || (proto != Tcp && proto != Sctp)) {
+		fmt.Printf("Invalid value \"%g\" specified for parameter \"-stable\".\n"+
+			"It must be a percentage below 100, and is only valid for TCP and SCTP\n"+
+			"latency tests on client.\n", *latencyStable)
+		os.Exit(1)
+	}
+
+	if *verify && (*isServer || test != Bandwidth || proto != Tcp) {
+		fmt.Println("Invalid argument, \"-verify\" is only valid for TCP bandwidth tests on client.")
+		os.Exit(1)
+	}
+
+	if *oneWay && (*isServer || test != Latency || (proto != Tcp && proto != Sctp)) {
+		fmt.Println("Invalid argument, \"-one-way\" is only valid for TCP and SCTP latency tests on client.")
+		os.Exit(1)
+	}
+
+	if *cpsClose && (*isServer || test != Cps || proto != Tcp) {
+		fmt.Println("Invalid argument, \"-cps-close\" is only valid for TCP conn/s tests on client.")
+		os.Exit(1)
+	}
+
+	if *cpsRateStr != "" {
+		gCpsRate = unitToNumber(*cpsRateStr)
+		if gCpsRate == 0 || *isServer || test != Cps || proto != Tcp {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-cps-rate\".\n"+
+				"It is only valid for TCP conn/s tests on client.\n", *cpsRateStr)
+			os.Exit(1)
+		}
+	}
+
+	if *useTls && (*isServer || (test != Bandwidth && test != Latency) || proto != Tcp) {
+		fmt.Println("Invalid argument, \"-tls\" is only valid for TCP bandwidth and latency tests on client.")
+		os.Exit(1)
+	}
+
+	if *label != "" && (*isServer || !isValidLabel(*label)) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-label\".\n"+
+			"It is only valid for client, and can't contain spaces or '='.\n", *label)
+		os.Exit(1)
+	}
+	gLabel = *label
+
 	if *thCount <= 0 {
 		*thCount = runtime.NumCPU()
 	}
 
-	if test == Pps {
+	if test == Pps && !isFlagPassed("l") {
 		bufLen = 1
 	}
 
+	if proto == Dns {
+		switch strings.ToUpper(*dnsType) {
+		case "A":
+			gDnsType = dnsTypeA
+		case "AAAA":
+			gDnsType = dnsTypeAAAA
+		default:
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-dns-type\".\n", *dnsType)
+			os.Exit(1)
+		}
+		gDnsName = *dnsName
+		gDnsTcp = *dnsTcp
+		// Resolvers are slower than an Ethr server, so report results
+		// more often by default.
+		if !isFlagPassed("i") {
+			*rttCount = 10
+		}
+	}
+
 	testParam := EthrTestParam{EthrTestId{EthrProtocol(proto), test},
 		uint32(*thCount),
 		uint32(bufLen),
-		uint32(*rttCount)}
-	if !validateTestParam(testParam) {
+		uint32(*rttCount),
+		*enableNagle,
+		uint32(*latencyWindow),
+		totalBytes,
+		*verify,
+		*oneWay,
+		*label,
+		*cpsClose,
+		*useTls,
+		*latencyStable}
+	if !*pmtu && !validateTestParam(testParam) {
+		os.Exit(1)
+	}
+
+	if !*isServer && !*pmtu && testParam.TestId == (EthrTestId{Udp, Bandwidth}) {
+		_, err = parseMcastGroup(*clientServerIP)
+		if err != nil {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-c\": %v\n"+
+				"UDP bandwidth tests receive from a multicast group, see \"-mcast\".\n",
+				*clientServerIP, err)
+			os.Exit(1)
+		}
+	}
+
+	if *mcast != "" {
+		gMcastGroup, err = parseMcastGroup(*mcast)
+		if err != nil || !*isServer {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-mcast\".\n"+
+				"It is only valid for server and must be a multicast group.\n", *mcast)
+			os.Exit(1)
+		}
+		if isFlagPassed("l") {
+			if bufLen < mcastHdrLen || bufLen > maxUdpPayload {
+				fmt.Printf("Invalid length %d for multicast packets, it must be %d to %d bytes.\n",
+					bufLen, mcastHdrLen, maxUdpPayload)
+				os.Exit(1)
+			}
+			gMcastSize = uint32(bufLen)
+		}
+	}
+	gMcastRate = unitToNumber(*mcastRate)
+	if gMcastRate == 0 || (isFlagPassed("mcast-rate") && gMcastGroup == nil) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-mcast-rate\".\n"+
+			"It is only valid for server with \"-mcast\".\n", *mcastRate)
+		os.Exit(1)
+	}
+	if *mcastTtl < 0 || *mcastTtl > 255 || (isFlagPassed("mcast-ttl") && gMcastGroup == nil) {
+		fmt.Printf("Invalid value \"%d\" specified for parameter \"-mcast-ttl\".\n"+
+			"It is only valid for server with \"-mcast\", and must be 0 to 255.\n", *mcastTtl)
+		os.Exit(1)
+	}
+	gMcastTtl = *mcastTtl
+	if *mcastIf != "" {
+		gMcastIf, err = net.InterfaceByName(*mcastIf)
+		if err != nil || *isServer || testParam.TestId != (EthrTestId{Udp, Bandwidth}) {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-mcast-if\".\n"+
+				"It is only valid for UDP bandwidth tests on client, and must be an interface.\n", *mcastIf)
+			os.Exit(1)
+		}
+	}
+
+	if *loadedLatency && (*isServer || testParam.TestId != EthrTestId{Tcp, Latency}) {
+		fmt.Println("Invalid argument, \"-loaded\" is only valid for TCP latency tests on client.")
+		os.Exit(1)
+	}
+	gLoadedLatency = *loadedLatency
+	gIntervalCount = *intervalCount
+
+	if *interactive && (*isServer || testParam.TestId != EthrTestId{Tcp, Bandwidth} || *loadedLatency) {
+		fmt.Println("Invalid argument, \"-interactive\" is only valid for TCP bandwidth tests on client.")
+		os.Exit(1)
+	}
+	gInteractive = *interactive
+
+	if *validate && *isServer {
+		fmt.Println("Invalid argument, \"-validate\" is only valid for client.")
+		os.Exit(1)
+	}
+	gValidate = *validate
+
+	if *cpuAffinity >= runtime.NumCPU() || *cpuAffinity < -1 ||
+		(*cpuAffinity >= 0 && !*isServer) {
+		fmt.Printf("Invalid value \"%d\" specified for parameter \"-affinity\".\n"+
+			"It is only valid for server and must be less than number of CPUs (%d).\n",
+			*cpuAffinity, runtime.NumCPU())
+		os.Exit(1)
+	}
+	gCpuAffinity = *cpuAffinity
+
+	if *ppsAffinity && !*isServer {
+		fmt.Println("Invalid argument, \"-pps-affinity\" is only valid for server.")
+		os.Exit(1)
+	}
+	gPpsAffinity = *ppsAffinity
+
+	if *cpsPorts != "" {
+		gCpsPortMin, gCpsPortMax = parsePortRange(*cpsPorts)
+		if gCpsPortMin == 0 || *isServer {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-cps-ports\".\n"+
+				"It is only valid for client and must be of the form <min>-<max>.\n", *cpsPorts)
+			os.Exit(1)
+		}
+	}
+
+	retryDelay, err := time.ParseDuration(*retryDelayStr)
+	if err != nil || retryDelay <= 0 || *retries < 0 || (*retries > 0 && *isServer) {
+		fmt.Printf("Invalid value specified for parameter \"-retries\" or \"-retry-delay\".\n" +
+			"Retries are only valid for client and must not be negative.\n")
+		os.Exit(1)
+	}
+	gRetries = *retries
+	gRetryDelay = retryDelay
+
+	if *sweep != "" {
+		for _, s := range strings.Split(*sweep, ",") {
+			size := unitToNumber(strings.TrimSpace(s))
+			if size == 0 || size > 1024*1024*1024 {
+				fmt.Printf("Invalid buffer size \"%s\" specified for parameter \"-sweep\".\n", s)
+				os.Exit(1)
+			}
+			gSweepSizes = append(gSweepSizes, uint32(size))
+		}
+		if *isServer || testParam.TestId != (EthrTestId{Tcp, Bandwidth}) ||
+			*intervalCount > 0 || *loadedLatency || totalBytes > 0 {
+			fmt.Println("Invalid argument, \"-sweep\" is only valid for TCP bandwidth tests on client,\n" +
+				"and can't be used with \"-interval-count\" or \"-bytes\".")
+			os.Exit(1)
+		}
+	}
+
+	if *minBandwidth != "" {
+		gMinBandwidth = unitToNumber(*minBandwidth)
+		if gMinBandwidth == 0 || *isServer || (test != Bandwidth && test != Download && test != Echo) ||
+			len(gSweepSizes) > 0 {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-min-bandwidth\".\n"+
+				"It is only valid for bandwidth, download and echo tests on client,\n"+
+				"and can't be used with \"-sweep\".\n", *minBandwidth)
+			os.Exit(1)
+		}
+	}
+	if *maxP99Str != "" {
+		gMaxP99, err = time.ParseDuration(*maxP99Str)
+		if err != nil || gMaxP99 <= 0 || *isServer || (test != Latency && test != ConnLatency) {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-max-p99\".\n"+
+				"It is only valid for latency and connection latency tests on client.\n", *maxP99Str)
+			os.Exit(1)
+		}
+	}
+
+	if *rampStr != "" {
+		gRamp, err = time.ParseDuration(*rampStr)
+		if err != nil || gRamp <= 0 || *isServer || test != Bandwidth || (proto != Tcp && proto != Sctp) {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-ramp\".\n"+
+				"It is only valid for TCP and SCTP bandwidth tests on client.\n", *rampStr)
+			os.Exit(1)
+		}
+	}
+
+	if *httpTiming && (*isServer || proto != Http || (test != Bandwidth && test != Download)) {
+		fmt.Println("Invalid argument, \"-ttfb\" is only valid for HTTP bandwidth and download tests on client.")
+		os.Exit(1)
+	}
+	gHttpTiming = *httpTiming
+
+	if *sessionName != "" && (*isServer || !isValidLabel(*sessionName) || len(gSweepSizes) > 0 ||
+		*loadedLatency || proto == Dns || testParam.TestId == (EthrTestId{Udp, Bandwidth})) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-session\".\n"+
+			"It is only valid for client, can't contain spaces or '=', and can't be used\n"+
+			"with \"-sweep\", \"-loaded\", DNS or multicast tests.\n", *sessionName)
+		os.Exit(1)
+	}
+	gSessionName = *sessionName
+	sessionLinger, err := time.ParseDuration(*sessionLingerStr)
+	if err != nil || sessionLinger <= 0 || (sessionLinger != gSessionLinger && !*isServer) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-session-linger\".\n"+
+			"It is only valid for server.\n", *sessionLingerStr)
+		os.Exit(1)
+	}
+	gSessionLinger = sessionLinger
+
+	switch *family {
+	case "any":
+	case "4":
+		gAddrFamily = family4
+	case "6":
+		gAddrFamily = family6
+	case "both":
+		gAddrFamily = familyBoth
+	default:
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-family\".\n", *family)
+		os.Exit(1)
+	}
+	if gAddrFamily != familyAny && (*isServer || proto == Dns) ||
+		gAddrFamily == familyBoth && (len(gSweepSizes) > 0 || *loadedLatency || *validate ||
+			gMinBandwidth > 0 || gMaxP99 > 0 || gSessionName != "" || *pmtu) {
+		fmt.Println("Invalid argument, \"-family\" is only valid for client, not for DNS tests,\n" +
+			"and \"both\" can't be used with \"-sweep\", \"-loaded\", \"-validate\",\n" +
+			"\"-min-bandwidth\", \"-max-p99\", \"-session\" or \"-pmtu\".")
+		os.Exit(1)
+	}
+
+	if *numeric && (*isServer || proto == Dns) {
+		fmt.Println("Invalid argument, \"-numeric\" is only valid for client, not for DNS tests.")
+		os.Exit(1)
+	}
+	gNumeric = *numeric
+
+	if *resultLine && !*isServer {
+		fmt.Println("Invalid argument, \"-result-line\" is only valid for server.")
+		os.Exit(1)
+	}
+	gResultLine = *resultLine
+
+	if (len(enable) > 0 || len(disable) > 0) && !*isServer {
+		fmt.Println("Invalid argument, \"-enable\" and \"-disable\" are only valid for server.")
+		os.Exit(1)
+	}
+	err = selectListeners(enable, disable)
+	if err != nil {
+		fmt.Printf("Invalid value specified for parameter \"-enable\" or \"-disable\": %v\n", err)
+		os.Exit(1)
+	}
+	gWireRate = *wireRate
+	gToken = *token
+
+	if *behindProxy && !*isServer {
+		fmt.Println("Invalid argument, \"-behind-proxy\" is only valid for server.")
+		os.Exit(1)
+	}
+	gBehindProxy = *behindProxy
+
+	if *maxRttCount <= 0 || int64(*maxRttCount) > math.MaxUint32 ||
+		(*maxRttCount != int(gMaxRttCount) && !*isServer) {
+		fmt.Printf("Invalid value \"%d\" specified for parameter \"-max-rtt-count\".\n"+
+			"It is only valid for server.\n", *maxRttCount)
+		os.Exit(1)
+	}
+	gMaxRttCount = uint32(*maxRttCount)
+
+	if *backlog < 0 || (*backlog > 0 && !*isServer) {
+		fmt.Printf("Invalid value \"%d\" specified for parameter \"-backlog\".\n"+
+			"It is only valid for server.\n", *backlog)
+		os.Exit(1)
+	}
+	gListenBacklog = *backlog
+
+	if *syslogAddr != "" {
+		_, _, err = parseSyslogAddr(*syslogAddr)
+		if err != nil || !*isServer {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-syslog\".\n"+
+				"It is only valid for server, and must be [udp:// | tcp://]<host>:<port>.\n",
+				*syslogAddr)
+			os.Exit(1)
+		}
+	}
+	gSyslogAddr = *syslogAddr
+
+	if *sendfile && !*isServer {
+		fmt.Println("Invalid argument, \"-sendfile\" is only valid for server.")
+		os.Exit(1)
+	}
+	gSendfile = *sendfile && sendfileSupported
+
+	if *srcPorts && !*isServer {
+		fmt.Println("Invalid argument, \"-src-ports\" is only valid for server.")
+		os.Exit(1)
+	}
+	gSrcPorts = *srcPorts
+
+	if *systemd && !*isServer {
+		fmt.Println("Invalid argument, \"-systemd\" is only valid for server.")
+		os.Exit(1)
+	}
+	gSystemd = *systemd
+
+	if *restApi && !*isServer {
+		fmt.Println("Invalid argument, \"-rest\" is only valid for server.")
+		os.Exit(1)
+	}
+	gRestApi = *restApi
+
+	if *adminToken != "" && !*isServer {
+		fmt.Println("Invalid argument, \"-admin-token\" is only valid for server.")
+		os.Exit(1)
+	}
+	gAdminToken = *adminToken
+
+	portNum, err := strconv.ParseUint(*port, 10, 16)
+	if err != nil || (portNum == 0 && !*isServer) {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-port\".\n"+
+			"It must be a port number, or 0 for server only.\n", *port)
+		os.Exit(1)
+	}
+	if portNum == 0 {
+		setEphemeralPorts()
+	} else {
+		ctrlPort = strconv.FormatUint(portNum, 10)
+	}
+
+	if *bind != "" {
+		if !*isServer {
+			fmt.Println("Invalid argument, \"-bind\" is only valid for server.")
+			os.Exit(1)
+		}
+		hostAddr, err = resolveBindAddr(*bind)
+		if err != nil {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-bind\": %v\n", *bind, err)
+			os.Exit(1)
+		}
+	}
+
+	if *allow != "" {
+		gAllowList, err = parseAllowList(*allow)
+		if err != nil || !*isServer {
+			fmt.Printf("Invalid value \"%s\" specified for parameter \"-allow\".\n"+
+				"It is only valid for server and must be a list of IP addresses or CIDR ranges.\n", *allow)
+			os.Exit(1)
+		}
+	}
+
+	err = outputInit(*resultFile)
+	if err != nil {
+		fmt.Printf("Unable to open the output file %s, Error: %v\n", *resultFile, err)
+		os.Exit(1)
+	}
+
+	err = hdrInit(*hdrFile)
+	if err != nil {
+		fmt.Printf("Unable to open the histogram file %s, Error: %v\n", *hdrFile, err)
+		os.Exit(1)
+	}
+
+	err = rawLatencyInit(*rawLatency)
+	if err != nil {
+		fmt.Printf("Unable to open the raw latency file %s, Error: %v\n", *rawLatency, err)
+		os.Exit(1)
+	}
+
+	// The p99 over the test is taken from the t-digest.
+	gTDigest = *tdigest || gMaxP99 > 0
+
+	err = otlpInit(*otlp)
+	if err != nil {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-otlp\": %v\n", *otlp, err)
+		os.Exit(1)
+	}
+
+	err = influxInit(*influx)
+	if err != nil {
+		fmt.Printf("Invalid value \"%s\" specified for parameter \"-influx\": %v\n", *influx, err)
 		os.Exit(1)
 	}
 
@@ -150,10 +1069,47 @@ func main() {
 			}
 			logInit(logFileName, *debug)
 		}
+		if *pmtu {
+			os.Exit(runPmtuClient(*clientServerIP, proto))
+		}
+		if proto == Dns {
+			runDnsClient(testParam, *clientServerIP, duration)
+			return
+		}
+		if testParam.TestId == (EthrTestId{Udp, Bandwidth}) {
+			runMcastClient(testParam, *clientServerIP, duration)
+			return
+		}
 		runClient(testParam, *clientServerIP, duration)
 	}
 }
 
+func parsePortRange(s string) (uint16, uint16) {
+	ports := strings.Split(s, "-")
+	if len(ports) != 2 {
+		return 0, 0
+	}
+	min, err := strconv.ParseUint(strings.TrimSpace(ports[0]), 10, 16)
+	if err != nil {
+		return 0, 0
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(ports[1]), 10, 16)
+	if err != nil || min == 0 || max < min {
+		return 0, 0
+	}
+	return uint16(min), uint16(max)
+}
+
+func isFlagPassed(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
 func emitUnsupportedTest(test EthrTestParam) {
 	fmt.Printf("Error: \"%s\" test for \"%s\" is not supported.\n",
 		testToString(test.TestId.Type), protoToString(test.TestId.Protocol))
@@ -164,17 +1120,38 @@ func validateTestParam(test EthrTestParam) bool {
 	protocol := test.TestId.Protocol
 	switch protocol {
 	case Tcp:
-		if testType != Bandwidth && testType != Cps && testType != Latency {
+		if testType != Bandwidth && testType != Cps && testType != Latency && testType != PingPong &&
+			testType != ConnLatency {
 			emitUnsupportedTest(test)
 			return false
 		}
 	case Udp:
-		if testType != Pps {
+		if testType != Pps && testType != Bandwidth {
 			emitUnsupportedTest(test)
 			return false
 		}
+		if test.BufferSize > maxUdpPayload {
+			fmt.Printf("Invalid length %d, UDP packets can carry at most %d bytes.\n",
+				test.BufferSize, maxUdpPayload)
+			return false
+		}
 	case Http:
-		if testType != Bandwidth {
+		if testType != Bandwidth && testType != Download && testType != Echo {
+			emitUnsupportedTest(test)
+			return false
+		}
+	case Quic:
+		if testType != Bandwidth && testType != Download {
+			emitUnsupportedTest(test)
+			return false
+		}
+	case Grpc, Sctp:
+		if testType != Bandwidth && testType != Latency {
+			emitUnsupportedTest(test)
+			return false
+		}
+	case Dns:
+		if testType != Latency {
 			emitUnsupportedTest(test)
 			return false
 		}
@@ -184,3 +1161,63 @@ func validateTestParam(test EthrTestParam) bool {
 	}
 	return true
 }
+
+//
+// Labels end up in space separated key=value result lines, so they can't
+// contain spaces or '=', nor anything that isn't printable.
+//
+const maxLabelLen = 64
+
+func isValidLabel(label string) bool {
+	if len(label) > maxLabelLen {
+		return false
+	}
+	for _, r := range label {
+		if !unicode.IsPrint(r) || unicode.IsSpace(r) || r == '=' {
+			return false
+		}
+	}
+	return true
+}
+
+func parseAllowList(s string) ([]*net.IPNet, error) {
+	var allowList []*net.IPNet
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			allowList = append(allowList, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		allowList = append(allowList, ipNet)
+	}
+	return allowList, nil
+}
+
+//
+// A flag that can be repeated, and takes a comma separated list each time.
+//
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	for _, v := range strings.Split(s, ",") {
+		*l = append(*l, strings.TrimSpace(v))
+	}
+	return nil
+}
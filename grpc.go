@@ -0,0 +1,265 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
+)
+
+//
+// The gRPC tests measure bandwidth and latency over gRPC streams, to compare
+// the overhead of HTTP/2 framing and gRPC with raw TCP. Messages are raw
+// bytes, so there is no generated protobuf code; both sides use rawCodec
+// instead of the protobuf codec, and the service is described by hand.
+//
+const grpcServiceName = "ethr.Ethr"
+
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, errors.New("rawCodec: unexpected message type")
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return errors.New("rawCodec: unexpected message type")
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "ethr-raw"
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Upload",
+			Handler:       handleGrpcUpload,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Echo",
+			Handler:       handleGrpcEcho,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+}
+
+func runGrpcServer() {
+	l, err := net.Listen(protoTCP, net.JoinHostPort(hostAddr, grpcPort))
+	if err != nil {
+		ui.printErr("Unable to start gRPC server, so gRPC tests cannot be run: %v", err)
+		return
+	}
+	setBoundPort(&grpcPort, l.Addr())
+	l = wrapListener(l)
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}))
+	server.RegisterService(&grpcServiceDesc, nil)
+	ui.printMsg("Listening on " + l.Addr().String() + " for gRPC tests")
+	go func() {
+		err := server.Serve(l)
+		if err != nil {
+			ui.printErr("gRPC server stopped, so gRPC tests cannot be run: %v", err)
+		}
+	}()
+}
+
+func getGrpcTest(stream grpc.ServerStream, testType EthrTestType) *ethrTest {
+	p, ok := peer.FromContext(stream.Context())
+	if !ok {
+		return nil
+	}
+	server, _, _ := net.SplitHostPort(p.Addr.String())
+	return getTest(server, Grpc, testType)
+}
+
+func handleGrpcUpload(srv interface{}, stream grpc.ServerStream) error {
+	handlerEnter()
+	defer handlerExit()
+	test := getGrpcTest(stream, Bandwidth)
+	if test == nil {
+		return errors.New("unauthorized request")
+	}
+	var msg []byte
+	for {
+		err := stream.RecvMsg(&msg)
+		if err != nil {
+			return nil
+		}
+		if !test.addBandwidthData(uint64(len(msg))) {
+			return nil
+		}
+	}
+}
+
+//
+// The server echoes each message back. It measures the time from sending
+// the echo to receiving the next message, which is close to the round trip
+// time, as the client sends the next message right away.
+//
+func handleGrpcEcho(srv interface{}, stream grpc.ServerStream) error {
+	handlerEnter()
+	defer handlerExit()
+	test := getGrpcTest(stream, Latency)
+	if test == nil {
+		return errors.New("unauthorized request")
+	}
+	ui.emitLatencyHdr()
+	rttCount := test.testParam.RttCount
+	sum, count := time.Duration(0), uint32(0)
+	var msg []byte
+	var sent time.Time
+	for {
+		err := stream.RecvMsg(&msg)
+		if err != nil {
+			return nil
+		}
+		if !sent.IsZero() {
+			sum += time.Since(sent)
+			count++
+			if count == rttCount {
+				atomic.StoreUint64(&test.testResult.lastLatencyNs, uint64(sum/time.Duration(count)))
+				sum, count = 0, 0
+			}
+		}
+		err = stream.SendMsg(&msg)
+		if err != nil {
+			return nil
+		}
+		sent = time.Now()
+	}
+}
+
+func dialGrpc(test *ethrTest) (*grpc.ClientConn, error) {
+	server := test.session.remoteAddr
+	return grpc.Dial(joinHostPort(server, grpcPort),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+}
+
+func runGrpcTest(test *ethrTest) {
+	if test.testParam.TestId.Type == Latency {
+		ui.emitLatencyHdr()
+		runGrpcLatencyTest(test)
+		return
+	}
+	conn, err := dialGrpc(test)
+	if err != nil {
+		ui.printErr("Error dialing the gRPC server: %v", err)
+		os.Exit(1)
+	}
+	ui.printMsg("Connecting to host %s, port %s", test.session.remoteAddr, grpcPort)
+	for th := uint32(0); th < test.testParam.NumThreads; th++ {
+		go func() {
+			buff := make([]byte, test.testParam.BufferSize)
+			for i := range buff {
+				buff[i] = byte(i)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			stream, err := conn.NewStream(ctx, &grpcServiceDesc.Streams[0],
+				"/"+grpcServiceName+"/Upload")
+			if err != nil {
+				ui.printErr("Error opening gRPC stream: %v", err)
+				return
+			}
+			blen := uint64(len(buff))
+		ExitForLoop:
+			for {
+				select {
+				case <-test.done:
+					break ExitForLoop
+				default:
+					err = stream.SendMsg(&buff)
+					if err != nil {
+						ui.printDbg("Error sending on gRPC stream: %v", err)
+						break ExitForLoop
+					}
+					atomic.AddUint64(&test.testResult.bytes, blen)
+				}
+			}
+		}()
+	}
+	<-test.done
+	conn.Close()
+}
+
+func runGrpcLatencyTest(test *ethrTest) {
+	// See runLatencyTest.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	conn, err := dialGrpc(test)
+	if err != nil {
+		ui.printErr("Error dialing the gRPC server: %v", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream, err := conn.NewStream(ctx, &grpcServiceDesc.Streams[1], "/"+grpcServiceName+"/Echo")
+	if err != nil {
+		ui.printErr("Error opening gRPC stream: %v", err)
+		os.Exit(1)
+	}
+	buff := []byte{0}
+	rttCount := test.testParam.RttCount
+	latencyNumbers := make([]time.Duration, rttCount)
+	windowSize := test.testParam.LatencyWindow
+	if windowSize == 0 {
+		windowSize = rttCount
+	}
+	window := newLatencyWindow(windowSize)
+	for {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		batchStart := time.Now()
+		for i := uint32(0); i < rttCount; i++ {
+			s1 := time.Now()
+			err = stream.SendMsg(&buff)
+			if err == nil {
+				err = stream.RecvMsg(&buff)
+			}
+			if err != nil {
+				ui.printDbg("Error on gRPC stream: %v", err)
+				return
+			}
+			e2 := time.Since(s1)
+			latencyNumbers[i] = e2
+			window.add(e2)
+		}
+		test.addLatencySamples(latencyNumbers)
+		avg, min, max, p50, p90, p95, p99, p999, p9999, stddev := calcLatencyResults(window.values())
+		if hdrEnabled() {
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev =
+				hdrRecordLatency(test.session.remoteAddr, batchStart, latencyNumbers, window.values())
+		}
+		ui.emitLatencyResults(test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol),
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
+	}
+}
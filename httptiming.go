@@ -0,0 +1,166 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+//
+// With "-ttfb", the client of HTTP bandwidth and download tests times the
+// phases of each request: the DNS lookup, connect and TLS handshake of new
+// connections, and the time to the first byte of the response, from when the
+// request was made. The p50 and p99 of each phase are reported per interval,
+// and logged as latency results with the phase in the protocol, e.g.
+// "HTTP-TTFB". Connections are kept alive, so most requests have no DNS,
+// connect or TLS phase, and phases without samples are not reported.
+//
+var gHttpTiming bool
+
+const (
+	httpPhaseDns = iota
+	httpPhaseConnect
+	httpPhaseTls
+	httpPhaseFirstByte
+	httpPhaseMax
+)
+
+var httpPhaseNames = [httpPhaseMax]string{"DNS", "Conn", "TLS", "TTFB"}
+
+//
+// The samples of the current interval, and the digests of the whole test, for
+// the summary.
+//
+var httpTimings struct {
+	lock    sync.Mutex
+	samples [httpPhaseMax][]time.Duration
+	digests [httpPhaseMax]*tDigest
+}
+
+func addHttpTiming(phase int, d time.Duration) {
+	httpTimings.lock.Lock()
+	httpTimings.samples[phase] = append(httpTimings.samples[phase], d)
+	httpTimings.lock.Unlock()
+}
+
+//
+// It adds the hooks that time the phases of requests to trace, and returns
+// the function to call as each request is made. Requests with the trace must
+// be made one at a time. Dialing is done apart from the request, and may try
+// several addresses at once, so connects are timed per address.
+//
+func addHttpTimingHooks(trace *httptrace.ClientTrace) func() {
+	if !gHttpTiming {
+		return func() {}
+	}
+	var lock sync.Mutex
+	var dnsStart, tlsStart time.Time
+	connectStart := make(map[string]time.Time)
+	trace.DNSStart = func(httptrace.DNSStartInfo) {
+		lock.Lock()
+		dnsStart = time.Now()
+		lock.Unlock()
+	}
+	trace.DNSDone = func(info httptrace.DNSDoneInfo) {
+		lock.Lock()
+		defer lock.Unlock()
+		if info.Err == nil && !dnsStart.IsZero() {
+			addHttpTiming(httpPhaseDns, time.Since(dnsStart))
+		}
+	}
+	trace.ConnectStart = func(network, addr string) {
+		lock.Lock()
+		connectStart[addr] = time.Now()
+		lock.Unlock()
+	}
+	trace.ConnectDone = func(network, addr string, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		start, found := connectStart[addr]
+		delete(connectStart, addr)
+		if err == nil && found {
+			addHttpTiming(httpPhaseConnect, time.Since(start))
+		}
+	}
+	trace.TLSHandshakeStart = func() {
+		lock.Lock()
+		tlsStart = time.Now()
+		lock.Unlock()
+	}
+	trace.TLSHandshakeDone = func(_ tls.ConnectionState, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err == nil && !tlsStart.IsZero() {
+			addHttpTiming(httpPhaseTls, time.Since(tlsStart))
+		}
+	}
+	var reqStart time.Time
+	trace.GotFirstResponseByte = func() {
+		lock.Lock()
+		defer lock.Unlock()
+		addHttpTiming(httpPhaseFirstByte, time.Since(reqStart))
+	}
+	return func() {
+		lock.Lock()
+		reqStart = time.Now()
+		lock.Unlock()
+	}
+}
+
+func emitHttpTimings(test *ethrTest) {
+	if !gHttpTiming {
+		return
+	}
+	var samples [httpPhaseMax][]time.Duration
+	httpTimings.lock.Lock()
+	for phase := range samples {
+		samples[phase] = httpTimings.samples[phase]
+		httpTimings.samples[phase] = nil
+		if len(samples[phase]) > 0 {
+			if httpTimings.digests[phase] == nil {
+				httpTimings.digests[phase] = newTDigest(tdigestCompression)
+			}
+			httpTimings.digests[phase].addSamples(samples[phase])
+		}
+	}
+	httpTimings.lock.Unlock()
+	// Lined up with the protocol of the results above, which for bandwidth
+	// tests follows the id of the connection.
+	indent := "  "
+	if test.testParam.TestId.Type == Bandwidth {
+		indent = "          "
+	}
+	for phase, s := range samples {
+		if len(s) == 0 {
+			continue
+		}
+		avg, min, max, p50, p90, p95, p99, p999, p9999, stddev := calcLatencyResults(s)
+		ui.printMsg("%s%-5s    %03d-%03d sec   p50 %9s   p99 %9s   %d samples", indent, httpPhaseNames[phase],
+			gInterval, gInterval+1, latencyToString(p50), latencyToString(p99), len(s))
+		logLatency(test.session.remoteAddr, protoToString(test.testParam.TestId.Protocol)+"-"+
+			httpPhaseNames[phase], avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
+	}
+}
+
+func emitHttpTimingSummary(test *ethrTest) {
+	if !gHttpTiming {
+		return
+	}
+	httpTimings.lock.Lock()
+	defer httpTimings.lock.Unlock()
+	for phase, td := range httpTimings.digests {
+		if td == nil {
+			continue
+		}
+		n, _, _, _ := td.summary()
+		ui.printMsg("%s %s with %s over %d samples: p50 %s, p99 %s",
+			protoToString(test.testParam.TestId.Protocol), httpPhaseNames[phase], test.remoteWithId(), n,
+			latencyToString(td.quantile(0.5)), latencyToString(td.quantile(0.99)))
+	}
+}
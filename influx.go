@@ -0,0 +1,254 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// With "-influx", results are also written to InfluxDB in line protocol, one
+// line per test and interval, e.g.
+// ethr,host=myhost,remote=10.0.0.1,protocol=TCP,test_type=bandwidth bits_per_second=123i
+// Lines are batched, and sent once per interval, over UDP or to the HTTP
+// write endpoint given by the URL, e.g. udp://influx:8089 or
+// http://influx:8086/write?db=ethr.
+//
+const (
+	influxMeasurement  = "ethr"
+	influxUdpMaxLen    = 1400
+	influxHttpTimeout  = 5 * time.Second
+	influxPendingBatch = 16
+)
+
+var influxUrl *url.URL
+var influxHost string
+var influxLock sync.Mutex
+var influxBuf bytes.Buffer
+var influxChan chan []byte
+var influxDone chan struct{}
+
+func influxInit(rawUrl string) error {
+	if rawUrl == "" {
+		return nil
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "udp", "http", "https":
+	default:
+		return errors.New("unsupported scheme, use udp, http or https")
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	influxHost, _ = os.Hostname()
+	influxUrl = u
+	influxChan = make(chan []byte, influxPendingBatch)
+	influxDone = make(chan struct{})
+	go runInfluxWriter()
+	return nil
+}
+
+func influxFini() {
+	if influxUrl == nil {
+		return
+	}
+	// The stats timer flushes as well, see emitStats.
+	stopStatsTimer()
+	influxFlush()
+	close(influxChan)
+	<-influxDone
+	influxUrl = nil
+}
+
+//
+// It hands the lines collected since the last flush to the writer goroutine,
+// so that a slow InfluxDB doesn't hold up the stats timer. Batches are
+// dropped if the writer falls too far behind.
+//
+func influxFlush() {
+	if influxUrl == nil {
+		return
+	}
+	influxLock.Lock()
+	if influxBuf.Len() == 0 {
+		influxLock.Unlock()
+		return
+	}
+	batch := make([]byte, influxBuf.Len())
+	copy(batch, influxBuf.Bytes())
+	influxBuf.Reset()
+	influxLock.Unlock()
+	select {
+	case influxChan <- batch:
+	default:
+		logDbg("Dropping InfluxDB batch, writer is falling behind.")
+	}
+}
+
+func runInfluxWriter() {
+	defer close(influxDone)
+	var conn net.Conn
+	var err error
+	if influxUrl.Scheme == "udp" {
+		conn, err = net.Dial(protoUDP, influxUrl.Host)
+		if err != nil {
+			ui.printErr("Unable to connect to InfluxDB at %s: %v", influxUrl.Host, err)
+		} else {
+			defer conn.Close()
+		}
+	}
+	client := &http.Client{Timeout: influxHttpTimeout}
+	failing := false
+	for batch := range influxChan {
+		if influxUrl.Scheme != "udp" {
+			err = influxPost(client, batch)
+		} else if conn != nil {
+			err = influxSendUdp(conn, batch)
+		}
+		influxReportError(err, &failing)
+	}
+}
+
+//
+// Errors are shown when writes start failing, and when they succeed again,
+// rather than once per interval while InfluxDB is down. All errors are
+// logged.
+//
+func influxReportError(err error, failing *bool) {
+	if err != nil {
+		if !*failing {
+			ui.printErr("Error writing results to InfluxDB: %v", err)
+		} else {
+			logErr("Error writing results to InfluxDB: " + err.Error())
+		}
+		*failing = true
+	} else if *failing {
+		ui.printMsg("Writing results to InfluxDB again.")
+		*failing = false
+	}
+}
+
+func influxPost(client *http.Client, batch []byte) error {
+	resp, err := client.Post(influxUrl.String(), "text/plain; charset=utf-8", bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("unexpected HTTP status " + resp.Status)
+	}
+	return nil
+}
+
+//
+// Over UDP, each datagram must contain whole lines, so the batch is split at
+// line boundaries into datagrams that fit a typical MTU.
+//
+func influxSendUdp(conn net.Conn, batch []byte) error {
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > influxUdpMaxLen {
+			n = bytes.LastIndexByte(batch[:influxUdpMaxLen], '\n') + 1
+			if n == 0 {
+				n = bytes.IndexByte(batch, '\n') + 1
+				if n == 0 {
+					n = len(batch)
+				}
+			}
+		}
+		_, err := conn.Write(batch[:n])
+		if err != nil {
+			return err
+		}
+		batch = batch[n:]
+	}
+	return nil
+}
+
+var influxTagEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+
+func influxWrite(remote, proto, testType string, fields map[string]uint64) {
+	otlpWrite(remote, proto, testType, fields)
+	if influxUrl == nil || len(fields) == 0 {
+		return
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var line bytes.Buffer
+	line.WriteString(influxMeasurement)
+	line.WriteString(",host=" + influxTagEscaper.Replace(influxHost))
+	if gLabel != "" {
+		line.WriteString(",label=" + influxTagEscaper.Replace(gLabel))
+	}
+	line.WriteString(",remote=" + influxTagEscaper.Replace(remote))
+	line.WriteString(",protocol=" + influxTagEscaper.Replace(proto))
+	line.WriteString(",test_type=" + testType)
+	for i, k := range keys {
+		if i == 0 {
+			line.WriteByte(' ')
+		} else {
+			line.WriteByte(',')
+		}
+		line.WriteString(k + "=" + strconv.FormatUint(fields[k], 10) + "i")
+	}
+	line.WriteString(" " + strconv.FormatInt(time.Now().UnixNano(), 10) + "\n")
+	influxLock.Lock()
+	influxBuf.Write(line.Bytes())
+	influxLock.Unlock()
+}
+
+func influxLatency(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev time.Duration) {
+	influxWrite(remote, proto, "latency", map[string]uint64{
+		"avg_ns":    uint64(avg),
+		"min_ns":    uint64(min),
+		"max_ns":    uint64(max),
+		"p50_ns":    uint64(p50),
+		"p90_ns":    uint64(p90),
+		"p95_ns":    uint64(p95),
+		"p99_ns":    uint64(p99),
+		"p99_9_ns":  uint64(p999),
+		"p99_99_ns": uint64(p9999),
+		"stddev_ns": uint64(stddev),
+	})
+}
+
+//
+// The server reports all tests of a client and protocol together, so they are
+// split here into one line per test type.
+//
+func influxServerResults(remote string, proto EthrProtocol, bw, cps, pps, latency uint64,
+	bwTestOn, cpsTestOn, ppsTestOn, latTestOn bool) {
+	protoStr := protoToString(proto)
+	if bwTestOn {
+		influxWrite(remote, protoStr, "bandwidth", map[string]uint64{"bits_per_second": bw * 8})
+	}
+	if cpsTestOn {
+		influxWrite(remote, protoStr, "cps", map[string]uint64{"connections_per_second": cps})
+	}
+	if ppsTestOn {
+		influxWrite(remote, protoStr, "pps", map[string]uint64{"packets_per_second": pps})
+	}
+	if latTestOn {
+		influxWrite(remote, protoStr, "latency", map[string]uint64{"avg_ns": latency})
+	}
+}
@@ -6,10 +6,13 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -23,6 +26,7 @@ type logLatencyData struct {
 	Type       string
 	RemoteAddr string
 	Protocol   string
+	Label      string `json:",omitempty"`
 	Avg        string
 	Min        string
 	P50        string
@@ -32,6 +36,8 @@ type logLatencyData struct {
 	P999       string
 	P9999      string
 	Max        string
+	StdDev     string
+	CV         float64
 }
 
 type logTestResults struct {
@@ -39,9 +45,12 @@ type logTestResults struct {
 	RemoteAddr           string
 	Protocol             string
 	BitsPerSecond        string
+	BytesPerSecond       string `json:",omitempty"`
 	ConnectionsPerSecond string
 	PacketsPerSecond     string
 	AverageLatency       string
+	Label                string `json:",omitempty"`
+	TestId               string `json:",omitempty"`
 }
 
 var loggingActive = false
@@ -87,10 +96,12 @@ func _log(prefix, msg string) {
 }
 
 func logMsg(msg string) {
+	syslogWrite(syslogSevInfo, msg)
 	_log("INFO", msg)
 }
 
 func logErr(msg string) {
+	syslogWrite(syslogSevErr, msg)
 	_log("ERROR", msg)
 }
 
@@ -101,37 +112,141 @@ func logDbg(msg string) {
 }
 
 func logResults(s []string) {
+	outputResults(s)
 	if loggingActive {
 		logData := logTestResults{}
 		logData.Type = "TestResult"
 		logData.RemoteAddr = s[0]
 		logData.Protocol = s[1]
-		logData.BitsPerSecond = s[2]
+		if gRateFormat != rateBits {
+			logData.BytesPerSecond = s[2]
+		} else {
+			logData.BitsPerSecond = s[2]
+		}
 		logData.ConnectionsPerSecond = s[3]
 		logData.PacketsPerSecond = s[4]
 		logData.AverageLatency = s[5]
+		logData.Label = gLabel
+		if len(s) > 6 {
+			logData.TestId = s[6]
+		}
 		logJson, _ := json.Marshal(logData)
 		logChan <- string(logJson)
 	}
 }
 
-func logLatency(remoteAddr, proto string, avg, min, p50, p90, p95, p99, p999, p9999, max time.Duration) {
+func logLatency(remoteAddr, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev time.Duration) {
+	outputLatency(remoteAddr, proto, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
+	influxLatency(remoteAddr, proto, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
 	if loggingActive {
 		logData := logLatencyData{}
 		logData.Time = time.Now().UTC().Format(time.RFC3339)
 		logData.Type = "LatencyResult"
 		logData.RemoteAddr = remoteAddr
 		logData.Protocol = proto
-		logData.Avg = durationToString(avg)
-		logData.Min = durationToString(min)
-		logData.P50 = durationToString(p50)
-		logData.P90 = durationToString(p90)
-		logData.P95 = durationToString(p95)
-		logData.P99 = durationToString(p99)
-		logData.P999 = durationToString(p999)
-		logData.P9999 = durationToString(p9999)
-		logData.Max = durationToString(max)
+		logData.Label = gLabel
+		logData.Avg = latencyToString(avg)
+		logData.Min = latencyToString(min)
+		logData.P50 = latencyToString(p50)
+		logData.P90 = latencyToString(p90)
+		logData.P95 = latencyToString(p95)
+		logData.P99 = latencyToString(p99)
+		logData.P999 = latencyToString(p999)
+		logData.P9999 = latencyToString(p9999)
+		logData.Max = latencyToString(max)
+		logData.StdDev = latencyToString(stddev)
+		logData.CV = latencyCv(avg, stddev)
 		logJson, _ := json.Marshal(logData)
 		logChan <- string(logJson)
 	}
 }
+
+//
+// Plain text copy of the results, written to the file specified by "-output"
+// in addition to the console and the JSON log. It is flushed every interval.
+//
+var outputFile *os.File
+var outputWriter *bufio.Writer
+var outputLock sync.Mutex
+
+func outputInit(fileName string) error {
+	if fileName == "" {
+		return nil
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	outputLock.Lock()
+	outputFile = f
+	outputWriter = bufio.NewWriter(f)
+	outputLock.Unlock()
+	return nil
+}
+
+func outputFini() {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	if outputFile == nil {
+		return
+	}
+	outputWriter.Flush()
+	outputFile.Close()
+	outputFile = nil
+	outputWriter = nil
+}
+
+func outputFlush() {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	if outputWriter != nil {
+		outputWriter.Flush()
+	}
+}
+
+func outputLine(fields []string) {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+	if outputWriter != nil {
+		outputWriter.WriteString(time.Now().UTC().Format(time.RFC3339) + " " +
+			strings.Join(fields, " ") + "\n")
+	}
+}
+
+func outputResults(s []string) {
+	fields := []string{s[0], s[1]}
+	names := []string{strings.ToLower(rateUnit()), "conn/s", "pkt/s", "latency"}
+	for i, name := range names {
+		if s[i+2] != "" {
+			fields = append(fields, name+"="+s[i+2])
+		}
+	}
+	if gLabel != "" {
+		fields = append(fields, "label="+gLabel)
+	}
+	if len(s) > 6 && s[6] != "" {
+		fields = append(fields, "test_id="+s[6])
+	}
+	syslogWrite(syslogSevInfo, strings.Join(fields, " "))
+	outputLine(fields)
+}
+
+func outputLatency(remoteAddr, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev time.Duration) {
+	fields := []string{remoteAddr, proto,
+		"avg=" + latencyToString(avg),
+		"min=" + latencyToString(min),
+		"p50=" + latencyToString(p50),
+		"p90=" + latencyToString(p90),
+		"p95=" + latencyToString(p95),
+		"p99=" + latencyToString(p99),
+		"p99.9=" + latencyToString(p999),
+		"p99.99=" + latencyToString(p9999),
+		"max=" + latencyToString(max),
+		"stddev=" + latencyToString(stddev),
+		fmt.Sprintf("cv=%.2f", latencyCv(avg, stddev))}
+	if gLabel != "" {
+		fields = append(fields, "label="+gLabel)
+	}
+	syslogWrite(syslogSevInfo, strings.Join(fields, " "))
+	outputLine(fields)
+}
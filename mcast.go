@@ -0,0 +1,274 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+//
+// With "-mcast", the server also sends a stream of UDP packets to a multicast
+// group, for IPTV or market data style validation. Clients receive it with a
+// UDP bandwidth test whose "-c" target is the group, which joins the group
+// rather than connecting to a server, so there is no control channel, as for
+// DNS tests. Each of the "-n" receivers joins the group on its own socket and
+// gets its own copy of the stream, so the throughput and loss of each is
+// reported along with the aggregate. Packets start with the id of the stream
+// and their sequence number, so that receivers count the packets they missed.
+// Packets that arrive out of order were counted as lost when skipped, and are
+// taken back when they arrive.
+//
+const (
+	mcastPort        = "9989"
+	mcastHdrLen      = 16
+	mcastDefaultSize = 1024
+	mcastMaxLag      = 100 * time.Millisecond
+)
+
+//
+// Settings of the sender on the server, and the interface the client joins
+// the group on, nil for the one chosen by the system.
+//
+var gMcastGroup *net.UDPAddr
+var gMcastRate uint64 = 10 * MEGA
+var gMcastSize uint32 = mcastDefaultSize
+var gMcastTtl = 1
+var gMcastIf *net.Interface
+
+type mcastReceiver struct {
+	ec          *ethrConn
+	packets     uint64
+	lost        uint64
+	lastPackets uint64
+	lastLost    uint64
+}
+
+var mcastReceivers []*mcastReceiver
+
+//
+// The port is optional, and defaults to mcastPort.
+//
+func parseMcastGroup(s string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(s, mcastPort)
+	}
+	addr, err := net.ResolveUDPAddr(protoUDP, s)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, errors.New("not a multicast address: " + addr.IP.String())
+	}
+	return addr, nil
+}
+
+//
+// Packets are paced at the given rate, each one scheduled from when the
+// previous one was due, so that the time spent sending doesn't lower the
+// rate. If the sender falls more than mcastMaxLag behind, e.g. after a stall,
+// it starts over rather than bursting.
+//
+func runMcastSender() {
+	conn, err := net.DialUDP(protoUDP, nil, gMcastGroup)
+	if err != nil {
+		ui.printErr("Unable to send to multicast group %s: %v", gMcastGroup, err)
+		return
+	}
+	defer conn.Close()
+	err = setMulticastTtl(getFd(conn), gMcastGroup.IP.To4() == nil, gMcastTtl)
+	if err != nil {
+		ui.printErr("Unable to set the multicast TTL: %v", err)
+		return
+	}
+	ui.printMsg("Sending to multicast group %s at %s, %d byte packets, TTL %d", gMcastGroup,
+		bytesToRate(gMcastRate/8), gMcastSize, gMcastTtl)
+	buff := make([]byte, gMcastSize)
+	binary.BigEndian.PutUint64(buff[8:], uint64(time.Now().UnixNano()))
+	gap := time.Duration(float64(time.Second) * float64(gMcastSize) * 8 / float64(gMcastRate))
+	next := time.Now()
+	var seq uint64
+	for {
+		if d := time.Until(next); d > 0 {
+			time.Sleep(d)
+		} else if -d > mcastMaxLag {
+			next = time.Now()
+		}
+		next = next.Add(gap)
+		binary.BigEndian.PutUint64(buff, seq)
+		_, err = conn.Write(buff)
+		if err != nil {
+			logDbg(fmt.Sprintf("Error sending to multicast group %s: %v", gMcastGroup, err))
+			continue
+		}
+		seq++
+	}
+}
+
+func runMcastClient(testParam EthrTestParam, server string, d time.Duration) {
+	initClient()
+	group, err := parseMcastGroup(server)
+	if err != nil {
+		ui.printErr("Error: %v", err)
+		os.Exit(1)
+	}
+	test, err := newTest(group.IP.String(), nil, testParam, nil, nil)
+	if err != nil {
+		ui.printErr("Error: %v", err)
+		os.Exit(1)
+	}
+	ui.printMsg("Joining multicast group %s with %d receivers", group, testParam.NumThreads)
+	for i := uint32(0); i < testParam.NumThreads; i++ {
+		conn, err := net.ListenMulticastUDP(protoUDP, gMcastIf, group)
+		if err != nil {
+			ui.printErr("Unable to join multicast group %s: %v", group, err)
+			os.Exit(1)
+		}
+		r := &mcastReceiver{ec: test.newConn(conn)}
+		mcastReceivers = append(mcastReceivers, r)
+		go runMcastReceiver(test, r)
+	}
+	startStatsTimer()
+	test.setActive(true)
+	toStop := make(chan int, 1)
+	runDurationTimer(d, toStop)
+	runIntervalCounter(toStop)
+	handleCtrlC(toStop)
+	reason := <-toStop
+	close(test.done)
+	stopStatsTimer()
+	test.connListDo(func(ec *ethrConn) {
+		ec.conn.Close()
+	})
+	emitBandwidthSummary(test)
+	emitMcastSummary()
+	passed := checkThresholds(test)
+	switch reason {
+	case timeout:
+		ui.printMsg("Ethr done, duration: " + d.String() + ".")
+	case interrupt:
+		ui.printMsg("Ethr done, received interrupt signal.")
+	case intervalsDone:
+		ui.printMsg("Ethr done, reported %d intervals.", gIntervalCount)
+	}
+	deleteTest(test)
+	outputFini()
+	influxFini()
+	otlpFini()
+	if !passed {
+		os.Exit(1)
+	}
+}
+
+//
+// A change of the stream id means that the sender restarted, so counting
+// starts over from its first packet, as for the first packet received.
+//
+func runMcastReceiver(test *ethrTest, r *mcastReceiver) {
+	buff := make([]byte, maxUdpPayload)
+	var stream, next uint64
+	for {
+		n, err := r.ec.conn.Read(buff)
+		if err != nil {
+			select {
+			case <-test.done:
+				return
+			default:
+			}
+			logDbg(fmt.Sprintf("Error receiving from multicast group: %v", err))
+			continue
+		}
+		if n < mcastHdrLen {
+			continue
+		}
+		seq := binary.BigEndian.Uint64(buff)
+		if id := binary.BigEndian.Uint64(buff[8:]); id != stream {
+			stream = id
+			next = seq
+		}
+		if seq >= next {
+			atomic.AddUint64(&r.lost, seq-next)
+			next = seq + 1
+		} else if atomic.LoadUint64(&r.lost) > 0 {
+			atomic.AddUint64(&r.lost, ^uint64(0))
+		}
+		atomic.AddUint64(&r.packets, 1)
+		atomic.AddUint64(&r.ec.data, uint64(n))
+		atomic.AddUint64(&test.testResult.bytes, uint64(n))
+	}
+}
+
+//
+// Packets that arrive late lower the count of lost packets, so loss in an
+// interval is not reported below 0.
+//
+func (r *mcastReceiver) interval() (packets, lost uint64) {
+	p, l := atomic.LoadUint64(&r.packets), atomic.LoadUint64(&r.lost)
+	packets = p - r.lastPackets
+	if l > r.lastLost {
+		lost = l - r.lastLost
+	}
+	r.lastPackets, r.lastLost = p, l
+	return
+}
+
+func lossToString(packets, lost uint64) string {
+	if packets+lost == 0 {
+		return "0.00%"
+	}
+	return fmt.Sprintf("%.2f%%", float64(lost)*100/float64(packets+lost))
+}
+
+func printMcastResult(test *ethrTest) {
+	if gInterval == 0 {
+		ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
+		ui.printMsg("[ ID]   Protocol    Interval     %7s    Pkts/s      Lost      Loss", rateUnit())
+	}
+	var bytes, packets, lost uint64
+	for _, r := range mcastReceivers {
+		b := atomic.SwapUint64(&r.ec.data, 0)
+		r.ec.total += b
+		p, l := r.interval()
+		ui.printMsg("[%3d]     %-5s    %03d-%03d sec   %7s   %7s   %7s   %7s", r.ec.fd,
+			protoToString(Udp), gInterval, gInterval+1, bytesToRate(b), ppsToString(p),
+			numberToUnit(l), lossToString(p, l))
+		bytes += b
+		packets += p
+		lost += l
+	}
+	if len(mcastReceivers) > 1 {
+		ui.printMsg("[SUM]     %-5s    %03d-%03d sec   %7s   %7s   %7s   %7s",
+			protoToString(Udp), gInterval, gInterval+1, bytesToRate(bytes), ppsToString(packets),
+			numberToUnit(lost), lossToString(packets, lost))
+		ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - -")
+	}
+	test.addBandwidthSample(bytes)
+	logResults([]string{test.session.remoteAddr, protoToString(Udp), bytesToRate(bytes), "",
+		ppsToString(packets), ""})
+	influxWrite(test.session.remoteAddr, protoToString(Udp), "multicast",
+		map[string]uint64{"bits_per_second": bytes * 8, "packets_per_second": packets,
+			"lost_packets": lost})
+}
+
+func emitMcastSummary() {
+	var packets, lost uint64
+	for _, r := range mcastReceivers {
+		p, l := atomic.LoadUint64(&r.packets), atomic.LoadUint64(&r.lost)
+		ui.printMsg("[%3d] received %d packets, lost %d (%s)", r.ec.fd, p, l,
+			lossToString(p, l))
+		packets += p
+		lost += l
+	}
+	if len(mcastReceivers) > 1 {
+		ui.printMsg("[SUM] received %d packets, lost %d (%s)", packets, lost,
+			lossToString(packets, lost))
+	}
+}
@@ -0,0 +1,238 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// With "-otlp", results are also exported as OpenTelemetry metrics, over
+// OTLP/HTTP with the JSON encoding, to a collector, e.g.
+// http://collector:4318. Each value reported to InfluxDB is a gauge here,
+// named after the test type and the field, e.g. ethr.bandwidth.bits_per_second
+// or ethr.latency.p99_ns, with the protocol, test type and remote address as
+// attributes. As for InfluxDB, data points are batched and sent once per
+// interval, and errors are logged without stopping the test.
+//
+const (
+	otlpMetricsPath  = "/v1/metrics"
+	otlpHttpTimeout  = 5 * time.Second
+	otlpPendingBatch = 16
+	otlpScopeName    = "ethr"
+)
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+//
+// 64 bit integers are encoded as strings in the JSON encoding of OTLP.
+//
+type otlpDataPoint struct {
+	Attributes   []otlpAttribute `json:"attributes"`
+	TimeUnixNano string          `json:"timeUnixNano"`
+	AsInt        string          `json:"asInt"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpMetric struct {
+	Name  string    `json:"name"`
+	Unit  string    `json:"unit,omitempty"`
+	Gauge otlpGauge `json:"gauge"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpExportRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+var otlpUrl *url.URL
+var otlpResourceAttrs []otlpAttribute
+var otlpLock sync.Mutex
+var otlpPoints map[string][]otlpDataPoint
+var otlpChan chan []byte
+var otlpDone chan struct{}
+
+func otlpInit(rawUrl string) error {
+	if rawUrl == "" {
+		return nil
+	}
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return errors.New("unsupported scheme, use http or https")
+	}
+	if u.Host == "" {
+		return errors.New("missing host")
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = otlpMetricsPath
+	}
+	host, _ := os.Hostname()
+	otlpResourceAttrs = []otlpAttribute{
+		{"service.name", otlpValue{"ethr"}},
+		{"host.name", otlpValue{host}},
+	}
+	otlpUrl = u
+	otlpPoints = make(map[string][]otlpDataPoint)
+	otlpChan = make(chan []byte, otlpPendingBatch)
+	otlpDone = make(chan struct{})
+	go runOtlpExporter()
+	return nil
+}
+
+func otlpFini() {
+	if otlpUrl == nil {
+		return
+	}
+	// The stats timer flushes as well, see emitStats.
+	stopStatsTimer()
+	otlpFlush()
+	close(otlpChan)
+	<-otlpDone
+	otlpUrl = nil
+}
+
+//
+// It is called for each line written to InfluxDB, see influxWrite, with the
+// same fields.
+//
+func otlpWrite(remote, proto, testType string, fields map[string]uint64) {
+	if otlpUrl == nil || len(fields) == 0 {
+		return
+	}
+	attrs := []otlpAttribute{
+		{"protocol", otlpValue{proto}},
+		{"test_type", otlpValue{testType}},
+		{"remote", otlpValue{remote}},
+	}
+	if gLabel != "" {
+		attrs = append(attrs, otlpAttribute{"label", otlpValue{gLabel}})
+	}
+	now := strconv.FormatInt(time.Now().UnixNano(), 10)
+	otlpLock.Lock()
+	defer otlpLock.Unlock()
+	for k, v := range fields {
+		name := "ethr." + testType + "." + k
+		otlpPoints[name] = append(otlpPoints[name],
+			otlpDataPoint{attrs, now, strconv.FormatUint(v, 10)})
+	}
+}
+
+func otlpFlush() {
+	if otlpUrl == nil {
+		return
+	}
+	otlpLock.Lock()
+	if len(otlpPoints) == 0 {
+		otlpLock.Unlock()
+		return
+	}
+	points := otlpPoints
+	otlpPoints = make(map[string][]otlpDataPoint)
+	otlpLock.Unlock()
+	names := make([]string, 0, len(points))
+	for name := range points {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]otlpMetric, 0, len(names))
+	for _, name := range names {
+		metrics = append(metrics, otlpMetric{name, otlpUnit(name), otlpGauge{points[name]}})
+	}
+	req := otlpExportRequest{[]otlpResourceMetrics{{
+		otlpResource{otlpResourceAttrs},
+		[]otlpScopeMetrics{{otlpScope{otlpScopeName}, metrics}},
+	}}}
+	batch, err := json.Marshal(req)
+	if err != nil {
+		logErr("Error encoding OTLP metrics: " + err.Error())
+		return
+	}
+	select {
+	case otlpChan <- batch:
+	default:
+		logDbg("Dropping OTLP batch, exporter is falling behind.")
+	}
+}
+
+//
+// Units follow the UCUM codes used by OpenTelemetry.
+//
+func otlpUnit(name string) string {
+	switch {
+	case strings.HasSuffix(name, "_ns"):
+		return "ns"
+	case strings.HasSuffix(name, "bits_per_second"):
+		return "bit/s"
+	case strings.HasSuffix(name, "_per_second"):
+		return "1/s"
+	}
+	return ""
+}
+
+func runOtlpExporter() {
+	defer close(otlpDone)
+	client := &http.Client{Timeout: otlpHttpTimeout}
+	for batch := range otlpChan {
+		err := otlpPost(client, batch)
+		if err != nil {
+			logErr("Error exporting metrics to OTLP endpoint: " + err.Error())
+		}
+	}
+}
+
+func otlpPost(client *http.Client, batch []byte) error {
+	resp, err := client.Post(otlpUrl.String(), "application/json", bytes.NewReader(batch))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("unexpected HTTP status " + resp.Status)
+	}
+	return nil
+}
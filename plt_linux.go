@@ -7,12 +7,16 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"io/ioutil"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 
 	tm "github.com/nsf/termbox-go"
+	"golang.org/x/sys/unix"
 )
 
 type ethrNetDevInfo struct {
@@ -142,3 +146,192 @@ func hideCursor() {
 
 func blockWindowResize() {
 }
+
+//
+// Caller must lock the goroutine to its OS thread via runtime.LockOSThread().
+//
+func setThreadAffinity(cpu int) error {
+	var set unix.CPUSet
+	set.Zero()
+	set.Set(cpu)
+	return unix.SchedSetaffinity(0, &set)
+}
+
+func setReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+//
+// SO_REUSEADDR on a listening socket only allows binding to a port that still
+// has connections in TIME_WAIT, so a restarted server can listen right away.
+//
+func setListenReuseAddr(fd uintptr) error {
+	return setReuseAddr(fd)
+}
+
+//
+// /proc/net/netstat has pairs of lines, names and then values, for each
+// group of counters. ListenDrops counts the connections dropped because the
+// accept queue was full, or for other reasons before they were accepted.
+//
+func getListenDrops() (uint64, error) {
+	data, err := ioutil.ReadFile("/proc/net/netstat")
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		if !strings.HasPrefix(lines[i], "TcpExt:") || !strings.HasPrefix(lines[i+1], "TcpExt:") {
+			continue
+		}
+		names := strings.Fields(lines[i])
+		values := strings.Fields(lines[i+1])
+		for j, name := range names {
+			if name == "ListenDrops" && j < len(values) {
+				return strconv.ParseUint(values[j], 10, 64)
+			}
+		}
+		break
+	}
+	return 0, errors.New("ListenDrops not found in /proc/net/netstat")
+}
+
+//
+// The kernel silently caps the backlog at net.core.somaxconn, so it is
+// reported instead of leaving the queue shorter than asked for.
+//
+func setListenBacklog(fd uintptr, backlog int) error {
+	err := syscall.Listen(int(fd), backlog)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile("/proc/sys/net/core/somaxconn")
+	if err != nil {
+		return nil
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && backlog > max {
+		return errors.New("it is capped at " + strconv.Itoa(max) + " by net.core.somaxconn")
+	}
+	return nil
+}
+
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MTU_DISCOVER, unix.IPV6_PMTUDISC_DO)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MTU_DISCOVER, unix.IP_PMTUDISC_DO)
+}
+
+func setMulticastTtl(fd uintptr, ipv6 bool, ttl int) error {
+	if ipv6 {
+		return unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_MULTICAST_HOPS, ttl)
+	}
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_TTL, ttl)
+}
+
+func isAddrNotAvailError(err error) bool {
+	return errors.Is(err, syscall.EADDRNOTAVAIL)
+}
+
+func isMsgSizeError(err error) bool {
+	return errors.Is(err, syscall.EMSGSIZE)
+}
+
+const msgTrunc = unix.MSG_TRUNC
+
+//
+// The ICMP port unreachable that answers a datagram fails the next read on a
+// connected UDP socket.
+//
+func isPortUnreachableError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+func isConnRefusedError(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+//
+// One-to-one style SCTP sockets are SOCK_STREAM sockets, so once bound or
+// connected, the net package wraps them like TCP sockets.
+//
+const sctpNoDelay = 3
+
+func sctpSocket(addr string) (int, unix.Sockaddr, error) {
+	tcpAddr, err := net.ResolveTCPAddr(protoTCP, addr)
+	if err != nil {
+		return -1, nil, err
+	}
+	family := unix.AF_INET6
+	var sa unix.Sockaddr
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+		family = unix.AF_INET
+		sa4 := &unix.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		sa6 := &unix.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		sa = sa6
+	}
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_SCTP)
+	if err != nil {
+		if errors.Is(err, unix.EPROTONOSUPPORT) {
+			return -1, nil, errors.New("SCTP is not available, the sctp kernel module may not be loaded")
+		}
+		return -1, nil, err
+	}
+	err = unix.SetsockoptInt(fd, unix.IPPROTO_SCTP, sctpNoDelay, 1)
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+	return fd, sa, nil
+}
+
+func sctpListen(addr string) (net.Listener, error) {
+	fd, sa, err := sctpSocket(addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := sa.(*unix.SockaddrInet6); ok {
+		// Accept IPv4 as well, as the TCP listeners do.
+		unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+	}
+	err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	if err == nil {
+		err = unix.Bind(fd, sa)
+	}
+	if err == nil {
+		err = unix.Listen(fd, unix.SOMAXCONN)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "sctp")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+func sctpDial(addr string) (net.Conn, error) {
+	fd, sa, err := sctpSocket(addr)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Connect(fd, sa)
+	if err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "sctp")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// TCP connections send files with sendfile, see sendfileInit.
+const sendfileSupported = true
+
+const portExhaustionAdvice = "Consider using \"-cps-ports\", widening " +
+	"net.ipv4.ip_local_port_range or enabling net.ipv4.tcp_tw_reuse."
@@ -0,0 +1,82 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func getNoDelay(t *testing.T, conn net.Conn) bool {
+	rc, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var value int
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		value, serr = unix.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, unix.TCP_NODELAY)
+	})
+	if err == nil {
+		err = serr
+	}
+	if err != nil {
+		t.Fatalf("getsockopt TCP_NODELAY: %v", err)
+	}
+	return value != 0
+}
+
+//
+// The latency handler disables Nagle's algorithm, unless the client asked
+// for it with "-nagle".
+//
+func TestLatencyHandlerNoDelay(t *testing.T) {
+	initServerTest()
+	for _, enableNagle := range []bool{false, true} {
+		l, err := net.Listen(protoTCP, "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen: %v", err)
+		}
+		client, err := net.Dial(protoTCP, l.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial: %v", err)
+		}
+		server, err := l.Accept()
+		l.Close()
+		if err != nil {
+			t.Fatalf("Accept: %v", err)
+		}
+		// Go enables TCP_NODELAY on all TCP connections, so start from
+		// the opposite of what the handler should set.
+		server.(*net.TCPConn).SetNoDelay(enableNagle)
+
+		testParam := EthrTestParam{TestId: EthrTestId{Tcp, Latency}, RttCount: 1,
+			BufferSize: 1, EnableNagle: enableNagle}
+		test, err := newTest("latency-nodelay", nil, testParam, nil, nil)
+		if err != nil {
+			t.Fatalf("newTest: %v", err)
+		}
+		ended := make(chan struct{})
+		go func() {
+			runLatencyHandler(server, test)
+			close(ended)
+		}()
+		deadline := time.Now().Add(time.Second)
+		for getNoDelay(t, server) == enableNagle && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if noDelay := getNoDelay(t, server); noDelay == enableNagle {
+			t.Errorf("TCP_NODELAY is %v with EnableNagle %v", noDelay, enableNagle)
+		}
+		client.Close()
+		<-ended
+		deleteTest(test)
+	}
+}
@@ -6,6 +6,7 @@
 package main
 
 import (
+	"errors"
 	"net"
 	"strings"
 	"syscall"
@@ -24,6 +25,8 @@ var (
 	proc_get_system_menu       = user32.NewProc("GetSystemMenu")
 	proc_delete_menu           = user32.NewProc("DeleteMenu")
 	proc_get_if_entry2         = iphlpapi.NewProc("GetIfEntry2")
+	proc_get_current_thread    = kernel32.NewProc("GetCurrentThread")
+	proc_set_thread_affinity   = kernel32.NewProc("SetThreadAffinityMask")
 )
 
 type ethrNetDevInfo struct {
@@ -204,3 +207,106 @@ func blockWindowResize() {
 	syscall.Syscall(proc_delete_menu.Addr(), 3, sysMenu, SC_MAXIMIZE, MF_BYCOMMAND)
 	syscall.Syscall(proc_delete_menu.Addr(), 3, sysMenu, SC_SIZE, MF_BYCOMMAND)
 }
+
+//
+// Caller must lock the goroutine to its OS thread via runtime.LockOSThread().
+//
+func setThreadAffinity(cpu int) error {
+	h, _, _ := syscall.Syscall(proc_get_current_thread.Addr(), 0, 0, 0, 0)
+	r0, _, err := syscall.Syscall(proc_set_thread_affinity.Addr(), 2, h, uintptr(1)<<uint(cpu), 0)
+	if r0 == 0 {
+		return err
+	}
+	return nil
+}
+
+func setReuseAddr(fd uintptr) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+}
+
+//
+// On Windows, SO_REUSEADDR on a listening socket would allow other sockets
+// to bind to the same port and steal connections, and it isn't needed to
+// listen on a port that has connections in TIME_WAIT, so it isn't set.
+//
+func setListenReuseAddr(fd uintptr) error {
+	return nil
+}
+
+//
+// Winsock ignores listen() on a socket that is already listening, so the
+// backlog can't be changed after the net package created the listener.
+//
+func setListenBacklog(fd uintptr, backlog int) error {
+	return errors.New("changing the listen backlog is not supported on Windows")
+}
+
+func getListenDrops() (uint64, error) {
+	return 0, errors.New("the count of dropped connections is not available on Windows")
+}
+
+const (
+	IP_DONTFRAGMENT = 14
+	IPV6_DONTFRAG   = 14
+)
+
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, IPV6_DONTFRAG, 1)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, IP_DONTFRAGMENT, 1)
+}
+
+func setMulticastTtl(fd uintptr, ipv6 bool, ttl int) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, ttl)
+}
+
+const WSAEADDRNOTAVAIL = 10049
+
+func isAddrNotAvailError(err error) bool {
+	return errors.Is(err, syscall.Errno(WSAEADDRNOTAVAIL))
+}
+
+const WSAEMSGSIZE = 10040
+
+func isMsgSizeError(err error) bool {
+	return errors.Is(err, syscall.Errno(WSAEMSGSIZE))
+}
+
+//
+// Windows doesn't flag truncated datagrams, but fails the receive with
+// WSAEMSGSIZE, see isMsgSizeError.
+//
+const msgTrunc = 0
+
+const WSAECONNRESET = 10054
+
+//
+// Windows reports the ICMP port unreachable that answers a datagram as a reset
+// on the next read.
+//
+func isPortUnreachableError(err error) bool {
+	return errors.Is(err, syscall.Errno(WSAECONNRESET))
+}
+
+const WSAECONNREFUSED = 10061
+
+func isConnRefusedError(err error) bool {
+	return errors.Is(err, syscall.Errno(WSAECONNREFUSED))
+}
+
+func sctpListen(addr string) (net.Listener, error) {
+	return nil, errSctpUnsupported
+}
+
+func sctpDial(addr string) (net.Conn, error) {
+	return nil, errSctpUnsupported
+}
+
+const sendfileSupported = false
+
+const portExhaustionAdvice = "Consider using \"-cps-ports\", widening the " +
+	"dynamic port range (netsh int ipv4 set dynamicport tcp) or reducing TcpTimedWaitDelay."
@@ -0,0 +1,239 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+//
+// With "-pmtu", the client discovers the path MTU to the host given with "-c",
+// without an Ethr server. It sends probes with the DF bit set, as UDP
+// datagrams to a port nobody is expected to listen on, or with "-p icmp" as
+// ICMP echo requests, and searches for the largest that gets through. A probe
+// got through if the host answers it, with port unreachable for UDP, or with
+// an echo reply. It is too large if the local stack refuses to send it, as
+// larger than the MTU of the interface or the path MTU it already learned, or
+// if a router reports that it needs to be fragmented, which fails the next
+// read with EMSGSIZE. A probe without an answer is retried, and then counted
+// as failed, as path MTU black holes drop large packets silently. Each probe
+// uses a new socket, so that a late answer is not taken for the next one.
+//
+const (
+	pmtuPort    = 33434
+	pmtuTimeout = time.Second
+	pmtuTries   = 2
+	pmtuMax     = 65535
+)
+
+const (
+	pmtuPassed = iota
+	pmtuTooBig
+	pmtuLost
+)
+
+func runPmtuClient(server string, proto EthrProtocol) int {
+	initClient()
+	ip, err := resolvePmtuTarget(server)
+	if err != nil {
+		ui.printErr("Error: %v", err)
+		return 1
+	}
+	ipv6 := ip.To4() == nil
+	// IP header + UDP or ICMP header.
+	hdrLen, minMtu := 20+8, 68
+	if ipv6 {
+		hdrLen, minMtu = 40+8, 1280
+	}
+	maxMtu := pmtuLocalMtu(ip)
+	ui.printMsg("Probing the path MTU to %s with %s, between %d and %d bytes", ip,
+		protoToString(proto), minMtu, maxMtu)
+	seq := 0
+	probe := func(size int) (int, string, error) {
+		for try := 0; try < pmtuTries; try++ {
+			seq++
+			var result int
+			var reason string
+			if proto == Icmp {
+				result, reason, err = probeIcmp(ip, size-hdrLen+8, seq)
+			} else {
+				result, reason, err = probeUdp(ip, size-hdrLen)
+			}
+			if err != nil || result != pmtuLost {
+				return result, reason, err
+			}
+		}
+		return pmtuLost, "no answer within " + pmtuTimeout.String(), nil
+	}
+	result, reason, err := probe(minMtu)
+	if err == nil && result != pmtuPassed {
+		err = fmt.Errorf("the smallest probe, of %d bytes, failed: %s", minMtu, reason)
+		if proto == Udp {
+			err = errors.New(err.Error() + ", the host may not send port unreachable, try \"-p icmp\"")
+		}
+	}
+	if err != nil {
+		ui.printErr("Error probing the path MTU: %v", err)
+		return 1
+	}
+	lo, hi := minMtu, maxMtu+1
+	failReason := "it is larger than the MTU of the local interface"
+	for size := maxMtu; hi-lo > 1; size = lo + (hi-lo)/2 {
+		result, reason, err = probe(size)
+		if err != nil {
+			ui.printErr("Error probing the path MTU: %v", err)
+			return 1
+		}
+		if result == pmtuPassed {
+			ui.printMsg("  %5d bytes: passed", size)
+			lo = size
+		} else {
+			ui.printMsg("  %5d bytes: failed, %s", size, reason)
+			hi, failReason = size, reason
+		}
+	}
+	ui.printMsg("Path MTU to %s is %d bytes, %d bytes of %s payload.", ip, lo, lo-hdrLen,
+		protoToString(proto))
+	if hi <= maxMtu {
+		ui.printMsg("The smallest size that failed is %d bytes: %s.", hi, failReason)
+	} else {
+		ui.printMsg("It is the MTU of the local interface, larger packets can't be sent.")
+	}
+	return 0
+}
+
+func resolvePmtuTarget(server string) (net.IP, error) {
+	if gAddrFamily == family4 || gAddrFamily == family6 {
+		host, err := resolveFamily(server, gAddrFamily)
+		if err != nil {
+			return nil, err
+		}
+		server = host
+	}
+	addr, err := net.ResolveIPAddr("ip", trimBrackets(server))
+	if err != nil {
+		return nil, err
+	}
+	return addr.IP, nil
+}
+
+//
+// It returns the MTU of the local interface the host is routed through, or
+// pmtuMax if it is unknown.
+//
+func pmtuLocalMtu(ip net.IP) int {
+	conn, err := net.DialUDP(protoUDP, nil, &net.UDPAddr{IP: ip, Port: pmtuPort})
+	if err != nil {
+		return pmtuMax
+	}
+	defer conn.Close()
+	mtu := getInterfaceMtu(conn.LocalAddr().(*net.UDPAddr).IP)
+	if mtu == 0 || mtu > pmtuMax {
+		return pmtuMax
+	}
+	return mtu
+}
+
+func probeUdp(ip net.IP, payload int) (int, string, error) {
+	conn, err := net.DialUDP(protoUDP, nil, &net.UDPAddr{IP: ip, Port: pmtuPort})
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	err = setDontFragment(getFd(conn), ip.To4() == nil)
+	if err != nil {
+		return 0, "", fmt.Errorf("unable to set the DF bit: %v", err)
+	}
+	_, err = conn.Write(make([]byte, payload))
+	if err != nil {
+		return pmtuProbeError(err, true)
+	}
+	conn.SetReadDeadline(time.Now().Add(pmtuTimeout))
+	_, err = conn.Read(make([]byte, 1))
+	if err == nil || isPortUnreachableError(err) {
+		return pmtuPassed, "", nil
+	}
+	return pmtuProbeError(err, false)
+}
+
+//
+// Echo requests are sent on a raw socket, which needs administrator rights
+// or CAP_NET_RAW. The kernel computes the checksum of ICMPv6 messages.
+//
+func probeIcmp(ip net.IP, size int, seq int) (int, string, error) {
+	ipv6 := ip.To4() == nil
+	network, reqType, replyType := "ip4:icmp", byte(8), byte(0)
+	if ipv6 {
+		network, reqType, replyType = "ip6:ipv6-icmp", 128, 129
+	}
+	conn, err := net.DialIP(network, nil, &net.IPAddr{IP: ip})
+	if err != nil {
+		return 0, "", err
+	}
+	defer conn.Close()
+	err = setDontFragment(getFd(conn), ipv6)
+	if err != nil {
+		return 0, "", fmt.Errorf("unable to set the DF bit: %v", err)
+	}
+	id := uint16(os.Getpid())
+	msg := make([]byte, size)
+	msg[0] = reqType
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], uint16(seq))
+	if !ipv6 {
+		binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+	}
+	_, err = conn.Write(msg)
+	if err != nil {
+		return pmtuProbeError(err, true)
+	}
+	conn.SetReadDeadline(time.Now().Add(pmtuTimeout))
+	buff := make([]byte, pmtuMax)
+	for {
+		// ReadFrom strips the IPv4 header that raw sockets receive.
+		n, _, err := conn.ReadFrom(buff)
+		if err != nil {
+			return pmtuProbeError(err, false)
+		}
+		if n >= 8 && buff[0] == replyType && binary.BigEndian.Uint16(buff[4:]) == id &&
+			binary.BigEndian.Uint16(buff[6:]) == uint16(seq) {
+			return pmtuPassed, "", nil
+		}
+	}
+}
+
+func icmpChecksum(msg []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(msg); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(msg[i:]))
+	}
+	if len(msg)%2 == 1 {
+		sum += uint32(msg[len(msg)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+func pmtuProbeError(err error, sending bool) (int, string, error) {
+	if isMsgSizeError(err) && sending {
+		return pmtuTooBig, "the local stack refused to send it, as larger than the MTU of the " +
+			"interface or a path MTU it learned before", nil
+	}
+	if isMsgSizeError(err) {
+		return pmtuTooBig, "a router reported that it needs to be fragmented", nil
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return pmtuLost, "", nil
+	}
+	return 0, "", err
+}
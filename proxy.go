@@ -0,0 +1,212 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// With "-behind-proxy", the server runs behind a load balancer or reverse
+// proxy, so the source address of connections is the proxy's. Tests are
+// attributed to clients by their address, so the client's address is taken
+// from the PROXY protocol v2 header the proxy sends at the start of each TCP
+// connection, and from X-Forwarded-For for HTTP requests.
+//
+var gBehindProxy bool
+
+const proxyHeaderTimeout = 5 * time.Second
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyV2Version  = 0x20
+	proxyV2CmdLocal = 0x00
+	proxyV2CmdProxy = 0x01
+	proxyV2Inet     = 0x10
+	proxyV2Inet6    = 0x20
+)
+
+type proxyListener struct {
+	net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type proxyConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+//
+// It returns the connection that a proxyConn, a prefixConn, or a TLS
+// connection, wraps, for socket options.
+//
+func baseConn(conn net.Conn) net.Conn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*prefixConn); ok {
+		conn = pc.Conn
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		return pc.Conn
+	}
+	return conn
+}
+
+func wrapListener(l net.Listener) net.Listener {
+	if !gBehindProxy {
+		return l
+	}
+	pl := &proxyListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		closed:   make(chan struct{}),
+	}
+	go pl.acceptConns()
+	return pl
+}
+
+//
+// Connections are accepted in the background, and the header of each is read
+// in its own goroutine, so that a client that is slow to send it doesn't hold
+// up the others. Accept returns the connections whose header was read, in the
+// order they arrive. Connections without a valid header are closed, and not
+// returned. Errors are passed on to Accept, so that its callers back off as
+// usual, and accepting goes on after temporary ones.
+//
+func (l *proxyListener) acceptConns() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.readHeader(conn)
+	}
+}
+
+func (l *proxyListener) readHeader(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	addr, err := readProxyV2Header(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		ui.printDbg("Invalid PROXY protocol header from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- &proxyConn{conn, addr}:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+func readProxyV2Header(conn net.Conn) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	_, err := io.ReadFull(conn, hdr)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) || hdr[12]&0xf0 != proxyV2Version {
+		return nil, errors.New("not a PROXY protocol v2 header")
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	_, err = io.ReadFull(conn, addrs)
+	if err != nil {
+		return nil, err
+	}
+	switch hdr[12] & 0x0f {
+	case proxyV2CmdLocal:
+		// Connections from the proxy itself, e.g. health checks.
+		return conn.RemoteAddr(), nil
+	case proxyV2CmdProxy:
+	default:
+		return nil, errors.New("unknown PROXY protocol command")
+	}
+	// The source address is first, followed by the destination address and
+	// the source and destination ports.
+	switch hdr[13] & 0xf0 {
+	case proxyV2Inet:
+		if len(addrs) < 12 {
+			return nil, errors.New("short PROXY protocol address")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]),
+			Port: int(binary.BigEndian.Uint16(addrs[8:]))}, nil
+	case proxyV2Inet6:
+		if len(addrs) < 36 {
+			return nil, errors.New("short PROXY protocol address")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]),
+			Port: int(binary.BigEndian.Uint16(addrs[32:]))}, nil
+	}
+	// Unspecified or unix address family, keep the address of the proxy.
+	return conn.RemoteAddr(), nil
+}
+
+//
+// The last address in X-Forwarded-For is the one that the proxy in front of
+// the server received the request from. Earlier ones are set by the client,
+// and can't be trusted.
+//
+func httpClientAddr(r *http.Request) string {
+	server, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !gBehindProxy {
+		return server
+	}
+	xff := r.Header.Get("X-Forwarded-For")
+	if xff == "" {
+		return server
+	}
+	addrs := strings.Split(xff, ",")
+	addr := strings.TrimSpace(addrs[len(addrs)-1])
+	if net.ParseIP(addr) == nil {
+		return server
+	}
+	return addr
+}
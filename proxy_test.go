@@ -0,0 +1,70 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func proxyV2Header(src *net.TCPAddr) []byte {
+	addrs := make([]byte, 12)
+	copy(addrs[0:4], src.IP.To4())
+	copy(addrs[4:8], net.IPv4(127, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(addrs[8:], uint16(src.Port))
+	binary.BigEndian.PutUint16(addrs[10:], 9999)
+	hdr := append([]byte{}, proxyV2Sig...)
+	hdr = append(hdr, proxyV2Version|proxyV2CmdProxy, proxyV2Inet|0x01, 0, byte(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+//
+// A connection that doesn't send its header must not hold up the ones
+// accepted after it.
+//
+func TestProxyListenerSlowHeader(t *testing.T) {
+	initServerTest()
+	gBehindProxy = true
+	defer func() { gBehindProxy = false }()
+	raw, err := net.Listen(protoTCP, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	l := wrapListener(raw)
+	defer l.Close()
+
+	slow, err := net.Dial(protoTCP, l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer slow.Close()
+	fast, err := net.Dial(protoTCP, l.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer fast.Close()
+	src := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 4321}
+	fast.Write(proxyV2Header(src))
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	select {
+	case conn := <-accepted:
+		defer conn.Close()
+		if conn.RemoteAddr().String() != src.String() {
+			t.Fatalf("accepted connection from %v, expected %v", conn.RemoteAddr(), src)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("connection with a header not accepted while another one sends none")
+	}
+}
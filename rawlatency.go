@@ -0,0 +1,98 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// With "-raw-latency", every latency sample is written to a CSV file, for
+// analysis of the distribution offline. Samples are written a batch at a
+// time, after the batch is measured, through a large buffer, so that disk
+// I/O doesn't delay the measurement. The buffer is flushed when a test ends.
+//
+var rawLatencyFile *os.File
+var rawLatencyWriter *bufio.Writer
+var rawLatencyLock sync.Mutex
+
+const rawLatencyBufferSize = 256 * 1024
+
+func rawLatencyInit(fileName string) error {
+	if fileName == "" {
+		return nil
+	}
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, rawLatencyBufferSize)
+	fi, err := f.Stat()
+	if err == nil && fi.Size() == 0 {
+		w.WriteString("time,remote,protocol,rtt_ns\n")
+	}
+	rawLatencyLock.Lock()
+	rawLatencyFile = f
+	rawLatencyWriter = w
+	rawLatencyLock.Unlock()
+	return nil
+}
+
+func rawLatencyFini() {
+	rawLatencyLock.Lock()
+	defer rawLatencyLock.Unlock()
+	if rawLatencyFile == nil {
+		return
+	}
+	rawLatencyWriter.Flush()
+	rawLatencyFile.Close()
+	rawLatencyFile = nil
+	rawLatencyWriter = nil
+}
+
+func rawLatencyFlush() {
+	rawLatencyLock.Lock()
+	defer rawLatencyLock.Unlock()
+	if rawLatencyWriter != nil {
+		rawLatencyWriter.Flush()
+	}
+}
+
+//
+// The samples of a batch are measured back to back, so the time each one
+// ended at is derived from the end of the batch.
+//
+func rawLatencyWrite(test *ethrTest, samples []time.Duration) {
+	rawLatencyLock.Lock()
+	defer rawLatencyLock.Unlock()
+	if rawLatencyWriter == nil {
+		return
+	}
+	ends := make([]time.Time, len(samples))
+	t := time.Now()
+	for i := len(samples) - 1; i >= 0; i-- {
+		ends[i] = t
+		t = t.Add(-samples[i])
+	}
+	remote := test.session.remoteAddr
+	proto := protoToString(test.testParam.TestId.Protocol)
+	var line []byte
+	for i, t := range ends {
+		line = t.UTC().AppendFormat(line[:0], time.RFC3339Nano)
+		line = append(line, ',')
+		line = append(line, remote...)
+		line = append(line, ',')
+		line = append(line, proto...)
+		line = append(line, ',')
+		line = strconv.AppendInt(line, int64(samples[i]), 10)
+		line = append(line, '\n')
+		rawLatencyWriter.Write(line)
+	}
+}
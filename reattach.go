@@ -0,0 +1,148 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+//
+// With "-session <name>" on the client, the test is named, and outlives its
+// control connection, for dashboards that poll by running the client again
+// and again. The client leaves without stopping the test, and the server
+// keeps it, and its results so far, for "-session-linger", waiting for a
+// client to reattach to it with the same name and test type. The data
+// connections of the new client are added to it, and matched by the id of
+// the new client's test, from any address, see matchDataConn. A test that is
+// not reattached in time is ended as if its client stopped it. Only one
+// client can be attached to a name at a time.
+//
+var gSessionName string
+var gSessionLinger = time.Minute
+
+var gNamedTests = make(map[string]*ethrTest)
+
+var errSessionInUse = errors.New("a client is attached to the session")
+
+//
+// It returns the detached test of the given name, now attached to the new
+// control connection, or nil if there is no test of that name.
+//
+func reattachTest(name string, testId EthrTestId, conn net.Conn, enc ethrMsgEncoder, dec ethrMsgDecoder,
+	uuid string) (*ethrTest, error) {
+	gSessionLock.Lock()
+	defer gSessionLock.Unlock()
+	test, found := gNamedTests[name]
+	if !found {
+		return nil, nil
+	}
+	if test.testParam.TestId != testId {
+		return nil, errors.New("the session runs a " + protoToString(test.testParam.TestId.Protocol) +
+			" " + testToString(test.testParam.TestId.Type) + " test")
+	}
+	if !test.detached {
+		return nil, errSessionInUse
+	}
+	test.detached = false
+	test.attachCount++
+	test.ctrlConn = conn
+	test.encLock.Lock()
+	test.enc = enc
+	test.encLock.Unlock()
+	test.dec = dec
+	test.uuid = uuid
+	test.setPaused(false)
+	return test, nil
+}
+
+//
+// It names a new test, unless another test already has the name.
+//
+func nameTest(test *ethrTest, name string) error {
+	gSessionLock.Lock()
+	defer gSessionLock.Unlock()
+	if _, found := gNamedTests[name]; found {
+		return errSessionInUse
+	}
+	gNamedTests[name] = test
+	test.name = name
+	return nil
+}
+
+//
+// It is called with gSessionLock held for write, see deleteTest.
+//
+func unnameTest(test *ethrTest) {
+	if test.name != "" && gNamedTests[test.name] == test {
+		delete(gNamedTests, test.name)
+	}
+	test.name = ""
+}
+
+//
+// The test is detached if it is named, and conn is still its control
+// connection. It is then ended after gSessionLinger, unless a client
+// reattached to it in the meantime.
+//
+func detachTest(test *ethrTest, conn net.Conn) bool {
+	gSessionLock.Lock()
+	if test.name == "" || test.ctrlConn != conn {
+		gSessionLock.Unlock()
+		return false
+	}
+	test.detached = true
+	attachCount := test.attachCount
+	gSessionLock.Unlock()
+	time.AfterFunc(gSessionLinger, func() {
+		if claimDetachedTest(test, attachCount) {
+			endDetachedTest(test, "no client reattached within "+gSessionLinger.String())
+		}
+	})
+	return true
+}
+
+//
+// A negative attachCount claims the test however often it was reattached.
+//
+func claimDetachedTest(test *ethrTest, attachCount int) bool {
+	gSessionLock.Lock()
+	defer gSessionLock.Unlock()
+	if !test.detached || (attachCount >= 0 && test.attachCount != attachCount) {
+		return false
+	}
+	test.detached = false
+	unnameTest(test)
+	return true
+}
+
+func endDetachedTest(test *ethrTest, reason string) {
+	ui.printMsg("Ending " + testToString(test.testParam.TestId.Type) + " test from " +
+		test.remoteWithId() + ", " + reason)
+	test.setActive(false)
+	emitServerTestSummary(test)
+	close(test.done)
+	deleteTest(test)
+	if sessionCount() > 0 {
+		ui.emitTestHdr()
+	}
+}
+
+//
+// A killed test ends rather than waiting for a client to reattach. It returns
+// true if the test was detached, and so was ended here.
+//
+func killNamedTest(test *ethrTest) bool {
+	if claimDetachedTest(test, -1) {
+		endDetachedTest(test, "killed through the admin API")
+		return true
+	}
+	gSessionLock.Lock()
+	unnameTest(test)
+	gSessionLock.Unlock()
+	return false
+}
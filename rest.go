@@ -0,0 +1,305 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// With "-rest", the HTTP server also serves a REST API to start and stop
+// tests on the server, for automation that drives the traffic by other means
+// than the Ethr client:
+// POST /tests with a JSON test spec starts a test, and returns its id.
+// GET /tests lists the tests started this way, with their results so far.
+// GET /tests/<id> returns the results of a test so far.
+// DELETE /tests/<id> stops the test, and returns its final results.
+// Tests are created and deleted as for the control channel, so the data
+// handlers accept traffic from the given remote address while the test runs.
+// With "-token", requests must send the token as "Authorization: Bearer".
+//
+var gRestApi bool
+
+type restTestSpec struct {
+	Remote     string `json:"remote"`
+	Protocol   string `json:"protocol"`
+	Type       string `json:"type"`
+	BufferSize uint32 `json:"buffer_size"`
+	RttCount   uint32 `json:"rtt_count"`
+	Label      string `json:"label"`
+}
+
+type restTestResult struct {
+	Id         string  `json:"id"`
+	Remote     string  `json:"remote"`
+	Protocol   string  `json:"protocol"`
+	Type       string  `json:"type"`
+	Label      string  `json:"label,omitempty"`
+	Active     bool    `json:"active"`
+	Duration   float64 `json:"duration"`
+	Total      uint64  `json:"total"`
+	Unit       string  `json:"unit,omitempty"`
+	AvgPerSec  uint64  `json:"avg_per_second"`
+	LatencyNs  uint64  `json:"latency_ns,omitempty"`
+	BitsPerSec uint64  `json:"bits_per_second,omitempty"`
+}
+
+type restError struct {
+	Error string `json:"error"`
+}
+
+const (
+	restDefaultBufferSize = 16 * 1024
+	restDefaultRttCount   = 1000
+)
+
+var restProtocols = map[string]EthrProtocol{
+	"tcp":  Tcp,
+	"udp":  Udp,
+	"http": Http,
+	"quic": Quic,
+	"grpc": Grpc,
+	"sctp": Sctp,
+}
+
+var restTests = make(map[string]*ethrTest)
+var restTestsLock sync.Mutex
+
+func restAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !isAllowed(host) {
+		writeRestError(w, http.StatusForbidden, "not in the allow list")
+		return false
+	}
+	if !isValidToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		writeRestError(w, http.StatusUnauthorized, "invalid token")
+		return false
+	}
+	return true
+}
+
+func writeRestJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeRestError(w http.ResponseWriter, status int, msg string) {
+	writeRestJson(w, status, restError{msg})
+}
+
+func handleRestTests(w http.ResponseWriter, r *http.Request) {
+	if !restAuthorized(w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		restTestsLock.Lock()
+		results := make([]restTestResult, 0, len(restTests))
+		for _, test := range restTests {
+			results = append(results, getRestTestResult(test))
+		}
+		restTestsLock.Unlock()
+		writeRestJson(w, http.StatusOK, results)
+	case http.MethodPost:
+		startRestTest(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeRestError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func handleRestTest(w http.ResponseWriter, r *http.Request) {
+	if !restAuthorized(w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/tests/")
+	restTestsLock.Lock()
+	test, found := restTests[id]
+	if found && r.Method == http.MethodDelete {
+		delete(restTests, id)
+	}
+	restTestsLock.Unlock()
+	if !found {
+		writeRestError(w, http.StatusNotFound, "no such test")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeRestJson(w, http.StatusOK, getRestTestResult(test))
+	case http.MethodDelete:
+		writeRestJson(w, http.StatusOK, stopRestTest(test, "REST API"))
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeRestError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+//
+// The test must have been removed from restTests already, so that it is only
+// stopped once. It returns the final results.
+//
+func stopRestTest(test *ethrTest, via string) restTestResult {
+	ui.printMsg("Ending " + testToString(test.testParam.TestId.Type) + " test from " +
+		test.remoteWithId() + ", stopped through the " + via)
+	test.setActive(false)
+	emitServerTestSummary(test)
+	result := getRestTestResult(test)
+	close(test.done)
+	deleteTest(test)
+	if sessionCount() > 0 {
+		ui.emitTestHdr()
+	}
+	return result
+}
+
+//
+// It returns false if the test is not a REST test, or was already removed.
+//
+func removeRestTest(test *ethrTest) bool {
+	restTestsLock.Lock()
+	defer restTestsLock.Unlock()
+	if restTests[test.uuid] != test {
+		return false
+	}
+	delete(restTests, test.uuid)
+	return true
+}
+
+func parseRestTestSpec(r *http.Request) (string, EthrTestParam, string) {
+	var spec restTestSpec
+	testParam := EthrTestParam{}
+	err := json.NewDecoder(r.Body).Decode(&spec)
+	if err != nil {
+		return "", testParam, "invalid test spec: " + err.Error()
+	}
+	ip := net.ParseIP(spec.Remote)
+	if ip == nil {
+		return "", testParam, "invalid remote address: " + spec.Remote
+	}
+	proto, ok := restProtocols[strings.ToLower(spec.Protocol)]
+	if !ok {
+		return "", testParam, "invalid protocol: " + spec.Protocol
+	}
+	testType, ok := testTypeNames[strings.ToLower(spec.Type)]
+	if !ok {
+		return "", testParam, "invalid test type: " + spec.Type
+	}
+	testId := EthrTestId{proto, testType}
+	supported := false
+	for _, t := range listenerTestTypes[listenerForTest(testId)] {
+		supported = supported || t == testType
+	}
+	if !supported {
+		return "", testParam, testToString(testType) + " test is not supported for " + protoToString(proto)
+	}
+	if spec.Label != "" && !isValidLabel(spec.Label) {
+		return "", testParam, "invalid label: " + spec.Label
+	}
+	testParam.TestId = testId
+	testParam.NumThreads = 1
+	testParam.BufferSize = spec.BufferSize
+	if testParam.BufferSize == 0 {
+		testParam.BufferSize = restDefaultBufferSize
+	}
+	testParam.RttCount = spec.RttCount
+	if testParam.RttCount == 0 {
+		testParam.RttCount = restDefaultRttCount
+	}
+	testParam.Label = spec.Label
+	err = checkRttCount(testParam)
+	if err != nil {
+		return "", testParam, err.Error()
+	}
+	return ip.String(), testParam, ""
+}
+
+func startRestTest(w http.ResponseWriter, r *http.Request) {
+	server, testParam, msg := parseRestTestSpec(r)
+	if msg != "" {
+		writeRestError(w, http.StatusBadRequest, msg)
+		return
+	}
+	if !gTestTypes[testParam.TestId.Type] || !isListenerEnabled(listenerForTest(testParam.TestId)) {
+		writeRestError(w, http.StatusForbidden, "the test is disabled on the server")
+		return
+	}
+	test, err := newTest(server, nil, testParam, nil, nil)
+	if err != nil {
+		writeRestError(w, http.StatusConflict, "a test of the same type is already running for "+server)
+		return
+	}
+	test.uuid = newTestUuid()
+	if testParam.TestId.Type == Pps {
+		err = runServerPpsTest(test)
+		if err != nil {
+			close(test.done)
+			deleteTest(test)
+			writeRestError(w, http.StatusInternalServerError, "unable to start the test: "+err.Error())
+			return
+		}
+	}
+	ui.printMsg("Starting " + protoToString(testParam.TestId.Protocol) + " " +
+		testToString(testParam.TestId.Type) + " test from " + test.remoteWithId() +
+		", started through the REST API")
+	ui.emitTestHdr()
+	test.startTime = time.Now()
+	test.setActive(true)
+	restTestsLock.Lock()
+	restTests[test.uuid] = test
+	restTestsLock.Unlock()
+	writeRestJson(w, http.StatusCreated, getRestTestResult(test))
+}
+
+//
+// Results so far include the current interval, which the stats timer has not
+// added to the total yet.
+//
+func getRestTestResult(test *ethrTest) restTestResult {
+	testType := test.testParam.TestId.Type
+	gSessionLock.RLock()
+	active := test.isActive
+	gSessionLock.RUnlock()
+	result := restTestResult{
+		Id:       test.uuid,
+		Remote:   test.session.remoteAddr,
+		Protocol: protoToString(test.testParam.TestId.Protocol),
+		Type:     resultLineTestName[testType],
+		Label:    test.testParam.Label,
+		Active:   active,
+	}
+	duration := time.Since(test.startTime)
+	result.Duration = duration.Seconds()
+	result.Total = atomic.LoadUint64(&test.testResult.total)
+	if counter := test.intervalCounter(); counter != nil {
+		result.Total += atomic.LoadUint64(counter)
+	}
+	if duration > 0 {
+		result.AvgPerSec = uint64(float64(result.Total) / duration.Seconds())
+	}
+	switch testType {
+	case Bandwidth, Download, Echo:
+		result.Unit = "bytes"
+		result.BitsPerSec = result.AvgPerSec * 8
+	case Cps, ConnLatency:
+		result.Unit = "connections"
+	case Pps:
+		result.Unit = "packets"
+		result.BitsPerSec = result.AvgPerSec * uint64(test.testParam.BufferSize) * 8
+	case PingPong:
+		result.Unit = "transactions"
+		result.BitsPerSec = result.AvgPerSec * uint64(test.testParam.BufferSize) * 8
+	case Latency:
+		result.LatencyNs = atomic.LoadUint64(&test.testResult.lastLatencyNs)
+	}
+	return result
+}
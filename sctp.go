@@ -0,0 +1,94 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+//
+// The SCTP tests are the TCP bandwidth and latency tests run over one-to-one
+// style SCTP sockets, which behave like TCP streams. The Go standard library
+// has no SCTP support, so the sockets are created with syscalls, see
+// sctpListen and sctpDial, and then handed to the same handlers as TCP.
+//
+var errSctpUnsupported = errors.New("SCTP is not supported on this platform")
+
+//
+// If SCTP isn't available, the listener is disabled, so that SCTP tests are
+// rejected by the control channel instead of waiting for connections.
+//
+func runServerSctpTests() {
+	ok := runServerSctpTest(&sctpBandwidthPort, Bandwidth, runBandwidthHandler)
+	ok = runServerSctpTest(&sctpLatencyPort, Latency, func(conn net.Conn, test *ethrTest) {
+		ui.emitLatencyHdr()
+		runLatencyHandler(conn, test)
+	}) && ok
+	if !ok {
+		gListeners[listenerSctp] = false
+	}
+}
+
+func runServerSctpTest(port *string, testType EthrTestType, handler func(net.Conn, *ethrTest)) bool {
+	name := "SCTP " + testToString(testType)
+	addr := net.JoinHostPort(hostAddr, *port)
+	l, err := sctpListen(addr)
+	if err != nil {
+		ui.printErr("Unable to listen on %s, so %s tests cannot be run: %v", addr, name, err)
+		return false
+	}
+	setBoundPort(port, l.Addr())
+	ui.printMsg("Listening on " + l.Addr().String() + " for " + name + " tests")
+	go func() {
+		defer l.Close()
+		var delay time.Duration
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				ui.printErr("Error accepting new %s connection: %v", name, err)
+				if acceptBackoff(err, &delay) {
+					continue
+				}
+				ui.printErr("Stopping listener for %s tests.", name)
+				return
+			}
+			delay = 0
+			server, rport, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if !isAllowed(server) {
+				ui.printDbg("Rejected %s connection from %s, not in the allow list", name, server)
+				conn.Close()
+				continue
+			}
+			go func(conn net.Conn, server, rport string) {
+				var test *ethrTest
+				if testType == Bandwidth {
+					conn, test = matchDataConn(conn, server, EthrTestId{Sctp, Bandwidth})
+				} else {
+					test = getTest(server, Sctp, testType)
+				}
+				if test == nil {
+					ui.printDbg("Received unsolicited SCTP connection on port %s from %s port %s", *port, server, rport)
+					conn.Close()
+					return
+				}
+				handler(conn, test)
+			}(conn, server, rport)
+		}
+	}()
+	return true
+}
+
+//
+// It dials the data connection of a TCP or SCTP stream test.
+//
+func dialStream(proto EthrProtocol, server, port string) (net.Conn, error) {
+	if proto == Sctp {
+		return sctpDial(joinHostPort(server, port))
+	}
+	return net.Dial(protoTCP, joinHostPort(server, port))
+}
@@ -0,0 +1,180 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+//
+// With "-selftest", the server and the client run in the same process, and
+// the client runs each test type against the server over loopback for a
+// short time, to check that both work. The listeners bind to ephemeral
+// ports, so that a server already running on the machine doesn't get in the
+// way, and only accept connections from loopback. The client addresses the
+// server as "localhost", so that its sessions are apart from the server's,
+// which are keyed by the client's address, e.g. 127.0.0.1.
+//
+const (
+	selfTestServer   = "localhost"
+	selfTestDuration = 2 * time.Second
+	selfTestPause    = time.Second
+)
+
+type selfTestCase struct {
+	name       string
+	testId     EthrTestId
+	bufferSize uint32
+}
+
+var selfTestCases = []selfTestCase{
+	{"TCP bandwidth", EthrTestId{Tcp, Bandwidth}, 16 * 1024},
+	{"TCP conn/s", EthrTestId{Tcp, Cps}, 16 * 1024},
+	{"TCP latency", EthrTestId{Tcp, Latency}, 16 * 1024},
+	{"TCP ping-pong", EthrTestId{Tcp, PingPong}, 1024},
+	{"TCP connection latency", EthrTestId{Tcp, ConnLatency}, 16 * 1024},
+	{"UDP pkt/s", EthrTestId{Udp, Pps}, 1},
+	{"HTTP bandwidth", EthrTestId{Http, Bandwidth}, 16 * 1024},
+	{"HTTP download", EthrTestId{Http, Download}, 16 * 1024},
+	{"HTTP echo", EthrTestId{Http, Echo}, 16 * 1024},
+}
+
+//
+// It returns the exit code, 0 if all tests passed.
+//
+func runSelfTest() int {
+	initClient()
+	err := selfTestPorts()
+	if err != nil {
+		ui.printErr("Unable to find free ports for the self-test: %v", err)
+		return 1
+	}
+	gAllowList, _ = parseAllowList("127.0.0.0/8,::1")
+	gListeners[listenerQuic] = false
+	gListeners[listenerGrpc] = false
+	gListeners[listenerSctp] = false
+	// The summary of latency tests checks that samples were measured.
+	gTDigest = true
+	ui = &selfTestUi{ui.(*clientUi)}
+	l := runControlChannel()
+	runServerListeners()
+	go acceptControlConns(l)
+
+	type selfTestResult struct {
+		name   string
+		passed bool
+	}
+	var results []selfTestResult
+	for i, c := range selfTestCases {
+		if i > 0 {
+			time.Sleep(selfTestPause)
+		}
+		ui.printMsg("Self-test %d of %d: %s.", i+1, len(selfTestCases), c.name)
+		testParam := EthrTestParam{TestId: c.testId, NumThreads: 1, BufferSize: c.bufferSize,
+			RttCount: 1000}
+		err, test := establishSession(testParam, selfTestServer)
+		if err != nil {
+			ui.printErr("Error: %v", err)
+			results = append(results, selfTestResult{c.name, false})
+			continue
+		}
+		gInterval = 0
+		reason := runTest(test, selfTestDuration, nil)
+		deleteTest(test)
+		results = append(results, selfTestResult{c.name, reason == timeout && selfTestPassed(test)})
+		if reason == interrupt {
+			break
+		}
+	}
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	exitCode := 0
+	for _, r := range results {
+		result := "pass"
+		if !r.passed {
+			result = "FAIL"
+			exitCode = 1
+		}
+		ui.printMsg("%-30s %s", r.name, result)
+	}
+	if len(results) < len(selfTestCases) {
+		exitCode = 1
+	}
+	ui.printMsg("- - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
+	outputFini()
+	hdrFini()
+	rawLatencyFini()
+	influxFini()
+	otlpFini()
+	return exitCode
+}
+
+//
+// The server's results are left out, as its sessions are in the same
+// process, and only its messages are shown along with the client's.
+//
+type selfTestUi struct {
+	*clientUi
+}
+
+func (u *selfTestUi) emitTestHdr() {
+}
+
+func (u *selfTestUi) emitTestResult(s *ethrSession, proto EthrProtocol) {
+	if s.remoteAddr == selfTestServer {
+		u.clientUi.emitTestResult(s, proto)
+	}
+}
+
+func (u *selfTestUi) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999,
+	p9999, stddev time.Duration) {
+	if remote == selfTestServer {
+		u.clientUi.emitLatencyResults(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
+	}
+}
+
+//
+// All ports are held open until all are chosen, so that none is chosen
+// twice. The pkt/s port is a UDP port, and shares its number with TCP.
+//
+func selfTestPorts() error {
+	tcpPorts := []*string{&ctrlPort, &tcpBandwidthPort, &tcpCpsPort, &tcpLatencyPort,
+		&tcpPingPongPort, &httpBandwidthPort}
+	for _, port := range tcpPorts {
+		l, err := net.Listen(protoTCP, ":0")
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		_, *port, _ = net.SplitHostPort(l.Addr().String())
+	}
+	pc, err := net.ListenPacket(protoUDP, ":0")
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	_, udpPpsPort, _ = net.SplitHostPort(pc.LocalAddr().String())
+	tcpPpsPort = udpPpsPort
+	return nil
+}
+
+func selfTestPassed(test *ethrTest) bool {
+	switch test.testParam.TestId.Type {
+	case Latency, ConnLatency:
+		n, _, _, _ := test.digest.summary()
+		return n > 0
+	case Echo:
+		if atomic.LoadUint64(&test.testResult.echoTotal) == 0 {
+			return false
+		}
+	}
+	total := atomic.LoadUint64(&test.testResult.total)
+	if counter := test.intervalCounter(); counter != nil {
+		total += atomic.LoadUint64(counter)
+	}
+	return total > 0
+}
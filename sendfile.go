@@ -0,0 +1,97 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+//
+// With "-sendfile", the server sends HTTP downloads from a file rather than
+// from a buffer. Copying a file to the response lets net/http hand it to the
+// TCP connection, which uses sendfile on Linux, so the data is never copied
+// to user space. On other platforms, and for connections that can't use it,
+// e.g. QUIC or behind a proxy, the file is copied as usual.
+//
+var gSendfile bool
+
+const sendfileChunkSize = 4 * 1024 * 1024
+
+var sendfileName string
+
+func sendfileInit() error {
+	if !gSendfile {
+		return nil
+	}
+	f, err := ioutil.TempFile("", "ethr-sendfile-")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buff := make([]byte, 64*1024)
+	for i := range buff {
+		buff[i] = 'x'
+	}
+	for written := 0; written < sendfileChunkSize; written += len(buff) {
+		_, err = f.Write(buff)
+		if err != nil {
+			os.Remove(f.Name())
+			return err
+		}
+	}
+	sendfileName = f.Name()
+	return nil
+}
+
+func sendfileFini() {
+	if sendfileName != "" {
+		os.Remove(sendfileName)
+		sendfileName = ""
+	}
+}
+
+func sendfileEnabled() bool {
+	return sendfileName != ""
+}
+
+//
+// The file is sent over and over, a chunk at a time, so that the bytes sent
+// are counted as the download goes.
+//
+func sendDownloadFromFile(w http.ResponseWriter, test *ethrTest, size uint64) {
+	f, err := os.Open(sendfileName)
+	if err != nil {
+		ui.printErr("Unable to open the file for sendfile: %v", err)
+		return
+	}
+	defer f.Close()
+	for size > 0 {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		_, err = f.Seek(0, io.SeekStart)
+		if err != nil {
+			ui.printDbg("Error seeking the file for sendfile: %v", err)
+			return
+		}
+		chunk := uint64(sendfileChunkSize)
+		if chunk > size {
+			chunk = size
+		}
+		n, err := io.CopyN(w, f, int64(chunk))
+		test.addBandwidthData(uint64(n))
+		if err != nil {
+			ui.printDbg("Error sending HTTP download: %v", err)
+			return
+		}
+		size -= uint64(n)
+	}
+}
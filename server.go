@@ -6,7 +6,10 @@
 package main
 
 import (
-	"encoding/gob"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,136 +17,868 @@ import (
 	"net/http"
 	"os"
 	"runtime"
-	"sort"
+	"strconv"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"time"
+
+	"github.com/quic-go/quic-go/http3"
 )
 
 func runServer(testParam EthrTestParam, showUi bool) {
 	initServer(showUi)
+	emitLocalAddrs()
 	l := runControlChannel()
 	defer l.Close()
-	runServerLatencyTest()
-	runServerCpsTest()
-	runServerBandwidthTest()
-	go runHttpServer()
+	runServerListeners()
+	emitBoundPorts()
+	if gMcastGroup != nil {
+		go runMcastSender()
+	}
 	startStatsTimer()
+	go runListenDropsMonitor()
+	sdNotifyReady()
+	acceptControlConns(l)
+	stopStatsTimer()
+	finiServer()
+	fmt.Println("Fatal error accepting control connections, exiting.")
+	os.Exit(1)
+}
+
+func runServerListeners() {
+	if isListenerEnabled(listenerTcpLatency) {
+		runServerLatencyTest()
+	}
+	if isListenerEnabled(listenerTcpCps) {
+		runServerCpsTest()
+	}
+	if isListenerEnabled(listenerTcpBandwidth) {
+		runServerBandwidthTest()
+	}
+	if isListenerEnabled(listenerTcpPingPong) {
+		runServerPingPongTest()
+	}
+	// Before the other listeners, as it may disable its own listener, see
+	// runServerSctpTests.
+	if isListenerEnabled(listenerSctp) {
+		runServerSctpTests()
+	}
+	if isListenerEnabled(listenerHttp) || isListenerEnabled(listenerQuic) {
+		runHttpServer()
+	}
+	if isListenerEnabled(listenerGrpc) {
+		runGrpcServer()
+	}
+}
+
+//
+// It returns when accepting fails for good, which is fatal for the server.
+//
+func acceptControlConns(l net.Listener) {
+	var delay time.Duration
 	for {
 		conn, err := l.Accept()
 		if err != nil {
 			ui.printErr("Error accepting new control connection: %v", err)
-			continue
+			if acceptBackoff(err, &delay) {
+				continue
+			}
+			break
 		}
+		delay = 0
 		go handleRequest(conn)
 	}
-	stopStatsTimer()
+}
+
+//
+// The address that all listeners bind to, set with "-bind". All interfaces
+// if empty.
+//
+var hostAddr string
+
+//
+// With "-port 0", all listeners are bound to ports chosen by the system, and
+// the ports are listed on one line once all are bound, for scripts that start
+// the server, e.g. "Ports: control=40123 tcp-bandwidth=40125 ...".
+//
+var gEphemeralPorts bool
+
+func setEphemeralPorts() {
+	gEphemeralPorts = true
+	for _, port := range []*string{&ctrlPort, &tcpBandwidthPort, &tcpCpsPort, &tcpLatencyPort,
+		&tcpPingPongPort, &udpPpsPort, &httpBandwidthPort, &quicBandwidthPort, &grpcPort,
+		&sctpBandwidthPort, &sctpLatencyPort} {
+		*port = "0"
+	}
+}
+
+//
+// UDP pkt/s listeners are bound for each test, so their ports are only sent
+// to the clients.
+//
+func emitBoundPorts() {
+	if !gEphemeralPorts {
+		return
+	}
+	ports := []struct {
+		name string
+		port string
+	}{
+		{"control", ctrlPort},
+		{listenerTcpBandwidth, tcpBandwidthPort},
+		{listenerTcpCps, tcpCpsPort},
+		{listenerTcpLatency, tcpLatencyPort},
+		{listenerTcpPingPong, tcpPingPongPort},
+		{listenerHttp, httpBandwidthPort},
+		{listenerQuic, quicBandwidthPort},
+		{listenerGrpc, grpcPort},
+		{"sctp-bandwidth", sctpBandwidthPort},
+		{"sctp-latency", sctpLatencyPort},
+	}
+	var s []string
+	for _, p := range ports {
+		if p.port != "0" {
+			s = append(s, p.name+"="+p.port)
+		}
+	}
+	ui.printMsg("Ports: " + strings.Join(s, " "))
+}
+
+//
+// With "-backlog", the accept queue of a listener is resized after it is
+// created. The net package always uses the system maximum, and ListenConfig
+// can't change it, as its Control function runs before listen(). Calling
+// listen() again on a listening socket updates the backlog on Linux.
+//
+var gListenBacklog int
+
+func applyListenBacklog(l net.Listener, name string) {
+	if gListenBacklog == 0 {
+		return
+	}
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return
+	}
+	rc, err := tl.SyscallConn()
+	if err == nil {
+		var serr error
+		err = rc.Control(func(fd uintptr) {
+			serr = setListenBacklog(fd, gListenBacklog)
+		})
+		if err == nil {
+			err = serr
+		}
+	}
+	if err != nil {
+		ui.printErr("Unable to set the listen backlog for %s tests to %d: %v", name, gListenBacklog, err)
+	}
+}
+
+//
+// When the accept loop can't keep up, e.g. in high rate conn/s tests, the
+// kernel drops new connections silently once the accept queue is full, and
+// the clients see it as a slow network. The count of such drops is checked
+// periodically, so that a warning is shown when the server is saturated. The
+// count is for the whole system, not only for the listeners of Ethr.
+//
+const listenDropsInterval = 5 * time.Second
+
+func runListenDropsMonitor() {
+	last, err := getListenDrops()
+	if err != nil {
+		ui.printDbg("Unable to read the count of dropped connections: %v", err)
+		return
+	}
+	ticker := time.NewTicker(listenDropsInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		drops, err := getListenDrops()
+		if err != nil {
+			continue
+		}
+		if drops > last {
+			ui.printErr("Warning: %d connections were dropped by the kernel in the last %v, as "+
+				"the accept queue was full. Results may be limited by the server, consider "+
+				"increasing it with \"-backlog\".", drops-last, listenDropsInterval)
+		}
+		last = drops
+	}
+}
+
+//
+// It resolves the address given with "-bind", so that a typo is reported
+// before any listener is started. Host names are resolved to their first
+// address, as a listener can only bind to one.
+//
+func resolveBindAddr(addr string) (string, error) {
+	ipAddr, err := net.ResolveIPAddr("ip", addr)
+	if err != nil {
+		return "", err
+	}
+	return ipAddr.String(), nil
+}
+
+//
+// With the default of binding to all interfaces, listeners report a wildcard
+// address, so the local addresses are listed once, for multi-homed hosts.
+//
+func emitLocalAddrs() {
+	if hostAddr != "" {
+		return
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		ui.printDbg("Unable to list local addresses: %v", err)
+		return
+	}
+	var ips []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLinkLocalUnicast() {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	ui.printMsg("Listening on all interfaces, local addresses: " + strings.Join(ips, ", "))
+}
+
+//
+// Data plane listeners can be enabled or disabled with "-enable" and
+// "-disable", so that only the ports for the tests that are needed are open.
+// Tests for disabled listeners are rejected.
+//
+const (
+	listenerTcpBandwidth = "tcp-bandwidth"
+	listenerTcpCps       = "tcp-cps"
+	listenerTcpLatency   = "tcp-latency"
+	listenerTcpPingPong  = "tcp-pingpong"
+	listenerUdpPps       = "udp-pps"
+	listenerHttp         = "http"
+	listenerQuic         = "quic"
+	listenerGrpc         = "grpc"
+	listenerSctp         = "sctp"
+)
+
+var gListeners = map[string]bool{
+	listenerTcpBandwidth: true,
+	listenerTcpCps:       true,
+	listenerTcpLatency:   true,
+	listenerTcpPingPong:  true,
+	listenerUdpPps:       true,
+	listenerHttp:         true,
+	listenerQuic:         true,
+	listenerGrpc:         true,
+	listenerSctp:         true,
+}
+
+//
+// Test types can be enabled or disabled as well, which rejects tests of
+// disabled types, and disables listeners that only serve disabled types.
+//
+var gTestTypes = map[EthrTestType]bool{
+	Bandwidth:   true,
+	Cps:         true,
+	Pps:         true,
+	Latency:     true,
+	Download:    true,
+	PingPong:    true,
+	ConnLatency: true,
+	Echo:        true,
+}
+
+var testTypeNames = map[string]EthrTestType{
+	"bandwidth":   Bandwidth,
+	"cps":         Cps,
+	"pps":         Pps,
+	"latency":     Latency,
+	"download":    Download,
+	"pingpong":    PingPong,
+	"connlatency": ConnLatency,
+	"echo":        Echo,
+}
+
+var listenerTestTypes = map[string][]EthrTestType{
+	listenerTcpBandwidth: {Bandwidth},
+	listenerTcpCps:       {Cps, ConnLatency},
+	listenerTcpLatency:   {Latency},
+	listenerTcpPingPong:  {PingPong},
+	listenerUdpPps:       {Pps},
+	listenerHttp:         {Bandwidth, Download, Echo},
+	listenerQuic:         {Bandwidth, Download},
+	listenerGrpc:         {Bandwidth, Latency},
+	listenerSctp:         {Bandwidth, Latency},
+}
+
+func selectListeners(enable, disable []string) error {
+	for _, name := range append(enable, disable...) {
+		if _, ok := gListeners[name]; ok {
+			continue
+		}
+		if _, ok := testTypeNames[name]; !ok {
+			return errors.New("unknown listener or test type \"" + name + "\"")
+		}
+	}
+	if len(enable) > 0 {
+		for name := range gListeners {
+			gListeners[name] = false
+		}
+		enableTypes := false
+		for _, name := range enable {
+			if _, ok := testTypeNames[name]; ok {
+				enableTypes = true
+			}
+		}
+		if enableTypes {
+			for testType := range gTestTypes {
+				gTestTypes[testType] = false
+			}
+		}
+		for _, name := range enable {
+			testType, ok := testTypeNames[name]
+			if !ok {
+				gListeners[name] = true
+				continue
+			}
+			gTestTypes[testType] = true
+			for listener, testTypes := range listenerTestTypes {
+				for _, t := range testTypes {
+					if t == testType {
+						gListeners[listener] = true
+					}
+				}
+			}
+		}
+	}
+	for _, name := range disable {
+		if testType, ok := testTypeNames[name]; ok {
+			gTestTypes[testType] = false
+		} else {
+			gListeners[name] = false
+		}
+	}
+	for listener, testTypes := range listenerTestTypes {
+		needed := false
+		for _, t := range testTypes {
+			needed = needed || gTestTypes[t]
+		}
+		if !needed {
+			gListeners[listener] = false
+		}
+	}
+	return nil
+}
+
+func isListenerEnabled(name string) bool {
+	return gListeners[name]
+}
+
+func listenerForTest(testId EthrTestId) string {
+	switch testId.Protocol {
+	case Tcp:
+		switch testId.Type {
+		case Bandwidth:
+			return listenerTcpBandwidth
+		case Cps, ConnLatency:
+			return listenerTcpCps
+		case Latency:
+			return listenerTcpLatency
+		case PingPong:
+			return listenerTcpPingPong
+		}
+	case Udp:
+		return listenerUdpPps
+	case Http:
+		return listenerHttp
+	case Quic:
+		return listenerQuic
+	case Grpc:
+		return listenerGrpc
+	case Sctp:
+		return listenerSctp
+	}
+	return ""
+}
+
+func testPort(testId EthrTestId) *string {
+	switch testId.Protocol {
+	case Tcp:
+		switch testId.Type {
+		case Bandwidth:
+			return &tcpBandwidthPort
+		case Cps, ConnLatency:
+			return &tcpCpsPort
+		case Latency:
+			return &tcpLatencyPort
+		case PingPong:
+			return &tcpPingPongPort
+		}
+	case Udp:
+		return &udpPpsPort
+	case Http:
+		return &httpBandwidthPort
+	case Quic:
+		return &quicBandwidthPort
+	case Grpc:
+		return &grpcPort
+	case Sctp:
+		if testId.Type == Latency {
+			return &sctpLatencyPort
+		}
+		return &sctpBandwidthPort
+	}
+	return nil
+}
+
+//
+// UDP pkt/s listeners are bound for each test, so with "-port 0", each test
+// has its own port.
+//
+func dataPort(test *ethrTest) string {
+	if test.udpPort != "" {
+		return test.udpPort
+	}
+	if port := testPort(test.testParam.TestId); port != nil {
+		return *port
+	}
+	return ""
+}
+
+//
+// Latency handlers allocate room for the samples of RttCount round trips,
+// and of the latency window, as requested by the client, so both are capped,
+// with "-max-rtt-count", for clients not to make the server allocate
+// unbounded memory.
+//
+var gMaxRttCount uint32 = 100000
+
+func checkRttCount(testParam EthrTestParam) error {
+	if testParam.TestId.Type != Latency {
+		return nil
+	}
+	if testParam.RttCount == 0 {
+		return errors.New("the RTT count must not be 0")
+	}
+	if testParam.RttCount > gMaxRttCount || testParam.LatencyWindow > gMaxRttCount {
+		return fmt.Errorf("the RTT count and the latency window can be at most %d", gMaxRttCount)
+	}
+	return nil
+}
+
+//
+// With "-allow", only clients whose address is in one of the allowed ranges
+// can run tests. Connections from other addresses are closed right away.
+//
+func isAllowed(server string) bool {
+	if len(gAllowList) == 0 {
+		return true
+	}
+	ip := net.ParseIP(server)
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range gAllowList {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// With "-token", only clients that send the same token in the Syn can run
+// tests. The comparison takes constant time, to not leak the token.
+//
+func isValidToken(token string) bool {
+	if gToken == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(gToken)) == 1
+}
+
+//
+// Accept errors that are temporary, e.g. running out of file descriptors, are
+// retried with exponential backoff instead of spinning. Returns false if the
+// error is fatal and the listener should be shut down.
+//
+func acceptBackoff(err error, delay *time.Duration) bool {
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Temporary() {
+		return false
+	}
+	if *delay == 0 {
+		*delay = 5 * time.Millisecond
+	} else {
+		*delay *= 2
+	}
+	if max := time.Second; *delay > max {
+		*delay = max
+	}
+	time.Sleep(*delay)
+	return true
 }
 
 func initServer(showUi bool) {
 	initServerUi(showUi)
+	err := syslogInit(gSyslogAddr)
+	if err != nil {
+		ui.printErr("Unable to connect to syslog server %s, results are not sent to it: %v",
+			gSyslogAddr, err)
+	}
+	err = sendfileInit()
+	if err != nil {
+		ui.printErr("Unable to create the file for sendfile, sending downloads from memory: %v", err)
+	}
 }
 
 func finiServer() {
+	sdNotifyStopping()
 	ui.fini()
 	logFini()
+	outputFini()
+	hdrFini()
+	rawLatencyFini()
+	influxFini()
+	otlpFini()
+	syslogFini()
+	sendfileFini()
 }
 
+//
+// The control port may be briefly unavailable, e.g. right after restarting
+// the server, so listening is retried a few times before giving up.
+//
+const (
+	ctrlListenRetries    = 5
+	ctrlListenRetryDelay = 200 * time.Millisecond
+)
+
 func runControlChannel() net.Listener {
-	l, err := net.Listen(protoTCP, hostAddr+":"+ctrlPort)
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = setListenReuseAddr(fd)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	delay := ctrlListenRetryDelay
+	l, err := lc.Listen(context.Background(), protoTCP, net.JoinHostPort(hostAddr, ctrlPort))
+	for i := 1; err != nil && i <= ctrlListenRetries; i++ {
+		ui.printErr("Error listening for control connections: %v. Retrying in %v (%d of %d).",
+			err, delay, i, ctrlListenRetries)
+		time.Sleep(delay)
+		delay *= 2
+		l, err = lc.Listen(context.Background(), protoTCP, net.JoinHostPort(hostAddr, ctrlPort))
+	}
 	if err != nil {
 		finiServer()
 		fmt.Printf("Fatal error listening for control connections: %v", err)
 		os.Exit(1)
 	}
-	ui.printMsg("Listening on " + ctrlPort + " for control plane")
-	return l
+	setBoundPort(&ctrlPort, l.Addr())
+	ui.printMsg("Listening on " + l.Addr().String() + " for control plane")
+	return wrapListener(l)
 }
 
+//
+// Clients send the Syn as soon as they connect, so connections that send
+// nothing, e.g. from port scanners, are closed after a while rather than
+// held forever. Connections that send anything but a valid Syn are closed
+// right away, without a message, as they are not from Ethr clients.
+//
+const ctrlSynTimeout = 10 * time.Second
+
+//
+// Clients send their Ack as soon as they started the test on their side, so
+// a client that goes away after the Syn without closing the connection, e.g.
+// as its host went down, would otherwise leave the test half-started until
+// keepalives fail. With "-ack-timeout", the test is cleaned up if the Ack
+// doesn't arrive in time, 0 waits for as long as the connection is up.
+//
+var gAckTimeout = 10 * time.Second
+
 func handleRequest(conn net.Conn) {
 	defer conn.Close()
-	dec := gob.NewDecoder(conn)
-	enc := gob.NewEncoder(conn)
-	ethrMsg := recvSessionMsg(dec)
-	if ethrMsg.Type != EthrSyn {
+	err := setKeepAlive(conn, gCtrlKeepAlive)
+	if err != nil {
+		ui.printDbg("Unable to set keepalive on control connection: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(ctrlSynTimeout))
+	enc, dec, err := acceptCtrlCodec(conn)
+	var ethrMsg *EthrMsg
+	if err == nil {
+		ethrMsg, err = recvSessionMsg(dec)
+	}
+	if err != nil || ethrMsg.Type != EthrSyn {
+		ui.printDbg("Closing control connection from %s, no valid Syn received", conn.RemoteAddr())
 		return
 	}
+	conn.SetReadDeadline(time.Time{})
 	testParam := ethrMsg.Syn.TestParam
+	testUuid := ethrMsg.Syn.TestUuid
 	server, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	ethrUnused(port)
 	lserver, lport, _ := net.SplitHostPort(conn.LocalAddr().String())
 	ethrUnused(lserver, lport)
-	ui.printMsg("New control connection from " + server + ", port " + port)
-	ui.printMsg("Starting " + protoToString(testParam.TestId.Protocol) + " " +
-		testToString(testParam.TestId.Type) + " test from " + server)
-	test, err := newTest(server, conn, testParam, enc, dec)
+	ui.printMsg("New control connection from " + server + ", port " + port +
+		" (" + addrFamily(conn.RemoteAddr()) + ")")
+	from := server + testIdSuffix(testUuid, testParam.Label)
+	if !isAllowed(server) {
+		msg := "Rejected test from " + from + ", not in the allow list"
+		ui.printMsg(msg)
+		sendSessionMsg(enc, createFinMsg(msg))
+		return
+	}
+	if !isValidToken(ethrMsg.Syn.Token) {
+		msg := "Rejected test from " + from + ", invalid token"
+		ui.printMsg(msg)
+		sendSessionMsg(enc, createFinMsg(msg))
+		return
+	}
+	if !gTestTypes[testParam.TestId.Type] {
+		msg := "Rejected " + protoToString(testParam.TestId.Protocol) + " " +
+			testToString(testParam.TestId.Type) + " test from " + from +
+			", " + testToString(testParam.TestId.Type) + " tests are disabled on the server"
+		ui.printMsg(msg)
+		sendSessionMsg(enc, createFinMsg(msg))
+		return
+	}
+	if !isListenerEnabled(listenerForTest(testParam.TestId)) {
+		msg := "Rejected " + protoToString(testParam.TestId.Protocol) + " " +
+			testToString(testParam.TestId.Type) + " test from " + from +
+			", the test is disabled on the server"
+		ui.printMsg(msg)
+		sendSessionMsg(enc, createFinMsg(msg))
+		return
+	}
+	err = checkRttCount(testParam)
 	if err != nil {
-		msg := "Rejected duplicate " + protoToString(testParam.TestId.Protocol) + " " +
-			testToString(testParam.TestId.Type) + " test from " + server
+		msg := "Rejected " + protoToString(testParam.TestId.Protocol) + " " +
+			testToString(testParam.TestId.Type) + " test from " + from + ", " + err.Error()
 		ui.printMsg(msg)
-		ethrMsg = createFinMsg(msg)
-		sendSessionMsg(enc, ethrMsg)
+		sendSessionMsg(enc, createFinMsg(msg))
 		return
 	}
+	name := ethrMsg.Syn.Session
+	var test *ethrTest
+	if name != "" {
+		test, err = reattachTest(name, testParam.TestId, conn, enc, dec, testUuid)
+		if err != nil {
+			msg := "Rejected " + protoToString(testParam.TestId.Protocol) + " " +
+				testToString(testParam.TestId.Type) + " test from " + from + " for session " + name +
+				", " + err.Error()
+			ui.printMsg(msg)
+			sendSessionMsg(enc, createFinMsg(msg))
+			return
+		}
+	}
+	reattached := test != nil
+	if reattached {
+		ui.printMsg("Reattaching " + protoToString(testParam.TestId.Protocol) + " " +
+			testToString(testParam.TestId.Type) + " test from " + from + " to session " + name)
+	} else {
+		ui.printMsg("Starting " + protoToString(testParam.TestId.Protocol) + " " +
+			testToString(testParam.TestId.Type) + " test from " + from)
+		test, err = newTest(server, conn, testParam, enc, dec)
+		if err != nil {
+			msg := rejectedDuplicateMsg + " " + protoToString(testParam.TestId.Protocol) + " " +
+				testToString(testParam.TestId.Type) + " test from " + from
+			ui.printMsg(msg)
+			ethrMsg = createFinMsg(msg)
+			sendSessionMsg(enc, ethrMsg)
+			return
+		}
+		test.uuid = testUuid
+		initSrcPorts(test)
+	}
 	cleanupFunc := func() {
 		test.ctrlConn.Close()
 		close(test.done)
 		deleteTest(test)
 	}
+	if name != "" && !reattached {
+		err = nameTest(test, name)
+		if err != nil {
+			msg := "Rejected " + protoToString(testParam.TestId.Protocol) + " " +
+				testToString(testParam.TestId.Type) + " test from " + from + " for session " + name +
+				", " + err.Error()
+			ui.printMsg(msg)
+			sendSessionMsg(enc, createFinMsg(msg))
+			cleanupFunc()
+			return
+		}
+	}
 	ui.emitTestHdr()
-	if test.testParam.TestId.Type == Pps {
+	if test.testParam.TestId.Type == Pps && !reattached {
 		err = runServerPpsTest(test)
 		if err != nil {
 			cleanupFunc()
 			return
 		}
 	}
-	ethrMsg = createAckMsg()
+	ethrMsg = createAckMsg(dataPort(test))
+	ethrMsg.Ack.DataToken = true
+	ethrMsg.Ack.ConnCounts = true
 	err = sendSessionMsg(enc, ethrMsg)
 	if err != nil {
 		cleanupFunc()
 		return
 	}
-	ethrMsg = recvSessionMsg(dec)
-	if ethrMsg.Type != EthrAck {
+	if gAckTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(gAckTimeout))
+	}
+	ethrMsg, err = recvSessionMsg(dec)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || ethrMsg.Type != EthrAck {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			ui.printMsg("Abandoning " + testToString(testParam.TestId.Type) + " test from " + from +
+				", no Ack received within " + gAckTimeout.String())
+		}
+		// A reattached test waits for the next client, as if this one
+		// never came.
+		if reattached && detachTest(test, conn) {
+			return
+		}
 		cleanupFunc()
 		return
 	}
-	test.isActive = true
-	var b [1]byte
-	_, err = test.ctrlConn.Read(b[0:])
-	ui.printMsg("Ending " + testToString(testParam.TestId.Type) + " test from " + server)
-	test.isActive = false
-	cleanupFunc()
-	if len(gSessionKeys) > 0 {
+	if !reattached {
+		test.startTime = time.Now()
+		test.setActive(true)
+	}
+	dropsStart, dropsErr := getListenDrops()
+	//
+	// The test runs until the control connection is closed, or until the
+	// client asks to stop it via EthrStop. In between, the client can pause
+	// and resume it. A message that fails to decode ends the test, like a
+	// closed connection.
+	//
+	ethrMsg, _ = recvSessionMsg(dec)
+	for {
+		if ethrMsg.Type == EthrStop && ethrMsg.Stop.TestId != testParam.TestId {
+			ui.printDbg("Ignoring stop message for unknown test from %s", server)
+		} else if ethrMsg.Type == EthrPause || ethrMsg.Type == EthrResume {
+			paused := ethrMsg.Type == EthrPause
+			test.setPaused(paused)
+			if paused {
+				ui.printMsg("Pausing " + testToString(testParam.TestId.Type) + " test from " + from)
+			} else {
+				ui.printMsg("Resuming " + testToString(testParam.TestId.Type) + " test from " + from)
+			}
+		} else {
+			break
+		}
+		ethrMsg, _ = recvSessionMsg(dec)
+	}
+	if ethrMsg.Type != EthrStop && detachTest(test, conn) {
+		ui.printMsg("Detaching " + testToString(testParam.TestId.Type) + " test from " + from +
+			", keeping session " + name + " for " + gSessionLinger.String() + " for a client to reattach")
+		return
+	}
+	ui.printMsg("Ending " + testToString(testParam.TestId.Type) + " test from " + from)
+	if testParam.TestId.Type == Bandwidth {
+		drainBandwidthTest(test)
+	}
+	test.setActive(false)
+	emitServerTestSummary(test)
+	if ethrMsg.Type == EthrStop {
+		if testParam.TestId.Type == Cps {
+			sendSessionMsg(enc, createConnCountsMsg(test, dropsStart, dropsErr))
+		}
+		// Stop only the test, the control connection is kept until the
+		// client closes it.
+		close(test.done)
+		deleteTest(test)
+		for ethrMsg.Type != EthrInv {
+			ethrMsg, _ = recvSessionMsg(dec)
+		}
+	} else {
+		cleanupFunc()
+	}
+	if sessionCount() > 0 {
 		ui.emitTestHdr()
 	}
 	return
 }
 
+func emitServerTestSummary(test *ethrTest) {
+	emitSrcPortSummary(test)
+	switch test.testParam.TestId.Type {
+	case Bandwidth:
+		emitBandwidthSummary(test)
+		emitWarmupSummary(test)
+		emitVerifySummary(test)
+	case Download:
+		emitBandwidthSummary(test)
+		emitWarmupSummary(test)
+	case Echo:
+		emitEchoSummary(test)
+		emitWarmupSummary(test)
+	case Latency:
+		emitLatencySummary(test)
+		emitOneWayDelaySummary(test)
+		emitDiscardedSummary(test)
+		rawLatencyFlush()
+	case Pps:
+		emitUdpSizeSummary(test)
+	}
+	if gResultLine {
+		emitResultLine(test)
+	}
+}
+
 func runServerBandwidthTest() {
-	l, err := net.Listen(protoTCP, hostAddr+":"+tcpBandwidthPort)
+	l, err := net.Listen(protoTCP, net.JoinHostPort(hostAddr, tcpBandwidthPort))
 	if err != nil {
 		finiServer()
 		fmt.Printf("Fatal error listening on "+tcpLatencyPort+" for TCP bandwidth tests: %v", err)
 		os.Exit(1)
 	}
-	ui.printMsg("Listening on " + tcpBandwidthPort + " for TCP bandwidth tests")
+	applyListenBacklog(l, "TCP bandwidth")
+	l = wrapListener(l)
+	setBoundPort(&tcpBandwidthPort, l.Addr())
+	ui.printMsg("Listening on " + l.Addr().String() + " for TCP bandwidth tests")
 	go func(l net.Listener) {
 		defer l.Close()
+		var delay time.Duration
 		for {
 			conn, err := l.Accept()
 			if err != nil {
 				ui.printErr("Error accepting new bandwidth connection: %v", err)
-				continue
+				if acceptBackoff(err, &delay) {
+					continue
+				}
+				ui.printErr("Stopping listener for TCP bandwidth tests.")
+				return
 			}
+			delay = 0
 			server, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
-			test := getTest(server, Tcp, Bandwidth)
-			if test == nil {
-				ui.printDbg("Received unsolicited TCP connection on port %s from %s port %s", tcpBandwidthPort, server, port)
+			if !isAllowed(server) {
+				ui.printDbg("Rejected TCP bandwidth connection from %s, not in the allow list", server)
 				conn.Close()
 				continue
 			}
-			go runBandwidthHandler(conn, test)
+			// The token is read off the accept loop, so that a slow
+			// client doesn't hold up others.
+			go func(conn net.Conn, server, port string) {
+				conn, test := matchDataConn(conn, server, EthrTestId{Tcp, Bandwidth})
+				if test == nil {
+					ui.printDbg("Received unsolicited TCP connection on port %s from %s port %s", tcpBandwidthPort, server, port)
+					conn.Close()
+					return
+				}
+				tconn, err := tlsServerConn(conn, test)
+				if err != nil {
+					ui.printErr("Unable to set up TLS for TCP bandwidth test: %v", err)
+					conn.Close()
+					return
+				}
+				runBandwidthHandler(tconn, test)
+			}(conn, server, port)
 		}
 	}(l)
 }
@@ -156,42 +891,202 @@ func closeConn(conn net.Conn) {
 	}
 }
 
+//
+// Number of data plane handler goroutines currently running. This is purely a
+// debugging aid to make goroutine and connection leaks visible.
+//
+var gActiveHandlers int64
+
+func handlerEnter() {
+	atomic.AddInt64(&gActiveHandlers, 1)
+}
+
+func handlerExit() {
+	atomic.AddInt64(&gActiveHandlers, -1)
+}
+
+func emitHandlerGauge() {
+	if !logDebug {
+		return
+	}
+	ui.printDbg("Active handler goroutines: %d", atomic.LoadInt64(&gActiveHandlers))
+}
+
+const maxTransientErrors = 10
+
+func isTransientError(err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false
+	}
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Temporary()
+}
+
 func runBandwidthHandler(conn net.Conn, test *ethrTest) {
+	handlerEnter()
+	defer handlerExit()
+	test.addSrcPort(conn.RemoteAddr())
 	defer closeConn(conn)
-	size := test.testParam.BufferSize
-	bytes := make([]byte, size)
+	err := setKeepAlive(conn, gDataKeepAlive)
+	if err != nil {
+		ui.printDbg("Unable to set keepalive on bandwidth connection: %v", err)
+	}
+	bytes := make([]byte, test.testParam.BufferSize)
+	var pattern []byte
+	offset := 0
+	if test.testParam.Verify {
+		pattern = newVerifyPattern(len(bytes))
+	}
+	errCount := 0
 ExitForLoop:
 	for {
 		select {
 		case <-test.done:
 			break ExitForLoop
 		default:
-			_, err := io.ReadFull(conn, bytes)
+			// Stop reading while paused, so TCP flow control stops the
+			// client from sending as well.
+			if test.isPaused() {
+				time.Sleep(pausePollInterval)
+				continue
+			}
+			//
+			// Count the bytes actually read, rather than whole buffers, so
+			// short reads, e.g. the last one of a connection, are included
+			// and the total matches the bytes transferred.
+			//
+			n, err := conn.Read(bytes)
+			if pattern != nil && n > 0 {
+				test.verifyPayload(bytes[:n], pattern, offset)
+				offset = (offset + n) % len(bytes)
+			}
+			if n > 0 && !test.addBandwidthData(uint64(n)) {
+				break ExitForLoop
+			}
 			if err != nil {
 				ui.printDbg("Error receiving data on a connection for bandwidth test: %v", err)
-				continue
+				//
+				// Retry transient errors with a small backoff, but give up if
+				// they persist, so a broken connection doesn't spin the CPU.
+				//
+				if isTransientError(err) && errCount < maxTransientErrors {
+					errCount++
+					time.Sleep(time.Duration(errCount) * 10 * time.Millisecond)
+					continue
+				}
+				break ExitForLoop
 			}
-			atomic.AddUint64(&test.testResult.data, uint64(size))
+			errCount = 0
 		}
 	}
 }
 
+const pausePollInterval = 10 * time.Millisecond
+
+//
+// When a bandwidth test ends, data that the client sent just before may
+// still be in flight, or in the socket buffers. The handlers keep reading
+// until the test is done, so with "-drain", the end of the test waits for up
+// to the given time, until no more data arrives, before the results are
+// frozen, so that the totals include it.
+//
+var gDrain = 200 * time.Millisecond
+
+const drainPollInterval = 10 * time.Millisecond
+
+func drainBandwidthTest(test *ethrTest) {
+	counter := test.intervalCounter()
+	if gDrain == 0 || counter == nil {
+		return
+	}
+	deadline := time.Now().Add(gDrain)
+	last := atomic.LoadUint64(counter)
+	for time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+		n := atomic.LoadUint64(counter)
+		if n == last {
+			return
+		}
+		last = n
+	}
+}
+
+//
+// Received data counts towards the byte limit of the test if there is one,
+// otherwise towards the warmup or the bandwidth.
+//
+func (test *ethrTest) addBandwidthData(size uint64) bool {
+	if test.testParam.TotalBytes > 0 {
+		return test.addToTotal(size)
+	}
+	if test.inWarmup() {
+		atomic.AddUint64(&test.testResult.warmupData, size)
+		return true
+	}
+	atomic.AddUint64(&test.testResult.bytes, size)
+	return true
+}
+
+//
+// With "-bytes", the bandwidth test stops once the given number of bytes has
+// been received over all streams. Streams reserve their share of the total
+// atomically, so the last buffer is only counted up to the limit, and the
+// stream that reaches the limit ends the test by closing the control
+// connection, and reports the time taken from the start of the test. It
+// returns false once no more data should be received.
+//
+func (test *ethrTest) addToTotal(size uint64) bool {
+	limit := test.testParam.TotalBytes
+	total := atomic.AddUint64(&test.testResult.totalData, size)
+	prev := total - size
+	if prev >= limit {
+		return false
+	}
+	if total < limit {
+		atomic.AddUint64(&test.testResult.bytes, size)
+		return true
+	}
+	atomic.AddUint64(&test.testResult.bytes, limit-prev)
+	elapsed := time.Since(test.startTime)
+	ui.printMsg("%s Bandwidth test from %s received %sBytes in %s (%s), stopping test",
+		protoToString(test.testParam.TestId.Protocol), test.remoteWithId(),
+		numberToUnit(limit), durationToString(elapsed),
+		bytesToRate(uint64(float64(limit)/elapsed.Seconds())))
+	test.ctrlConn.Close()
+	return false
+}
+
 func runServerCpsTest() {
-	l, err := net.Listen(protoTCP, hostAddr+":"+tcpCpsPort)
+	l, err := net.Listen(protoTCP, net.JoinHostPort(hostAddr, tcpCpsPort))
 	if err != nil {
 		finiServer()
 		fmt.Printf("Fatal error listening on "+tcpLatencyPort+" for TCP conn/s tests: %v", err)
 		os.Exit(1)
 	}
-	ui.printMsg("Listening on " + tcpCpsPort + " for TCP conn/s tests")
+	applyListenBacklog(l, "TCP conn/s")
+	l = wrapListener(l)
+	setBoundPort(&tcpCpsPort, l.Addr())
+	ui.printMsg("Listening on " + l.Addr().String() + " for TCP conn/s tests")
 	go func(l net.Listener) {
 		defer l.Close()
+		var delay time.Duration
 		for {
 			conn, err := l.Accept()
 			if err != nil {
 				// This can happen a lot during load, hence don't log by
 				// default.
 				ui.printDbg("Error accepting new conn/s connection: %v", err)
+				if acceptBackoff(err, &delay) {
+					continue
+				}
+				ui.printErr("Stopping listener for TCP conn/s tests: %v", err)
+				return
+			}
+			delay = 0
+			server, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if !isAllowed(server) {
+				ui.printDbg("Rejected TCP conn/s connection from %s, not in the allow list", server)
+				conn.Close()
 				continue
 			}
 			go runCPSHandler(conn)
@@ -199,17 +1094,42 @@ func runServerCpsTest() {
 	}(l)
 }
 
+//
+// By default, the client resets the connection right after connecting, and
+// it is closed here as soon as it is accepted. With "-cps-close", the client
+// waits for the server to close it instead, so it is closed gracefully here,
+// which sends a FIN, without a linger timeout that would reset it.
+//
 func runCPSHandler(conn net.Conn) {
-	defer conn.Close()
+	handlerEnter()
+	defer handlerExit()
 	server, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 	test := getTest(server, Tcp, Cps)
-	if test != nil {
-		atomic.AddUint64(&test.testResult.data, 1)
+	if test == nil {
+		// Connection latency tests share the listener, see runConnLatencyTest.
+		test = getTest(server, Tcp, ConnLatency)
+	}
+	if test == nil {
+		conn.Close()
+		return
+	}
+	atomic.AddUint64(&test.testResult.connections, 1)
+	test.addSrcPort(conn.RemoteAddr())
+	if !test.testParam.CpsCloseWait && test.testParam.TestId.Type != ConnLatency {
+		conn.Close()
+		return
+	}
+	if tcpconn, ok := baseConn(conn).(*net.TCPConn); ok {
+		tcpconn.SetLinger(-1)
+	}
+	err := conn.Close()
+	if err != nil {
+		ui.printDbg("Error closing conn/s connection: %v", err)
 	}
 }
 
 func runServerPpsTest(test *ethrTest) error {
-	udpAddr, err := net.ResolveUDPAddr(protoUDP, hostAddr+":"+udpPpsPort)
+	udpAddr, err := net.ResolveUDPAddr(protoUDP, net.JoinHostPort(hostAddr, udpPpsPort))
 	if err != nil {
 		ui.printDbg("Unable to resolve UDP address: %v", err)
 		return err
@@ -219,16 +1139,20 @@ func runServerPpsTest(test *ethrTest) error {
 		ui.printDbg("Error listening on %s for UDP pkt/s tests: %v", udpPpsPort, err)
 		return err
 	}
+	ui.printDbg("Listening on %s for UDP pkt/s test", l.LocalAddr())
+	setBoundPort(&test.udpPort, l.LocalAddr())
+	test.udpSizes = make([]uint64, len(udpSizeBuckets))
+	test.handlerPps = make([]uint64, runtime.NumCPU())
 	go func(l *net.UDPConn) {
 		defer l.Close()
 		for i := 0; i < runtime.NumCPU(); i++ {
-			go runPPSHandler(test, l)
+			go runPPSHandler(test, l, i)
 		}
 		<-test.done
 	}(l)
 	return nil
 	/*
-			ludpAddr, err := net.ResolveUDPAddr(protoUDP, hostAddr+":"+udpPpsPort)
+			ludpAddr, err := net.ResolveUDPAddr(protoUDP, net.JoinHostPort(hostAddr, udpPpsPort))
 			if err != nil {
 				ui.printErr("%v", err)
 				os.Exit(1)
@@ -258,20 +1182,44 @@ func runServerPpsTest(test *ethrTest) error {
 	*/
 }
 
-func runPPSHandler(test *ethrTest, conn *net.UDPConn) {
-	buffer := make([]byte, 1)
-	n, remoteAddr, err := 0, new(net.UDPAddr), error(nil)
+func runPPSHandler(test *ethrTest, conn *net.UDPConn, cpu int) {
+	handlerEnter()
+	defer handlerExit()
+	if gPpsAffinity {
+		// The thread is intentionally left locked, see runLatencyHandler.
+		runtime.LockOSThread()
+		err := setThreadAffinity(cpu)
+		if err != nil {
+			ui.printErr("Unable to set CPU affinity for pkt/s test: %v", err)
+		}
+	}
+	//
+	// Receive into a buffer that fits any UDP packet, rather than one of the
+	// test's buffer size, so packets larger than expected, e.g. the ones
+	// used for probing the path MTU, aren't truncated.
+	//
+	buffer := make([]byte, maxUdpPayload)
+	n, flags, remoteAddr, err := 0, 0, new(net.UDPAddr), error(nil)
 	for err == nil {
-		n, remoteAddr, err = conn.ReadFromUDP(buffer)
+		n, _, flags, remoteAddr, err = conn.ReadMsgUDP(buffer, nil)
+		truncated := flags&msgTrunc != 0
+		if err != nil && isMsgSizeError(err) && remoteAddr != nil {
+			n, truncated, err = len(buffer), true, nil
+		}
 		if err != nil {
 			ui.printDbg("Error receiving data from UDP for pkt/s test: %v", err)
 			continue
 		}
-		ethrUnused(n)
 		server, port, _ := net.SplitHostPort(remoteAddr.String())
 		test := getTest(server, Udp, Pps)
 		if test != nil {
-			atomic.AddUint64(&test.testResult.data, 1)
+			atomic.AddUint64(&test.testResult.packets, 1)
+			test.addHandlerPacket(cpu)
+			test.addUdpSize(n)
+			test.addSrcPort(remoteAddr)
+			if truncated {
+				test.addUdpTruncated(n)
+			}
 		} else {
 			ui.printDbg("Received unsolicited UDP traffic on port %s from %s port %s", udpPpsPort, server, port)
 		}
@@ -279,47 +1227,104 @@ func runPPSHandler(test *ethrTest, conn *net.UDPConn) {
 }
 
 func runServerLatencyTest() {
-	l, err := net.Listen(protoTCP, hostAddr+":"+tcpLatencyPort)
+	l, err := net.Listen(protoTCP, net.JoinHostPort(hostAddr, tcpLatencyPort))
 	if err != nil {
 		finiServer()
 		fmt.Printf("Fatal error listening on "+tcpLatencyPort+" for TCP latency tests: %v", err)
 		os.Exit(1)
 	}
-	ui.printMsg("Listening on " + tcpLatencyPort + " for TCP latency tests")
+	l = wrapListener(l)
+	setBoundPort(&tcpLatencyPort, l.Addr())
+	ui.printMsg("Listening on " + l.Addr().String() + " for TCP latency tests")
 	go func(l net.Listener) {
 		defer l.Close()
+		var delay time.Duration
 		for {
 			conn, err := l.Accept()
 			if err != nil {
 				ui.printErr("Error accepting new latency connection: %v", err)
-				continue
+				if acceptBackoff(err, &delay) {
+					continue
+				}
+				ui.printErr("Stopping listener for TCP latency tests.")
+				return
 			}
+			delay = 0
 			server, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if !isAllowed(server) {
+				ui.printDbg("Rejected TCP latency connection from %s, not in the allow list", server)
+				conn.Close()
+				continue
+			}
 			test := getTest(server, Tcp, Latency)
 			if test == nil {
 				conn.Close()
 				continue
 			}
+			tconn, err := tlsServerConn(conn, test)
+			if err != nil {
+				ui.printErr("Unable to set up TLS for TCP latency test: %v", err)
+				conn.Close()
+				continue
+			}
 			ui.emitLatencyHdr()
-			go runLatencyHandler(conn, test)
+			go runLatencyHandler(tconn, test)
 		}
 	}(l)
 }
 
 func runLatencyHandler(conn net.Conn, test *ethrTest) {
+	handlerEnter()
+	defer handlerExit()
+	test.addSrcPort(conn.RemoteAddr())
+	// Keep the latency measurement on its own OS thread, so it isn't
+	// multiplexed with other handlers, e.g. a bandwidth test from the same
+	// client running in parallel to measure latency under load.
+	runtime.LockOSThread()
+	if gCpuAffinity >= 0 {
+		// The thread is intentionally left locked, so that it exits along
+		// with this goroutine instead of going back to the scheduler with
+		// the affinity still applied.
+		err := setThreadAffinity(gCpuAffinity)
+		if err != nil {
+			ui.printErr("Unable to set CPU affinity for latency test: %v", err)
+		}
+	} else {
+		defer runtime.UnlockOSThread()
+	}
 	defer conn.Close()
+	err := setNoDelay(conn, !test.testParam.EnableNagle)
+	if err != nil {
+		ui.printDbg("Unable to set TCP_NODELAY for latency test: %v", err)
+	}
 	bytes := make([]byte, test.testParam.BufferSize)
 	// TODO Override buffer size to 1 for now. Evaluate if we need to allow
 	// client to specify the buffer size in future.
-	bytes = make([]byte, 1)
+	bytes = make([]byte, latencyMsgSize(test.testParam))
 	rttCount := test.testParam.RttCount
-	latencyNumbers := make([]time.Duration, rttCount)
+	latencyNumbers := make([]time.Duration, 0, rttCount)
+	var oneWayNumbers []time.Duration
+	if test.testParam.OneWay {
+		oneWayNumbers = make([]time.Duration, 0, rttCount)
+	}
+	windowSize := test.testParam.LatencyWindow
+	if windowSize == 0 {
+		windowSize = rttCount
+	}
+	window := newLatencyWindow(windowSize)
+	var stability *latencyStability
+	if test.testParam.LatencyStable > 0 {
+		stability = newLatencyStability(test.testParam.LatencyStable)
+	}
 	for {
-		_, err := io.ReadFull(conn, bytes)
+		_, _, err = readLatencyMsg(conn, bytes, 0)
 		if err != nil {
-			ui.printDbg("Error receiving data for latency test: %v", err)
+			logLatencyReadError(test, err)
 			return
 		}
+		batchStart := time.Now()
+		latencyNumbers = latencyNumbers[:0]
+		oneWayNumbers = oneWayNumbers[:0]
 		for i := uint32(0); i < rttCount; i++ {
 			s1 := time.Now()
 			_, err = conn.Write(bytes)
@@ -327,50 +1332,198 @@ func runLatencyHandler(conn net.Conn, test *ethrTest) {
 				ui.printDbg("Error sending data for latency test: %v", err)
 				return
 			}
-			_, err = io.ReadFull(conn, bytes)
+			partial, timedOut, err := readLatencyMsg(conn, bytes, gLatencyTimeout)
 			if err != nil {
-				ui.printDbg("Error receiving data for latency test: %v", err)
+				logLatencyReadError(test, err)
 				return
 			}
-			e2 := time.Since(s1)
-			latencyNumbers[i] = e2
+			if timedOut {
+				atomic.AddUint64(&test.testResult.timeouts, 1)
+				continue
+			}
+			if partial {
+				atomic.AddUint64(&test.testResult.discarded, 1)
+				continue
+			}
+			received := time.Now()
+			if test.testParam.OneWay {
+				oneWayNumbers = append(oneWayNumbers, oneWayDelay(bytes, received))
+			}
+			e2 := received.Sub(s1)
+			latencyNumbers = append(latencyNumbers, e2)
+			window.add(e2)
+		}
+		if len(latencyNumbers) == 0 {
+			continue
 		}
-		sum := int64(0)
-		for _, d := range latencyNumbers {
-			sum += d.Nanoseconds()
+		if test.testParam.OneWay {
+			test.addOneWayDelays(oneWayNumbers)
 		}
-		elapsed := time.Duration(sum / int64(rttCount))
-		sort.SliceStable(latencyNumbers, func(i, j int) bool {
-			return latencyNumbers[i] < latencyNumbers[j]
-		})
-		//
-		// Special handling for rttCount == 1. This prevents negative index
-		// in the latencyNumber index. The other option is to use
-		// roundUpToZero() but that is more expensive.
-		//
-		rttCountFixed := rttCount
-		if rttCountFixed == 1 {
-			rttCountFixed = 2
-		}
-		atomic.SwapUint64(&test.testResult.data, uint64(elapsed.Nanoseconds()))
-		avg := elapsed
-		min := latencyNumbers[0]
-		max := latencyNumbers[rttCount-1]
-		p50 := latencyNumbers[((rttCountFixed*50)/100)-1]
-		p90 := latencyNumbers[((rttCountFixed*90)/100)-1]
-		p95 := latencyNumbers[((rttCountFixed*95)/100)-1]
-		p99 := latencyNumbers[((rttCountFixed*99)/100)-1]
-		p999 := latencyNumbers[uint64(((float64(rttCountFixed)*99.9)/100)-1)]
-		p9999 := latencyNumbers[uint64(((float64(rttCountFixed)*99.99)/100)-1)]
+		test.addLatencySamples(latencyNumbers)
+		avg, min, max, p50, p90, p95, p99, p999, p9999, stddev := calcLatencyResults(window.values())
+		if hdrEnabled() {
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev =
+				hdrRecordLatency(test.session.remoteAddr, batchStart, latencyNumbers, window.values())
+		}
+		atomic.StoreUint64(&test.testResult.lastLatencyNs, uint64(avg.Nanoseconds()))
 		ui.emitLatencyResults(
 			test.session.remoteAddr,
 			protoToString(test.testParam.TestId.Protocol),
-			avg, min, max, p50, p90, p95, p99, p999, p9999)
+			avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
+		if stability != nil {
+			if p99, stable := stability.add(latencyNumbers); stable {
+				endStableLatencyTest(test, stability, p99)
+				stability = nil
+			}
+		}
+	}
+}
+
+//
+// The client closing the connection between messages is the normal end of a
+// test, while closing it in the middle of one means it failed.
+//
+func logLatencyReadError(test *ethrTest, err error) {
+	switch err {
+	case io.EOF:
+		ui.printDbg("Latency connection closed by %s", test.remoteWithId())
+	case io.ErrUnexpectedEOF:
+		ui.printDbg("Latency connection closed by %s in the middle of a message", test.remoteWithId())
+	default:
+		ui.printDbg("Error receiving data for latency test: %v", err)
+	}
+}
+
+//
+// A message may arrive in pieces, e.g. from a slow client. If a piece is
+// followed by a pause of more than latencyPartialTimeout, the rest of the
+// message is still read, so the stream stays in sync, but the sample is
+// reported as partial, to be discarded, as its time includes the stall of the
+// sender. Waiting for the first byte of a message is only limited by the
+// given timeout, "-latency-timeout" for replies, after which the exchange is
+// reported as timed out, and the message is still waited for, as the client
+// only sends the next one after it.
+//
+const latencyPartialTimeout = time.Second
+
+var gLatencyTimeout time.Duration
+
+func readLatencyMsg(conn net.Conn, msg []byte, timeout time.Duration) (partial, timedOut bool, err error) {
+	n, deadline := 0, false
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		deadline = true
+	}
+	for n < len(msg) {
+		if n > 0 {
+			conn.SetReadDeadline(time.Now().Add(latencyPartialTimeout))
+			deadline = true
+		}
+		var m int
+		m, err = conn.Read(msg[n:])
+		n += m
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if n == 0 {
+					timedOut = true
+					conn.SetReadDeadline(time.Time{})
+				} else {
+					partial = true
+				}
+				err = nil
+				continue
+			}
+			if err == io.EOF && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			break
+		}
+	}
+	if deadline {
+		conn.SetReadDeadline(time.Time{})
+	}
+	return
+}
+
+func runServerPingPongTest() {
+	l, err := net.Listen(protoTCP, net.JoinHostPort(hostAddr, tcpPingPongPort))
+	if err != nil {
+		finiServer()
+		fmt.Printf("Fatal error listening on "+tcpPingPongPort+" for TCP ping-pong tests: %v", err)
+		os.Exit(1)
+	}
+	l = wrapListener(l)
+	setBoundPort(&tcpPingPongPort, l.Addr())
+	ui.printMsg("Listening on " + l.Addr().String() + " for TCP ping-pong tests")
+	go func(l net.Listener) {
+		defer l.Close()
+		var delay time.Duration
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				ui.printErr("Error accepting new ping-pong connection: %v", err)
+				if acceptBackoff(err, &delay) {
+					continue
+				}
+				ui.printErr("Stopping listener for TCP ping-pong tests.")
+				return
+			}
+			delay = 0
+			server, port, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			if !isAllowed(server) {
+				ui.printDbg("Rejected TCP ping-pong connection from %s, not in the allow list", server)
+				conn.Close()
+				continue
+			}
+			test := getTest(server, Tcp, PingPong)
+			if test == nil {
+				ui.printDbg("Received unsolicited TCP connection on port %s from %s port %s", tcpPingPongPort, server, port)
+				conn.Close()
+				continue
+			}
+			go runPingPongHandler(conn, test)
+		}
+	}(l)
+}
+
+//
+// In the ping-pong test, the client sends a request of the test's buffer
+// size and waits for it to be echoed before sending the next one. Unlike the
+// latency test, the whole buffer is echoed, so the test measures the
+// transactions/s, and the throughput, that a request-response protocol gets
+// out of a single round trip at a time.
+//
+func runPingPongHandler(conn net.Conn, test *ethrTest) {
+	handlerEnter()
+	defer handlerExit()
+	test.addSrcPort(conn.RemoteAddr())
+	defer closeConn(conn)
+	err := setNoDelay(conn, !test.testParam.EnableNagle)
+	if err != nil {
+		ui.printDbg("Unable to set TCP_NODELAY for ping-pong test: %v", err)
+	}
+	buff := make([]byte, test.testParam.BufferSize)
+	for {
+		_, err = io.ReadFull(conn, buff)
+		if err != nil {
+			ui.printDbg("Error receiving data for ping-pong test: %v", err)
+			return
+		}
+		_, err = conn.Write(buff)
+		if err != nil {
+			ui.printDbg("Error sending data for ping-pong test: %v", err)
+			return
+		}
+		atomic.AddUint64(&test.testResult.transactions, 1)
 	}
 }
 
 func handleHttpRequest(w http.ResponseWriter, r *http.Request) {
-	_, err := ioutil.ReadAll(r.Body)
+	//
+	// Count the bytes read from the body, rather than Content-Length, which
+	// is -1 for chunked requests.
+	//
+	n, err := io.Copy(ioutil.Discard, r.Body)
 	if err != nil {
 		ui.printDbg("Error reading HTTP body: %v", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -387,21 +1540,207 @@ func handleHttpRequest(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Only GET, PUT and POST are supported.", http.StatusMethodNotAllowed)
 		return
 	}
-	server, _, _ := net.SplitHostPort(r.RemoteAddr)
-	test := getTest(server, Http, Bandwidth)
+	// The same handler serves HTTP/1.1 and HTTP/3 (QUIC) requests.
+	proto := Http
+	if r.ProtoMajor == 3 {
+		proto = Quic
+	}
+	server := httpClientAddr(r)
+	test := getTest(server, proto, Bandwidth)
+	if test == nil {
+		http.Error(w, "Unauthorized request.", http.StatusUnauthorized)
+		return
+	}
+	if n > 0 {
+		test.addBandwidthData(uint64(n))
+	}
+}
+
+//
+// The download test is the reverse of the HTTP bandwidth test, the client
+// requests /download?size=<n> and the server sends n bytes, counting them
+// as they are written.
+//
+const maxHttpDownloadSize = 1024 * 1024 * 1024
+
+func handleHttpDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Only GET is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	size, err := strconv.ParseUint(r.URL.Query().Get("size"), 10, 64)
+	if err != nil || size == 0 || size > maxHttpDownloadSize {
+		http.Error(w, "Invalid size.", http.StatusBadRequest)
+		return
+	}
+	proto := Http
+	if r.ProtoMajor == 3 {
+		proto = Quic
+	}
+	server := httpClientAddr(r)
+	test := getTest(server, proto, Download)
+	if test == nil {
+		http.Error(w, "Unauthorized request.", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+	if sendfileEnabled() {
+		sendDownloadFromFile(w, test, size)
+		return
+	}
+	buff := make([]byte, test.testParam.BufferSize)
+	for i := range buff {
+		buff[i] = 'x'
+	}
+	for size > 0 {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		b := buff
+		if uint64(len(b)) > size {
+			b = b[:size]
+		}
+		n, err := w.Write(b)
+		test.addBandwidthData(uint64(n))
+		if err != nil {
+			ui.printDbg("Error sending HTTP download: %v", err)
+			return
+		}
+		size -= uint64(n)
+	}
+}
+
+//
+// The echo test streams the request body in and the same bytes back out, so
+// that the client measures upload and download at once. For HTTP/1.1, the
+// server only lets a handler write before it has read the whole body with
+// full duplex enabled.
+//
+func handleHttpEcho(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" && r.Method != "PUT" {
+		http.Error(w, "Only PUT and POST are supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	proto := Http
+	if r.ProtoMajor == 3 {
+		proto = Quic
+	}
+	server := httpClientAddr(r)
+	test := getTest(server, proto, Echo)
 	if test == nil {
 		http.Error(w, "Unauthorized request.", http.StatusUnauthorized)
 		return
 	}
-	if r.ContentLength > 0 {
-		atomic.AddUint64(&test.testResult.data, uint64(r.ContentLength))
+	rc := http.NewResponseController(w)
+	if r.ProtoMajor == 1 {
+		err := rc.EnableFullDuplex()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	buff := make([]byte, test.testParam.BufferSize)
+	for {
+		select {
+		case <-test.done:
+			return
+		default:
+		}
+		n, err := r.Body.Read(buff)
+		if n > 0 {
+			test.addBandwidthData(uint64(n))
+			n, werr := w.Write(buff[:n])
+			if test.inWarmup() {
+				atomic.AddUint64(&test.testResult.warmupData, uint64(n))
+			} else {
+				atomic.AddUint64(&test.testResult.echoBytes, uint64(n))
+			}
+			if werr == nil {
+				werr = rc.Flush()
+			}
+			if werr != nil {
+				ui.printDbg("Error sending HTTP echo: %v", werr)
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				ui.printDbg("Error reading HTTP echo: %v", err)
+			}
+			return
+		}
 	}
 }
 
+func handleStatusRequest(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "handlers: %d\n", atomic.LoadInt64(&gActiveHandlers))
+}
+
+//
+// Like the other listeners, the HTTP and QUIC listeners are bound before
+// returning, so that their ports are known when tests start, and served in
+// the background.
+//
 func runHttpServer() {
 	http.HandleFunc("/", handleHttpRequest)
-	err := http.ListenAndServe(":"+httpBandwidthPort, nil)
+	http.HandleFunc("/download", handleHttpDownload)
+	http.HandleFunc("/echo", handleHttpEcho)
+	http.HandleFunc("/status", handleStatusRequest)
+	if gRestApi {
+		http.HandleFunc("/tests", handleRestTests)
+		http.HandleFunc("/tests/", handleRestTest)
+	}
+	if gAdminToken != "" {
+		http.HandleFunc("/admin/tests", handleAdminTests)
+		http.HandleFunc("/admin/kill", handleAdminKill)
+	}
+	if isListenerEnabled(listenerQuic) {
+		runHttp3Server(http.DefaultServeMux)
+	}
+	if !isListenerEnabled(listenerHttp) {
+		return
+	}
+	lc := net.ListenConfig{KeepAlive: dataKeepAlivePeriod()}
+	l, err := lc.Listen(context.Background(), protoTCP, net.JoinHostPort(hostAddr, httpBandwidthPort))
 	if err != nil {
 		ui.printErr("Unable to start HTTP server, so HTTP tests cannot be run: %v", err)
+		return
+	}
+	setBoundPort(&httpBandwidthPort, l.Addr())
+	ui.printMsg("Listening on " + l.Addr().String() + " for HTTP tests")
+	go func() {
+		err := http.Serve(l, nil)
+		ui.printErr("HTTP server stopped, so HTTP tests cannot be run: %v", err)
+	}()
+}
+
+func runHttp3Server(handler http.Handler) {
+	cert, err := generateCertificate()
+	if err != nil {
+		ui.printErr("Unable to generate certificate, so QUIC tests cannot be run: %v", err)
+		return
 	}
+	server := &http3.Server{
+		Handler:   handler,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	conn, err := net.ListenPacket(protoUDP, net.JoinHostPort(hostAddr, quicBandwidthPort))
+	if err != nil {
+		ui.printErr("Unable to start QUIC server, so QUIC tests cannot be run: %v", err)
+		return
+	}
+	setBoundPort(&quicBandwidthPort, conn.LocalAddr())
+	ui.printMsg("Listening on " + conn.LocalAddr().String() + " for QUIC (HTTP/3) bandwidth tests")
+	go func() {
+		err := server.Serve(conn)
+		if err != nil {
+			ui.printErr("QUIC server stopped, so QUIC tests cannot be run: %v", err)
+		}
+	}()
 }
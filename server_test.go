@@ -0,0 +1,327 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var serverTestOnce sync.Once
+
+func initServerTest() {
+	serverTestOnce.Do(func() {
+		initServerUi(false)
+	})
+}
+
+//
+// The conn/s handler runs in a goroutine per accepted connection, so the
+// count must add up when many are accepted at once.
+//
+func TestCpsCountConcurrentAccepts(t *testing.T) {
+	initServerTest()
+	runServerCpsTest()
+	test, err := newTest("127.0.0.1", nil, EthrTestParam{TestId: EthrTestId{Tcp, Cps}}, nil, nil)
+	if err != nil {
+		t.Fatalf("newTest: %v", err)
+	}
+	defer deleteTest(test)
+
+	const threads = 16
+	const connsPerThread = 100
+	var wg sync.WaitGroup
+	var dialErrs uint64
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < connsPerThread; j++ {
+				conn, err := net.Dial(protoTCP, net.JoinHostPort("127.0.0.1", tcpCpsPort))
+				if err != nil {
+					atomic.AddUint64(&dialErrs, 1)
+					continue
+				}
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	opened := uint64(threads*connsPerThread) - atomic.LoadUint64(&dialErrs)
+	if opened == 0 {
+		t.Fatalf("no connections could be opened")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&test.testResult.connections) < opened && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Give late handlers a chance to count a connection twice.
+	time.Sleep(100 * time.Millisecond)
+	if count := atomic.LoadUint64(&test.testResult.connections); count != opened {
+		t.Fatalf("server counted %d connections, the client opened %d", count, opened)
+	}
+}
+
+//
+// A closed peer must end the bandwidth handler, rather than have it retry
+// reading from the connection.
+//
+func TestBandwidthHandlerEndsOnClosedPeer(t *testing.T) {
+	initServerTest()
+	testParam := EthrTestParam{TestId: EthrTestId{Tcp, Bandwidth}, BufferSize: 1024}
+	test, err := newTest("bandwidth-closed-peer", nil, testParam, nil, nil)
+	if err != nil {
+		t.Fatalf("newTest: %v", err)
+	}
+	defer deleteTest(test)
+
+	client, server := net.Pipe()
+	ended := make(chan struct{})
+	go func() {
+		runBandwidthHandler(server, test)
+		close(ended)
+	}()
+	client.Write(make([]byte, 100))
+	client.Close()
+	select {
+	case <-ended:
+	case <-time.After(time.Second):
+		t.Fatalf("bandwidth handler still running 1s after the peer closed the connection")
+	}
+}
+
+//
+// Bytes are counted as read, so a stream that isn't a multiple of the
+// buffer size is counted exactly.
+//
+func TestBandwidthHandlerCountsExactBytes(t *testing.T) {
+	initServerTest()
+	const bufferSize = 1024
+	const sent = 10*bufferSize + 123
+	testParam := EthrTestParam{TestId: EthrTestId{Tcp, Bandwidth}, BufferSize: bufferSize}
+	test, err := newTest("bandwidth-exact-bytes", nil, testParam, nil, nil)
+	if err != nil {
+		t.Fatalf("newTest: %v", err)
+	}
+	defer deleteTest(test)
+
+	client, server := net.Pipe()
+	ended := make(chan struct{})
+	go func() {
+		runBandwidthHandler(server, test)
+		close(ended)
+	}()
+	// Odd sized writes, so reads end in the middle of buffers as well.
+	buff := make([]byte, 777)
+	for left := sent; left > 0; {
+		n := len(buff)
+		if n > left {
+			n = left
+		}
+		client.Write(buff[:n])
+		left -= n
+	}
+	client.Close()
+	<-ended
+	if count := atomic.LoadUint64(&test.testResult.bytes); count != sent {
+		t.Fatalf("server counted %d bytes, the client sent %d", count, sent)
+	}
+}
+
+//
+// Chunked requests have no Content-Length, so the bytes of the body must be
+// counted as they are read.
+//
+func TestHttpBandwidthCountsChunkedBody(t *testing.T) {
+	initServerTest()
+	test, err := newTest("192.0.2.1", nil, EthrTestParam{TestId: EthrTestId{Http, Bandwidth}}, nil, nil)
+	if err != nil {
+		t.Fatalf("newTest: %v", err)
+	}
+	defer deleteTest(test)
+
+	const size = 100000
+	body := io.MultiReader(strings.NewReader(strings.Repeat("x", size)))
+	req := httptest.NewRequest("POST", "/", body)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if req.ContentLength != -1 {
+		t.Fatalf("request has Content-Length %d, expected a chunked request", req.ContentLength)
+	}
+	rec := httptest.NewRecorder()
+	handleHttpRequest(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("handler returned status %d", rec.Code)
+	}
+	if count := atomic.LoadUint64(&test.testResult.bytes); count != size {
+		t.Fatalf("server counted %d bytes, the client sent %d", count, size)
+	}
+}
+
+//
+// The test registry is used by the control handlers, the data handlers and
+// the stats timer at once. Run with -race to check that it is safe.
+//
+func TestRegistryConcurrentTests(t *testing.T) {
+	initServerTest()
+	const clients = 32
+	const rounds = 50
+	types := []EthrTestType{Bandwidth, Latency, Cps}
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			emitTestResults()
+			sessionCount()
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Pairs of clients share an address, so that they share a
+			// session.
+			addr := net.IPv4(192, 0, 2, byte(i/2)).String()
+			for j := 0; j < rounds; j++ {
+				testType := types[(i+j)%len(types)]
+				test, err := newTest(addr, nil, EthrTestParam{TestId: EthrTestId{Tcp, testType}}, nil, nil)
+				if err != nil {
+					continue
+				}
+				if getTest(addr, Tcp, testType) != test {
+					t.Errorf("getTest did not return the test just added")
+				}
+				test.setActive(false)
+				deleteTest(test)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	for i := 0; i < clients/2; i++ {
+		addr := net.IPv4(192, 0, 2, byte(i)).String()
+		for _, testType := range types {
+			if getTest(addr, Tcp, testType) != nil {
+				t.Errorf("test %v from %s still registered", testType, addr)
+			}
+		}
+	}
+}
+
+//
+// At 100 Gbit/s, the byte total of a test wraps after about 47 years, so a
+// long run is simulated by starting it close to wrapping. Interval rates are
+// swapped out of their own counter, so they stay right across the wrap, and
+// the latency gauge of a test of the same client doesn't mix with them.
+//
+func TestCountersLongRun(t *testing.T) {
+	initServerTest()
+	const addr = "counters-long-run"
+	const perInterval uint64 = 100e9 / 8
+	const latency = 123456 * time.Nanosecond
+	bw, err := newTest(addr, nil, EthrTestParam{TestId: EthrTestId{Tcp, Bandwidth}}, nil, nil)
+	if err != nil {
+		t.Fatalf("newTest: %v", err)
+	}
+	defer deleteTest(bw)
+	lat, err := newTest(addr, nil, EthrTestParam{TestId: EthrTestId{Tcp, Latency}}, nil, nil)
+	if err != nil {
+		t.Fatalf("newTest: %v", err)
+	}
+	defer deleteTest(lat)
+	bw.setActive(true)
+	lat.setActive(true)
+
+	total := ^uint64(0) - 10*perInterval
+	bw.testResult.total = total
+	const intervals = 100
+	for i := 0; i < intervals; i++ {
+		bw.addBandwidthData(perInterval)
+		atomic.StoreUint64(&lat.testResult.lastLatencyNs, uint64(latency))
+		total += perInterval
+		gSessionLock.RLock()
+		str := getTestResults(bw.session, Tcp)
+		gSessionLock.RUnlock()
+		if str[2] != bytesToRate(perInterval) {
+			t.Fatalf("interval %d: rate %s, expected %s", i, str[2], bytesToRate(perInterval))
+		}
+		if str[5] != latencyToString(latency) {
+			t.Fatalf("interval %d: latency %s, expected %s", i, str[5], latencyToString(latency))
+		}
+	}
+	if got := atomic.LoadUint64(&bw.testResult.total); got != total {
+		t.Fatalf("total %d, expected %d", got, total)
+	}
+	if len(bw.bwSeries) != intervals {
+		t.Fatalf("%d bandwidth samples, expected %d", len(bw.bwSeries), intervals)
+	}
+	for i, sample := range bw.bwSeries {
+		if sample != perInterval {
+			t.Fatalf("sample %d is %d, expected %d", i, sample, perInterval)
+		}
+	}
+}
+
+//
+// A message that stalls in the middle for longer than latencyPartialTimeout
+// is still echoed, so the exchange stays in sync, but its sample is
+// discarded.
+//
+func TestLatencyHandlerDiscardsStalledMsg(t *testing.T) {
+	initServerTest()
+	client, server := net.Pipe()
+	defer client.Close()
+	testParam := EthrTestParam{TestId: EthrTestId{Tcp, Latency}, RttCount: 2, OneWay: true}
+	test, err := newTest("latency-stall", nil, testParam, nil, nil)
+	if err != nil {
+		t.Fatalf("newTest: %v", err)
+	}
+	defer deleteTest(test)
+	ended := make(chan struct{})
+	go func() {
+		runLatencyHandler(server, test)
+		close(ended)
+	}()
+
+	msg := make([]byte, latencyMsgSize(testParam))
+	exchange := func(stall bool) {
+		stampLatencyMsg(msg)
+		if stall {
+			client.Write(msg[:2])
+			time.Sleep(latencyPartialTimeout + 200*time.Millisecond)
+			client.Write(msg[2:])
+		} else {
+			client.Write(msg)
+		}
+		if _, err := io.ReadFull(client, msg); err != nil {
+			t.Fatalf("reading the echo: %v", err)
+		}
+	}
+	exchange(false)
+	exchange(true)
+	exchange(false)
+	client.Close()
+	<-ended
+	if n := atomic.LoadUint64(&test.testResult.discarded); n != 1 {
+		t.Fatalf("%d samples discarded, expected 1", n)
+	}
+}
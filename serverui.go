@@ -9,6 +9,8 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,6 +34,9 @@ func initServerUi(showUi bool) {
 	gAggregateTestResults[Http] = &ethrTestResultAggregate{}
 	gAggregateTestResults[Https] = &ethrTestResultAggregate{}
 	gAggregateTestResults[Icmp] = &ethrTestResultAggregate{}
+	gAggregateTestResults[Quic] = &ethrTestResultAggregate{}
+	gAggregateTestResults[Grpc] = &ethrTestResultAggregate{}
+	gAggregateTestResults[Sctp] = &ethrTestResultAggregate{}
 	if !showUi || !initServerTui() {
 		initServerCli()
 	}
@@ -193,18 +198,20 @@ func (u *serverTui) printTestResults(s []string) {
 
 func (u *serverTui) emitTestResultEnd() {
 	emitAggregateResults()
+	emitHandlerGauge()
 }
 
 func (u *serverTui) emitTestHdr() {
-	s := []string{"RemoteAddress", "Proto", "Bits/s", "Conn/s", "Pkts/s", "Latency"}
+	s := []string{"RemoteAddress", "Proto", rateUnit(), "Conn/s", "Pkts/s", "Latency"}
 	u.resultHdr = s
 }
 
 func (u *serverTui) emitLatencyHdr() {
 }
 
-func (u *serverTui) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999 time.Duration) {
-	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999)
+func (u *serverTui) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999,
+	p9999, stddev time.Duration) {
+	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
 }
 
 func (u *serverTui) paint() {
@@ -250,16 +257,20 @@ func (u *serverTui) paint() {
 	x := u.statX
 	w := u.statW
 	y := u.statY
+	bps := "bps"
+	if gRateFormat != rateBits {
+		bps = "Bps"
+	}
 	for _, ns := range gCurNetStats.netDevStats {
 		nsDiff := getNetDevStatDiff(ns, gPrevNetStats)
 		// TODO: Log the network adapter stats in file as well.
 		printText(x, y, w, fmt.Sprintf("if: %s", ns.interfaceName), tm.ColorWhite, tm.ColorBlack)
 		y++
-		printText(x, y, w, fmt.Sprintf("Tx %sbps", bytesToRate(nsDiff.txBytes)), tm.ColorWhite, tm.ColorBlack)
+		printText(x, y, w, fmt.Sprintf("Tx %s%s", bytesToRate(nsDiff.txBytes), bps), tm.ColorWhite, tm.ColorBlack)
 		bw := nsDiff.txBytes * 8
 		printUsageBar(x+14, y, 10, bw, KILO, tm.ColorYellow)
 		y++
-		printText(x, y, w, fmt.Sprintf("Rx %sbps", bytesToRate(nsDiff.rxBytes)), tm.ColorWhite, tm.ColorBlack)
+		printText(x, y, w, fmt.Sprintf("Rx %s%s", bytesToRate(nsDiff.rxBytes), bps), tm.ColorWhite, tm.ColorBlack)
 		bw = nsDiff.rxBytes * 8
 		printUsageBar(x+14, y, 10, bw, KILO, tm.ColorGreen)
 		y++
@@ -320,9 +331,7 @@ func (u *serverCli) paint() {
 }
 
 func (u *serverCli) emitTestResultBegin() {
-	gSessionLock.RLock()
-	l := len(gSessionKeys)
-	gSessionLock.RUnlock()
+	l := sessionCount()
 	if l > 1 {
 		fmt.Println("- - - - - - - - - - - - - - - - - - - - - - - - - - - - - -")
 	}
@@ -332,24 +341,27 @@ func (u *serverCli) emitTestResult(s *ethrSession, proto EthrProtocol) {
 	str := getTestResults(s, proto)
 	if len(str) > 0 {
 		ui.printTestResults(str)
+		emitPpsHandlers(s, proto)
 	}
 }
 
 func (u *serverCli) emitTestResultEnd() {
 	emitAggregateResults()
+	emitHandlerGauge()
 }
 
 func (u *serverCli) emitTestHdr() {
-	s := []string{"RemoteAddress", "Proto", "Bits/s", "Conn/s", "Pkt/s", "Latency"}
+	s := []string{"RemoteAddress", "Proto", rateUnit(), "Conn/s", "Pkt/s", "Latency", "Test ID"}
 	fmt.Println("-----------------------------------------------------------")
-	fmt.Printf("[%13s]  %5s  %7s  %7s  %7s  %8s\n", s[0], s[1], s[2], s[3], s[4], s[5])
+	fmt.Printf("[%13s]  %5s  %7s  %7s  %7s  %8s  %s\n", s[0], s[1], s[2], s[3], s[4], s[5], s[6])
 }
 
 func (u *serverCli) emitLatencyHdr() {
 }
 
-func (u *serverCli) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999 time.Duration) {
-	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999)
+func (u *serverCli) emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999,
+	p9999, stddev time.Duration) {
+	logLatency(remote, proto, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev)
 }
 
 func (u *serverCli) emitStats(netStats ethrNetStat) {
@@ -357,12 +369,16 @@ func (u *serverCli) emitStats(netStats ethrNetStat) {
 
 func (u *serverCli) printTestResults(s []string) {
 	logResults(s)
-	fmt.Printf("[%13s]  %5s  %7s  %7s  %7s  %8s\n", truncateString(s[0], 13),
-		s[1], s[2], s[3], s[4], s[5])
+	id := ""
+	if len(s) > 6 {
+		id = s[6]
+	}
+	fmt.Printf("[%13s]  %5s  %7s  %7s  %7s  %8s  %s\n", truncateString(s[0], 13),
+		s[1], s[2], s[3], s[4], s[5], id)
 }
 
 func emitAggregateResults() {
-	var protoList = []EthrProtocol{Tcp, Udp, Http, Https, Icmp}
+	var protoList = []EthrProtocol{Tcp, Udp, Http, Https, Icmp, Quic, Grpc, Sctp}
 	for _, proto := range protoList {
 		emitAggregate(proto)
 	}
@@ -389,6 +405,21 @@ func emitAggregate(proto EthrProtocol) {
 	}
 }
 
+//
+// The ids of the tests of the session over the protocol, as sent by their
+// clients, so that the server's results can be matched with the clients'.
+//
+func testIds(s *ethrSession, proto EthrProtocol) string {
+	var ids []string
+	for testId, test := range s.tests {
+		if testId.Protocol == proto && test.isActive && test.uuid != "" {
+			ids = append(ids, test.uuid)
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
 func getTestResults(s *ethrSession, proto EthrProtocol) []string {
 	var bwTestOn, cpsTestOn, ppsTestOn, latTestOn bool
 	var bw, cps, pps, latency uint64
@@ -396,30 +427,96 @@ func getTestResults(s *ethrSession, proto EthrProtocol) []string {
 	test, found := s.tests[EthrTestId{proto, Bandwidth}]
 	if found && test.isActive {
 		bwTestOn = true
-		bw = atomic.SwapUint64(&test.testResult.data, 0)
+		bw = atomic.SwapUint64(&test.testResult.bytes, 0)
+		atomic.AddUint64(&test.testResult.total, bw)
+		if !test.inWarmup() && !test.isPaused() {
+			test.addBandwidthSample(bw)
+		}
 		aggTestResult.bw += bw
 		aggTestResult.cbw++
 	}
+	test, found = s.tests[EthrTestId{proto, Download}]
+	if found && test.isActive {
+		bwTestOn = true
+		download := atomic.SwapUint64(&test.testResult.bytes, 0)
+		atomic.AddUint64(&test.testResult.total, download)
+		if !test.inWarmup() && !test.isPaused() {
+			test.addBandwidthSample(download)
+		}
+		bw += download
+		aggTestResult.bw += download
+		aggTestResult.cbw++
+	}
+	// Echo tests are shown with the bytes of both directions, and the bytes
+	// received are kept for the summary, as for bandwidth tests.
+	test, found = s.tests[EthrTestId{proto, Echo}]
+	if found && test.isActive {
+		bwTestOn = true
+		rx := atomic.SwapUint64(&test.testResult.bytes, 0)
+		tx := atomic.SwapUint64(&test.testResult.echoBytes, 0)
+		atomic.AddUint64(&test.testResult.total, rx)
+		atomic.AddUint64(&test.testResult.echoTotal, tx)
+		if !test.inWarmup() {
+			test.addBandwidthSample(rx)
+		}
+		bw += rx + tx
+		aggTestResult.bw += rx + tx
+		aggTestResult.cbw++
+	}
 	test, found = s.tests[EthrTestId{proto, Cps}]
 	if found && test.isActive {
 		cpsTestOn = true
-		cps = atomic.SwapUint64(&test.testResult.data, 0)
+		cps = atomic.SwapUint64(&test.testResult.connections, 0)
+		atomic.AddUint64(&test.testResult.total, cps)
 		aggTestResult.cps += cps
 		aggTestResult.ccps++
 	}
+	// The server only sees the connections of connection latency tests, so
+	// they are shown as conn/s.
+	test, found = s.tests[EthrTestId{proto, ConnLatency}]
+	if found && test.isActive {
+		cpsTestOn = true
+		conns := atomic.SwapUint64(&test.testResult.connections, 0)
+		atomic.AddUint64(&test.testResult.total, conns)
+		cps += conns
+		aggTestResult.cps += conns
+		aggTestResult.ccps++
+	}
 	test, found = s.tests[EthrTestId{proto, Pps}]
 	if found && test.isActive {
 		ppsTestOn = true
-		pps = atomic.SwapUint64(&test.testResult.data, 0)
+		pps = atomic.SwapUint64(&test.testResult.packets, 0)
+		atomic.AddUint64(&test.testResult.total, pps)
 		aggTestResult.pps += pps
 		aggTestResult.cpps++
+		// Derived bandwidth for the Packets/s test, as there is no separate
+		// UDP bandwidth test.
+		if !bwTestOn {
+			bwTestOn = true
+			bw = pps * uint64(test.testParam.BufferSize)
+		}
+	}
+	test, found = s.tests[EthrTestId{proto, PingPong}]
+	if found && test.isActive {
+		tps := atomic.SwapUint64(&test.testResult.transactions, 0)
+		atomic.AddUint64(&test.testResult.total, tps)
+		// As for Packets/s, the echoed bytes are shown as the bandwidth.
+		pingPongBw := tps * uint64(test.testParam.BufferSize)
+		influxWrite(s.remoteAddr, protoToString(proto), "pingpong",
+			map[string]uint64{"transactions_per_second": tps, "bits_per_second": pingPongBw * 8})
+		if !bwTestOn {
+			bwTestOn = true
+			bw = pingPongBw
+		}
 	}
 	test, found = s.tests[EthrTestId{proto, Latency}]
 	if found && test.isActive {
 		latTestOn = true
-		latency = atomic.LoadUint64(&test.testResult.data)
+		latency = atomic.LoadUint64(&test.testResult.lastLatencyNs)
 	}
 	if bwTestOn || cpsTestOn || ppsTestOn || latTestOn {
+		influxServerResults(s.remoteAddr, proto, bw, cps, pps, latency,
+			bwTestOn, cpsTestOn, ppsTestOn, latTestOn)
 		var bwStr, cpsStr, ppsStr, latStr string
 		if bwTestOn {
 			bwStr = bytesToRate(bw)
@@ -431,10 +528,10 @@ func getTestResults(s *ethrSession, proto EthrProtocol) []string {
 			ppsStr = ppsToString(pps)
 		}
 		if latTestOn {
-			latStr = durationToString(time.Duration(latency))
+			latStr = latencyToString(time.Duration(latency))
 		}
 		str := []string{s.remoteAddr, protoToString(proto),
-			bwStr, cpsStr, ppsStr, latStr}
+			bwStr, cpsStr, ppsStr, latStr, testIds(s, proto)}
 		return str
 	}
 
@@ -7,10 +7,14 @@ package main
 
 import (
 	"container/list"
-	"encoding/gob"
+	"crypto/rand"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type EthrTestType uint32
@@ -20,6 +24,10 @@ const (
 	Cps
 	Pps
 	Latency
+	Download
+	PingPong
+	ConnLatency
+	Echo
 )
 
 type EthrProtocol uint32
@@ -30,6 +38,10 @@ const (
 	Http
 	Https
 	Icmp
+	Quic
+	Dns
+	Grpc
+	Sctp
 )
 
 type EthrTestId struct {
@@ -46,6 +58,9 @@ const (
 	EthrFin
 	EthrBgn
 	EthrEnd
+	EthrStop
+	EthrPause
+	EthrResume
 )
 
 type EthrMsgVer uint32
@@ -58,13 +73,29 @@ type EthrMsg struct {
 	Fin     *EthrMsgFin
 	Bgn     *EthrMsgBgn
 	End     *EthrMsgEnd
+	Stop    *EthrMsgStop
+	Pause   *EthrMsgPause
 }
 
 type EthrMsgSyn struct {
 	TestParam EthrTestParam
+	Token     string
+	TestUuid  string
+	Session   string
 }
 
+//
+// The server sends the port of the data listener for the test, so that
+// clients find it when the server binds to ephemeral ports. Servers that
+// predate it send none. DataToken is set by servers that match data
+// connections by the token the client sends, see matchDataConn. ConnCounts is
+// set by servers that send their counts of connections in EthrEnd when the
+// client stops a conn/s test.
+//
 type EthrMsgAck struct {
+	Port       string
+	DataToken  bool
+	ConnCounts bool
 }
 
 type EthrMsgFin struct {
@@ -75,31 +106,185 @@ type EthrMsgBgn struct {
 	UdpPort string
 }
 
+//
+// The server sends EthrEnd when it ends a test, with a message for the client
+// to show, or in reply to EthrStop for a conn/s test, with the number of
+// connections it accepted, and the number the kernel dropped as the accept
+// queue was full, if it knows it. Drops are counted for the whole system.
+//
 type EthrMsgEnd struct {
-	Message string
+	Message    string
+	Accepted   uint64
+	Dropped    uint64
+	DropsKnown bool
+}
+
+type EthrMsgStop struct {
+	TestId EthrTestId
+}
+
+//
+// Used for both EthrPause and EthrResume messages.
+//
+type EthrMsgPause struct {
+	TestId EthrTestId
 }
 
 type EthrTestParam struct {
-	TestId     EthrTestId
-	NumThreads uint32
-	BufferSize uint32
-	RttCount   uint32
+	TestId        EthrTestId
+	NumThreads    uint32
+	BufferSize    uint32
+	RttCount      uint32
+	EnableNagle   bool
+	LatencyWindow uint32
+	TotalBytes    uint64
+	Verify        bool
+	OneWay        bool
+	Label         string
+	CpsCloseWait  bool
+	Tls           bool
+	LatencyStable float64
 }
 
+//
+// Each test type counts into its own field during an interval, which the
+// stats timer swaps out and adds to total, see intervalCounter. Latency tests
+// report the average of the last batch in lastLatencyNs instead, which is
+// replaced rather than accumulated. Echo tests count the bytes sent by the
+// client in bytes, and the bytes the server sends back in echoBytes, which
+// is added to echoTotal.
+//
 type ethrTestResult struct {
-	data uint64
+	bytes         uint64
+	packets       uint64
+	connections   uint64
+	transactions  uint64
+	lastLatencyNs uint64
+	warmupData    uint64
+	totalData     uint64
+	total         uint64
+	verified      uint64
+	corrupted     uint64
+	discarded     uint64
+	timeouts      uint64
+	echoBytes     uint64
+	echoTotal     uint64
+	refused       uint64
+	connectFailed uint64
+	cpsInterval   ethrCpsPhases
+	cpsTotal      ethrCpsPhases
+}
+
+//
+// With "-cps-close", the conn/s test measures the time it takes to connect
+// and the time it takes to close each connection, summed up to compute the
+// average of each phase.
+//
+type ethrCpsPhases struct {
+	connectNs uint64
+	closeNs   uint64
+	count     uint64
+}
+
+func (test *ethrTest) intervalCounter() *uint64 {
+	switch test.testParam.TestId.Type {
+	case Bandwidth, Download, Echo:
+		return &test.testResult.bytes
+	case Cps, ConnLatency:
+		return &test.testResult.connections
+	case Pps:
+		return &test.testResult.packets
+	case PingPong:
+		return &test.testResult.transactions
+	}
+	return nil
 }
 
 type ethrTest struct {
 	isActive   bool
 	session    *ethrSession
 	ctrlConn   net.Conn
-	enc        *gob.Encoder
-	dec        *gob.Decoder
+	enc        ethrMsgEncoder
+	encLock    sync.Mutex
+	dec        ethrMsgDecoder
 	testParam  EthrTestParam
 	testResult ethrTestResult
 	done       chan struct{}
 	connList   *list.List
+	connLock   sync.RWMutex
+	bwSeries   []uint64
+	startTime  time.Time
+	udpSizes   []uint64
+	udpTrunc   uint64
+	srcPorts   []uint64
+	handlerPps []uint64
+	paused     uint32
+	uuid       string
+	dataToken  bool
+	connCounts bool
+	serverEnd  chan *EthrMsgEnd
+	udpPort    string
+	oneWay     ethrOneWayDelay
+	digest     *tDigest
+	// Set on the server for tests named with "-session", see reattachTest.
+	name        string
+	detached    bool
+	attachCount int
+}
+
+//
+// The client generates a UUID for each test and sends it in the Syn, so that
+// its results can be matched with the server's, e.g. when several clients
+// test against one server. Clients that predate it send none.
+//
+func newTestUuid() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return ""
+	}
+	// Version 4, variant 10xx, as in RFC 4122.
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func testIdSuffix(uuid, label string) string {
+	switch {
+	case uuid != "" && label != "":
+		return " (test id " + uuid + ", label " + label + ")"
+	case uuid != "":
+		return " (test id " + uuid + ")"
+	case label != "":
+		return " (label " + label + ")"
+	}
+	return ""
+}
+
+func (test *ethrTest) remoteWithId() string {
+	return test.session.remoteAddr + testIdSuffix(test.uuid, test.testParam.Label)
+}
+
+//
+// isActive is read by the stats timer while it holds gSessionLock for read,
+// so it is only changed with gSessionLock held for write.
+//
+func (test *ethrTest) setActive(active bool) {
+	gSessionLock.Lock()
+	defer gSessionLock.Unlock()
+	test.isActive = active
+}
+
+func (test *ethrTest) isPaused() bool {
+	return atomic.LoadUint32(&test.paused) != 0
+}
+
+func (test *ethrTest) setPaused(paused bool) {
+	if paused {
+		atomic.StoreUint32(&test.paused, 1)
+	} else {
+		atomic.StoreUint32(&test.paused, 0)
+	}
 }
 
 type ethrConn struct {
@@ -108,6 +293,7 @@ type ethrConn struct {
 	elem    *list.Element
 	fd      uintptr
 	data    uint64
+	total   uint64
 	retrans uint64
 }
 
@@ -117,6 +303,15 @@ type ethrSession struct {
 	tests      map[EthrTestId]*ethrTest
 }
 
+//
+// Prefix of the Fin message sent by the server when it rejects a test because
+// the same test type is already running from the same host. The client uses
+// it to distinguish this case from other failures.
+//
+const rejectedDuplicateMsg = "Rejected duplicate"
+
+var errDuplicateTest = errors.New("a test of this type is already running against the server from this host")
+
 var gSessions = make(map[string]*ethrSession)
 var gSessionKeys = make([]string, 0)
 var gSessionLock sync.RWMutex
@@ -132,7 +327,7 @@ func deleteKey(key string) {
 	gSessionKeys = gSessionKeys[:i]
 }
 
-func newTest(remoteAddr string, conn net.Conn, testParam EthrTestParam, enc *gob.Encoder, dec *gob.Decoder) (*ethrTest, error) {
+func newTest(remoteAddr string, conn net.Conn, testParam EthrTestParam, enc ethrMsgEncoder, dec ethrMsgDecoder) (*ethrTest, error) {
 	gSessionLock.Lock()
 	defer gSessionLock.Unlock()
 	var session *ethrSession
@@ -157,7 +352,14 @@ func newTest(remoteAddr string, conn net.Conn, testParam EthrTestParam, enc *gob
 	test.dec = dec
 	test.testParam = testParam
 	test.done = make(chan struct{})
+	test.serverEnd = make(chan *EthrMsgEnd, 1)
 	test.connList = list.New()
+	// The comparison of address families shows percentiles over the test,
+	// and so does the summary of connection latency tests.
+	if (gTDigest || gAddrFamily == familyBoth) && testParam.TestId.Type == Latency ||
+		testParam.TestId.Type == ConnLatency {
+		test.digest = newTDigest(tdigestCompression)
+	}
 	session.tests[testParam.TestId] = test
 
 	return test, nil
@@ -185,6 +387,7 @@ func deleteTest(test *ethrTest) {
 	//
 	delete(session.tests, testId)
 	session.testCount--
+	unnameTest(test)
 
 	if session.testCount == 0 {
 		deleteKey(session.remoteAddr)
@@ -192,6 +395,12 @@ func deleteTest(test *ethrTest) {
 	}
 }
 
+func sessionCount() int {
+	gSessionLock.RLock()
+	defer gSessionLock.RUnlock()
+	return len(gSessionKeys)
+}
+
 func getTest(remoteAddr string, proto EthrProtocol, testType EthrTestType) (test *ethrTest) {
 	test = nil
 	gSessionLock.RLock()
@@ -204,9 +413,27 @@ func getTest(remoteAddr string, proto EthrProtocol, testType EthrTestType) (test
 	return
 }
 
+func getTestByUuid(uuid string) *ethrTest {
+	gSessionLock.RLock()
+	defer gSessionLock.RUnlock()
+	for _, session := range gSessions {
+		for _, test := range session.tests {
+			if test.uuid == uuid {
+				return test
+			}
+		}
+	}
+	return nil
+}
+
+//
+// The connection list has its own lock, as it is walked by the stats timer
+// while it holds gSessionLock for read, and a nested read lock on
+// gSessionLock can deadlock with a writer waiting in between.
+//
 func (test *ethrTest) newConn(conn net.Conn) (ec *ethrConn) {
-	gSessionLock.Lock()
-	defer gSessionLock.Unlock()
+	test.connLock.Lock()
+	defer test.connLock.Unlock()
 	ec = &ethrConn{}
 	ec.test = test
 	ec.conn = conn
@@ -216,6 +443,8 @@ func (test *ethrTest) newConn(conn net.Conn) (ec *ethrConn) {
 }
 
 func (test *ethrTest) delConn(conn net.Conn) {
+	test.connLock.Lock()
+	defer test.connLock.Unlock()
 	for e := test.connList.Front(); e != nil; e = e.Next() {
 		ec := e.Value.(*ethrConn)
 		if ec.conn == conn {
@@ -226,25 +455,78 @@ func (test *ethrTest) delConn(conn net.Conn) {
 }
 
 func (test *ethrTest) connListDo(f func(*ethrConn)) {
-	gSessionLock.RLock()
-	defer gSessionLock.RUnlock()
+	test.connLock.RLock()
+	defer test.connLock.RUnlock()
 	for e := test.connList.Front(); e != nil; e = e.Next() {
 		ec := e.Value.(*ethrConn)
 		f(ec)
 	}
 }
 
-func recvSessionMsg(dec *gob.Decoder) (ethrMsg *EthrMsg) {
-	ethrMsg = &EthrMsg{}
+//
+// Messages that fail to decode, e.g. garbage from port scanners, and
+// messages without the body for their type, which would otherwise crash the
+// receiver, are returned as EthrInv along with the error, so that callers
+// that only check the type end the session.
+//
+func recvSessionMsg(dec ethrMsgDecoder) (*EthrMsg, error) {
+	ethrMsg := &EthrMsg{}
 	err := dec.Decode(ethrMsg)
+	if err == nil {
+		err = checkSessionMsg(ethrMsg)
+	}
 	if err != nil {
 		ui.printDbg("Error receiving message on control channel: %v", err)
-		ethrMsg.Type = EthrInv
+		return &EthrMsg{Type: EthrInv}, err
 	}
-	return
+	return ethrMsg, nil
+}
+
+//
+// The Ack has no body from older versions.
+//
+func checkSessionMsg(ethrMsg *EthrMsg) error {
+	missing := false
+	switch ethrMsg.Type {
+	case EthrSyn:
+		missing = ethrMsg.Syn == nil
+		// The label is shown and logged by the server, so it is checked
+		// as on the client, see isValidLabel.
+		if !missing && !isValidLabel(ethrMsg.Syn.TestParam.Label) {
+			return errors.New("invalid label")
+		}
+	case EthrAck:
+	case EthrFin:
+		missing = ethrMsg.Fin == nil
+	case EthrBgn:
+		missing = ethrMsg.Bgn == nil
+	case EthrEnd:
+		missing = ethrMsg.End == nil
+	case EthrStop:
+		missing = ethrMsg.Stop == nil
+	case EthrPause, EthrResume:
+		missing = ethrMsg.Pause == nil
+	default:
+		return fmt.Errorf("unknown message type %d", ethrMsg.Type)
+	}
+	if missing {
+		return fmt.Errorf("message of type %d has no body", ethrMsg.Type)
+	}
+	return nil
 }
 
-func sendSessionMsg(enc *gob.Encoder, ethrMsg *EthrMsg) error {
+//
+// Messages on the control connection of a running test are sent from more
+// than one goroutine, e.g. the keyboard handler and the end of the test on
+// the client, so they are sent one at a time.
+//
+func (test *ethrTest) sendMsg(ethrMsg *EthrMsg) error {
+	test.encLock.Lock()
+	defer test.encLock.Unlock()
+	return sendSessionMsg(test.enc, ethrMsg)
+}
+
+func sendSessionMsg(enc ethrMsgEncoder, ethrMsg *EthrMsg) error {
 	err := enc.Encode(ethrMsg)
 	if err != nil {
 		ui.printDbg("Error sending message on control channel. Message: %v, Error: %v", ethrMsg, err)
@@ -252,8 +534,10 @@ func sendSessionMsg(enc *gob.Encoder, ethrMsg *EthrMsg) error {
 	return err
 }
 
-func createAckMsg() (ethrMsg *EthrMsg) {
+func createAckMsg(port string) (ethrMsg *EthrMsg) {
 	ethrMsg = &EthrMsg{Version: 0, Type: EthrAck}
+	ethrMsg.Ack = &EthrMsgAck{}
+	ethrMsg.Ack.Port = port
 	return
 }
 
@@ -264,10 +548,38 @@ func createFinMsg(message string) (ethrMsg *EthrMsg) {
 	return
 }
 
-func createSynMsg(testParam EthrTestParam) (ethrMsg *EthrMsg) {
+func createEndMsg(message string) (ethrMsg *EthrMsg) {
+	ethrMsg = &EthrMsg{Version: 0, Type: EthrEnd}
+	ethrMsg.End = &EthrMsgEnd{}
+	ethrMsg.End.Message = message
+	return
+}
+
+//
+// Connections are counted by the stats timer in total, and in connections
+// for the current interval.
+//
+func createConnCountsMsg(test *ethrTest, dropsStart uint64, dropsErr error) (ethrMsg *EthrMsg) {
+	ethrMsg = createEndMsg("")
+	ethrMsg.End.Accepted = atomic.LoadUint64(&test.testResult.total) +
+		atomic.LoadUint64(&test.testResult.connections)
+	if dropsErr == nil {
+		drops, err := getListenDrops()
+		if err == nil && drops >= dropsStart {
+			ethrMsg.End.Dropped = drops - dropsStart
+			ethrMsg.End.DropsKnown = true
+		}
+	}
+	return
+}
+
+func createSynMsg(testParam EthrTestParam, testUuid string) (ethrMsg *EthrMsg) {
 	ethrMsg = &EthrMsg{Version: 0, Type: EthrSyn}
 	ethrMsg.Syn = &EthrMsgSyn{}
 	ethrMsg.Syn.TestParam = testParam
+	ethrMsg.Syn.Token = gToken
+	ethrMsg.Syn.TestUuid = testUuid
+	ethrMsg.Syn.Session = gSessionName
 	return
 }
 
@@ -277,3 +589,21 @@ func createBgnMsg(port string) (ethrMsg *EthrMsg) {
 	ethrMsg.Bgn.UdpPort = port
 	return
 }
+
+func createPauseMsg(testId EthrTestId, pause bool) (ethrMsg *EthrMsg) {
+	msgType := EthrResume
+	if pause {
+		msgType = EthrPause
+	}
+	ethrMsg = &EthrMsg{Version: 0, Type: msgType}
+	ethrMsg.Pause = &EthrMsgPause{}
+	ethrMsg.Pause.TestId = testId
+	return
+}
+
+func createStopMsg(testId EthrTestId) (ethrMsg *EthrMsg) {
+	ethrMsg = &EthrMsg{Version: 0, Type: EthrStop}
+	ethrMsg.Stop = &EthrMsgStop{}
+	ethrMsg.Stop.TestId = testId
+	return
+}
@@ -0,0 +1,32 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckSessionMsgLabel(t *testing.T) {
+	for _, c := range []struct {
+		label string
+		valid bool
+	}{
+		{"", true},
+		{"site-a/run_1", true},
+		{"with space", false},
+		{"key=value", false},
+		{"line\nbreak", false},
+		{strings.Repeat("x", maxLabelLen), true},
+		{strings.Repeat("x", maxLabelLen+1), false},
+	} {
+		msg := createSynMsg(EthrTestParam{Label: c.label}, "")
+		err := checkSessionMsg(msg)
+		if (err == nil) != c.valid {
+			t.Errorf("label %q: got error %v, expected valid %v", c.label, err, c.valid)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+)
+
+//
+// With "-src-ports", the server counts the source ports of the data
+// connections of each TCP and SCTP test, and of the packets of UDP tests, and
+// shows their distribution at the end of the test, e.g. to check that a
+// firewall rule for a range of source ports let the test through. The ports
+// are shown as the range seen, the number of distinct ports, and the count
+// in each block of srcPortBlock ports that has any.
+//
+const srcPortBlock = 4096
+
+var gSrcPorts bool
+
+func initSrcPorts(test *ethrTest) {
+	if gSrcPorts {
+		test.srcPorts = make([]uint64, 1<<16)
+	}
+}
+
+func (test *ethrTest) addSrcPort(addr net.Addr) {
+	if test.srcPorts == nil || addr == nil {
+		return
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return
+	}
+	atomic.AddUint64(&test.srcPorts[p], 1)
+}
+
+func emitSrcPortSummary(test *ethrTest) {
+	if test.srcPorts == nil {
+		return
+	}
+	unit := "connections"
+	if test.testParam.TestId.Protocol == Udp {
+		unit = "packets"
+	}
+	var total, distinct uint64
+	min, max := -1, 0
+	blocks := make([]uint64, len(test.srcPorts)/srcPortBlock)
+	for p := range test.srcPorts {
+		count := atomic.LoadUint64(&test.srcPorts[p])
+		if count == 0 {
+			continue
+		}
+		if min < 0 {
+			min = p
+		}
+		max = p
+		total += count
+		distinct++
+		blocks[p/srcPortBlock] += count
+	}
+	if total == 0 {
+		return
+	}
+	ui.printMsg("Source ports of %d %s from %s: %d-%d, %d distinct", total, unit,
+		test.remoteWithId(), min, max, distinct)
+	str := ""
+	for i, count := range blocks {
+		if count > 0 {
+			str += fmt.Sprintf(" %d-%d: %d", i*srcPortBlock, (i+1)*srcPortBlock-1, count)
+		}
+	}
+	ui.printMsg("Source ports by block:%s", str)
+}
@@ -0,0 +1,77 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+//
+// With "-stable <percent>", a latency test runs until its p99 is stable,
+// rather than for a duration picked in advance, although "-d" still applies.
+// The server takes the p99 over all samples so far after each batch of
+// round trips ("-i"), and once it moved by no more than the given percentage
+// over the last latencyStableBatches batches, it reports the p99, and ends
+// the test by sending EthrEnd to the client and closing the control
+// connection. At least latencyStableMinSamples are taken, so that the tail
+// has a few samples to estimate the p99 from.
+//
+const (
+	latencyStableBatches    = 3
+	latencyStableMinSamples = 1000
+)
+
+type latencyStability struct {
+	tolerance float64
+	digest    *tDigest
+	p99s      []time.Duration
+}
+
+func newLatencyStability(percent float64) *latencyStability {
+	return &latencyStability{
+		tolerance: percent / 100,
+		digest:    newTDigest(tdigestCompression),
+	}
+}
+
+//
+// It adds the samples of a batch, and returns the p99 over all samples so far,
+// and whether it is stable.
+//
+func (s *latencyStability) add(samples []time.Duration) (time.Duration, bool) {
+	s.digest.addSamples(samples)
+	p99 := s.digest.quantile(0.99)
+	s.p99s = append(s.p99s, p99)
+	if len(s.p99s) > latencyStableBatches+1 {
+		s.p99s = s.p99s[1:]
+	}
+	n, _, _, _ := s.digest.summary()
+	if n < latencyStableMinSamples || len(s.p99s) <= latencyStableBatches {
+		return p99, false
+	}
+	for _, prev := range s.p99s[:latencyStableBatches] {
+		if diff := float64(p99 - prev); diff > s.tolerance*float64(p99) ||
+			-diff > s.tolerance*float64(p99) {
+			return p99, false
+		}
+	}
+	return p99, true
+}
+
+func (s *latencyStability) samples() uint64 {
+	n, _, _, _ := s.digest.summary()
+	return n
+}
+
+func endStableLatencyTest(test *ethrTest, s *latencyStability, p99 time.Duration) {
+	msg := fmt.Sprintf("p99 latency %s stable within %.4g%% over the last %d batches, after %d samples",
+		latencyToString(p99), s.tolerance*100, latencyStableBatches, s.samples())
+	ui.printMsg("%s latency test from %s: %s, stopping test",
+		protoToString(test.testParam.TestId.Protocol), test.remoteWithId(), msg)
+	sendSessionMsg(test.enc, createEndMsg(msg))
+	test.ctrlConn.Close()
+}
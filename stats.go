@@ -6,8 +6,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"os"
 	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/HdrHistogram/hdrhistogram-go"
 )
 
 type ethrNetStat struct {
@@ -74,28 +85,40 @@ func getNetDevStatDiff(curStats ethrNetDevStat, prevNetStats ethrNetStat) ethrNe
 	return curStats
 }
 
-var statsEnabled bool
+var statsEnabled uint32
+var statsStop, statsStopped chan struct{}
 
 func startStatsTimer() {
-	if statsEnabled {
+	if !atomic.CompareAndSwapUint32(&statsEnabled, 0, 1) {
 		return
 	}
+	statsStop = make(chan struct{})
+	statsStopped = make(chan struct{})
 	ticker := time.NewTicker(time.Second)
-	statsEnabled = true
 	go func() {
-		for statsEnabled {
+		defer close(statsStopped)
+		for {
 			select {
 			case <-ticker.C:
 				emitStats()
+			case <-statsStop:
+				ticker.Stop()
+				return
 			}
 		}
-		ticker.Stop()
-		return
 	}()
 }
 
+//
+// It returns once the stats timer has stopped, so that the outputs it
+// flushes can be closed afterwards without racing with its last flush.
+//
 func stopStatsTimer() {
-	statsEnabled = false
+	if !atomic.CompareAndSwapUint32(&statsEnabled, 1, 0) {
+		return
+	}
+	close(statsStop)
+	<-statsStopped
 }
 
 /*
@@ -161,6 +184,9 @@ func emitStats() {
 	ui.emitTestResultEnd()
 	ui.emitStats(getNetworkStats())
 	ui.paint()
+	outputFlush()
+	influxFlush()
+	otlpFlush()
 }
 
 func emitTestResults() {
@@ -173,5 +199,791 @@ func emitTestResults() {
 		ui.emitTestResult(v, Http)
 		ui.emitTestResult(v, Https)
 		ui.emitTestResult(v, Icmp)
+		ui.emitTestResult(v, Quic)
+		ui.emitTestResult(v, Grpc)
+		ui.emitTestResult(v, Sctp)
+	}
+}
+
+//
+// Per interval bandwidth values are recorded on the test, so that a summary
+// over the whole run can be emitted at the end. Samples are added by the
+// stats timer while holding gSessionLock for read, and only that goroutine
+// adds them, so reading them with gSessionLock held for write is safe.
+//
+func (test *ethrTest) addBandwidthSample(bw uint64) {
+	test.bwSeries = append(test.bwSeries, bw)
+}
+
+//
+// With "-warmup", bytes transferred at the start of a bandwidth, download or
+// echo test, while TCP is still ramping up, are counted separately and not
+// reported as bandwidth. Other test types are not affected.
+//
+func (test *ethrTest) inWarmup() bool {
+	return gWarmup > 0 && time.Since(test.startTime) < gWarmup
+}
+
+func emitWarmupSummary(test *ethrTest) {
+	warmupData := atomic.LoadUint64(&test.testResult.warmupData)
+	if warmupData == 0 {
+		return
+	}
+	ui.printMsg("%s %s test from %s: excluded %sBytes transferred during %v warmup",
+		protoToString(test.testParam.TestId.Protocol), testToString(test.testParam.TestId.Type),
+		test.remoteWithId(),
+		numberToUnit(warmupData), gWarmup)
+}
+
+//
+// With "-verify", the client sends byte(i % BufferSize) at offset i of each
+// stream, and the server compares what it receives with it. A read is
+// compared as a whole first, and only checked byte by byte if it differs, to
+// keep the cost low at high rates.
+//
+func newVerifyPattern(size int) []byte {
+	pattern := make([]byte, 2*size)
+	for i := range pattern {
+		pattern[i] = byte(i % size)
+	}
+	return pattern
+}
+
+func (test *ethrTest) verifyPayload(data, pattern []byte, offset int) {
+	atomic.AddUint64(&test.testResult.verified, uint64(len(data)))
+	expected := pattern[offset : offset+len(data)]
+	if bytes.Equal(data, expected) {
+		return
+	}
+	corrupted := uint64(0)
+	for i := range data {
+		if data[i] != expected[i] {
+			corrupted++
+		}
+	}
+	atomic.AddUint64(&test.testResult.corrupted, corrupted)
+}
+
+func emitVerifySummary(test *ethrTest) {
+	if !test.testParam.Verify {
+		return
+	}
+	verified := atomic.LoadUint64(&test.testResult.verified)
+	corrupted := atomic.LoadUint64(&test.testResult.corrupted)
+	ui.printMsg("%s Bandwidth test from %s: %d of %d bytes received were corrupted",
+		protoToString(test.testParam.TestId.Protocol), test.remoteWithId(),
+		corrupted, verified)
+}
+
+func emitBandwidthSummary(test *ethrTest) {
+	n, min, avg, max, stddev := getBandwidthSummary(test)
+	if n == 0 {
+		return
+	}
+	ui.printMsg("%s Bandwidth summary for %s over %d intervals ("+rateUnit()+"): "+
+		"Min %s, Avg %s, Max %s, StdDev %s",
+		protoToString(test.testParam.TestId.Protocol), test.remoteWithId(), n,
+		bytesToRate(min), bytesToRate(avg), bytesToRate(max), bytesToRate(stddev))
+}
+
+//
+// With more than one stream, e.g. "-n 4", how evenly the streams share the
+// bandwidth is reported each interval and over the test, to detect per-flow
+// rate limiting. Jain's fairness index is 1 when all streams get the same
+// rate, and 1/n when one of n streams gets all of it.
+//
+func streamFairness(rates []uint64) (min, max, stddev uint64, jain float64) {
+	min, max = rates[0], rates[0]
+	sum, sumSq := float64(0), float64(0)
+	for _, r := range rates {
+		if r < min {
+			min = r
+		}
+		if r > max {
+			max = r
+		}
+		sum += float64(r)
+		sumSq += float64(r) * float64(r)
+	}
+	n := float64(len(rates))
+	mean := sum / n
+	if variance := sumSq/n - mean*mean; variance > 0 {
+		stddev = uint64(math.Sqrt(variance))
+	}
+	jain = 1
+	if sumSq > 0 {
+		jain = sum * sum / (n * sumSq)
+	}
+	return
+}
+
+//
+// Streams are compared by their average rate over the intervals of the test.
+// The client is the only side that knows the streams of a test.
+//
+func emitStreamSummary(test *ethrTest) {
+	n, _, _, _, _ := getBandwidthSummary(test)
+	if n == 0 {
+		return
+	}
+	var rates []uint64
+	var ids []string
+	test.connListDo(func(ec *ethrConn) {
+		rates = append(rates, ec.total/uint64(n))
+		ids = append(ids, fmt.Sprintf("[%d] %s", ec.fd, bytesToRate(ec.total/uint64(n))))
+	})
+	if len(rates) < 2 {
+		return
+	}
+	min, max, stddev, jain := streamFairness(rates)
+	ui.printMsg("%s per-stream summary for %s over %d streams ("+rateUnit()+"): "+
+		"Min %s, Max %s, StdDev %s, Jain's index %.3f",
+		protoToString(test.testParam.TestId.Protocol), test.remoteWithId(), len(rates),
+		bytesToRate(min), bytesToRate(max), bytesToRate(stddev), jain)
+	ui.printMsg("Average per stream: %s", strings.Join(ids, ", "))
+}
+
+//
+// Upload is from client to server, so the rates are the same on both sides.
+//
+func emitEchoSummary(test *ethrTest) {
+	n, min, avg, max, _ := getBandwidthSummary(test)
+	if n == 0 {
+		return
+	}
+	ui.printMsg("%s Echo summary for %s over %d intervals ("+rateUnit()+"): "+
+		"Upload Min %s, Avg %s, Max %s, Download Avg %s",
+		protoToString(test.testParam.TestId.Protocol), test.remoteWithId(), n,
+		bytesToRate(min), bytesToRate(avg), bytesToRate(max),
+		bytesToRate(atomic.LoadUint64(&test.testResult.echoTotal)/uint64(n)))
+}
+
+//
+// The total number of connections that the client opened in a conn/s test,
+// to compare with the number the server accepted, e.g. as reported with
+// "-result-line". Connections still in the server's accept queue when the
+// test ends are only counted by the client.
+//
+func emitCpsSummary(test *ethrTest) {
+	total := atomic.LoadUint64(&test.testResult.total) +
+		atomic.SwapUint64(&test.testResult.connections, 0)
+	ui.printMsg("%s Conn/s test to %s opened %d connections.",
+		protoToString(test.testParam.TestId.Protocol), test.remoteWithId(), total)
+	emitCpsRateSummary(test, total)
+	emitConnCountsSummary(test, total)
+	if test.testParam.CpsCloseWait {
+		test.swapCpsPhases()
+		t := &test.testResult.cpsTotal
+		count := atomic.LoadUint64(&t.count)
+		if count == 0 {
+			return
+		}
+		ui.printMsg("Connections closed by the server: %d, avg connect %s, avg close %s.", count,
+			latencyToString(time.Duration(atomic.LoadUint64(&t.connectNs)/count)),
+			latencyToString(time.Duration(atomic.LoadUint64(&t.closeNs)/count)))
+	}
+}
+
+//
+// Connections refused by the server, e.g. as its accept queue overflowed, are
+// counted apart from other failures to connect. The server's counts, from
+// servers that send them, show how many of the client's connections it
+// accepted, and how many the kernel dropped, e.g. when they time out on the
+// client rather than being refused.
+//
+func emitConnCountsSummary(test *ethrTest, connected uint64) {
+	refused := atomic.LoadUint64(&test.testResult.refused)
+	failed := atomic.LoadUint64(&test.testResult.connectFailed)
+	attempts := connected + refused + failed
+	if attempts == 0 {
+		return
+	}
+	ui.printMsg("Connection attempts: %d, connected %d, refused %d, failed otherwise %d, "+
+		"success ratio %.2f%%.", attempts, connected, refused, failed,
+		float64(connected)*100/float64(attempts))
+	var end *EthrMsgEnd
+	select {
+	case end = <-test.serverEnd:
+	default:
+		return
+	}
+	dropped := "unknown"
+	if end.DropsKnown {
+		dropped = fmt.Sprint(end.Dropped)
+	}
+	ui.printMsg("Server accepted %d connections, the client opened %d. The server's kernel "+
+		"dropped %s as the accept queue was full.", end.Accepted, connected, dropped)
+}
+
+//
+// It returns the average time to connect and to close in the interval, and
+// adds the interval to the totals of the test.
+//
+func (test *ethrTest) swapCpsPhases() (connectAvg, closeAvg time.Duration) {
+	i, t := &test.testResult.cpsInterval, &test.testResult.cpsTotal
+	connectNs := atomic.SwapUint64(&i.connectNs, 0)
+	closeNs := atomic.SwapUint64(&i.closeNs, 0)
+	count := atomic.SwapUint64(&i.count, 0)
+	atomic.AddUint64(&t.connectNs, connectNs)
+	atomic.AddUint64(&t.closeNs, closeNs)
+	atomic.AddUint64(&t.count, count)
+	if count == 0 {
+		return 0, 0
+	}
+	return time.Duration(connectNs / count), time.Duration(closeNs / count)
+}
+
+func emitPingPongSummary(test *ethrTest) {
+	total := atomic.LoadUint64(&test.testResult.total) +
+		atomic.SwapUint64(&test.testResult.transactions, 0)
+	ui.printMsg("%s Ping-pong test to %s completed %d transactions of %sBytes.",
+		protoToString(test.testParam.TestId.Protocol), test.remoteWithId(), total,
+		numberToUnit(uint64(test.testParam.BufferSize)))
+}
+
+func getBandwidthSummary(test *ethrTest) (n int, min, avg, max, stddev uint64) {
+	gSessionLock.Lock()
+	defer gSessionLock.Unlock()
+	n = len(test.bwSeries)
+	if n == 0 {
+		return
+	}
+	min, max, sum := test.bwSeries[0], test.bwSeries[0], float64(0)
+	for _, bw := range test.bwSeries {
+		if bw < min {
+			min = bw
+		}
+		if bw > max {
+			max = bw
+		}
+		sum += float64(bw)
+	}
+	mean := sum / float64(n)
+	variance := float64(0)
+	for _, bw := range test.bwSeries {
+		variance += (float64(bw) - mean) * (float64(bw) - mean)
+	}
+	avg = uint64(mean)
+	stddev = uint64(math.Sqrt(variance / float64(n)))
+	return
+}
+
+//
+// The wire rate is estimated assuming Ethernet with a 1500 byte MTU, full
+// sized segments for stream protocols, TCP timestamps and no IP options.
+// Ethernet overhead includes the preamble and inter-frame gap, as these use
+// link capacity as well.
+//
+const (
+	ethMtu         = 1500
+	ethHdrFcsLen   = 18
+	ethPreambleIfg = 20
+	ethMinFrame    = 64
+	ipv4HdrLen     = 20
+	ipv6HdrLen     = 40
+	tcpHdrLen      = 32
+	udpHdrLen      = 8
+	quicHdrLen     = 25
+	sctpHdrLen     = 12 + 16
+)
+
+func ethFrameLen(ipPacketLen uint64) uint64 {
+	frameLen := ipPacketLen + ethHdrFcsLen
+	if frameLen < ethMinFrame {
+		frameLen = ethMinFrame
+	}
+	return frameLen + ethPreambleIfg
+}
+
+//
+// It returns the estimated number of bytes on the wire to transfer payload
+// bytes. For the packets/s test, packets is the number of UDP packets of the
+// test's buffer size, which are fragmented if they exceed the MTU.
+//
+func estimateWireBytes(test *ethrTest, payload, packets uint64) uint64 {
+	ipHdrLen := uint64(ipv4HdrLen)
+	if addr, ok := test.ctrlConn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipHdrLen = ipv6HdrLen
+	}
+	var l4HdrLen uint64
+	switch test.testParam.TestId.Protocol {
+	case Udp:
+		ipPayload := udpHdrLen + uint64(test.testParam.BufferSize)
+		fragLen := (ethMtu - ipHdrLen) &^ 7
+		frags := (ipPayload + fragLen - 1) / fragLen
+		perPacket := (frags-1)*ethFrameLen(ipHdrLen+fragLen) +
+			ethFrameLen(ipHdrLen+ipPayload-(frags-1)*fragLen)
+		return packets * perPacket
+	case Quic:
+		l4HdrLen = udpHdrLen + quicHdrLen
+	case Sctp:
+		l4HdrLen = sctpHdrLen
+	default:
+		l4HdrLen = tcpHdrLen
+	}
+	mss := ethMtu - ipHdrLen - l4HdrLen
+	segments := (payload + mss - 1) / mss
+	return payload + segments*(ipHdrLen+l4HdrLen+ethHdrFcsLen+ethPreambleIfg)
+}
+
+//
+// With "-result-line", a single line with the totals of a test is printed when
+// it ends. The format is meant for scripts, so keys are only ever added to it.
+// Values are plain numbers: durations in seconds, latency in nanoseconds.
+//
+func emitResultLine(test *ethrTest) {
+	testType := test.testParam.TestId.Type
+	duration := time.Since(test.startTime)
+	if (testType == Bandwidth || testType == Download || testType == Echo) && gWarmup > 0 {
+		duration -= gWarmup
+		if duration < 0 {
+			duration = 0
+		}
+	}
+	total := atomic.LoadUint64(&test.testResult.total)
+	if counter := test.intervalCounter(); counter != nil {
+		total += atomic.SwapUint64(counter, 0)
+	}
+	if limit := test.testParam.TotalBytes; limit > 0 && total > limit {
+		total = limit
+	}
+	avg := uint64(0)
+	if duration > 0 {
+		avg = uint64(float64(total) / duration.Seconds())
+	}
+	str := fmt.Sprintf("ETHR_RESULT proto=%s type=%s remote=%s duration=%.3f",
+		strings.ToLower(protoToString(test.testParam.TestId.Protocol)),
+		resultLineTestName[testType], test.session.remoteAddr, duration.Seconds())
+	if test.uuid != "" {
+		str += " test_id=" + test.uuid
+	}
+	if test.testParam.Label != "" {
+		str += " label=" + test.testParam.Label
+	}
+	switch testType {
+	case Bandwidth, Download:
+		str += fmt.Sprintf(" bytes=%d avg_bps=%d", total, avg*8)
+		if test.testParam.Verify {
+			str += fmt.Sprintf(" corrupted_bytes=%d", atomic.LoadUint64(&test.testResult.corrupted))
+		}
+	case Echo:
+		echoed := atomic.LoadUint64(&test.testResult.echoTotal) +
+			atomic.SwapUint64(&test.testResult.echoBytes, 0)
+		echoAvg := uint64(0)
+		if duration > 0 {
+			echoAvg = uint64(float64(echoed) / duration.Seconds())
+		}
+		str += fmt.Sprintf(" bytes=%d avg_bps=%d echo_bytes=%d avg_echo_bps=%d",
+			total, avg*8, echoed, echoAvg*8)
+	case Cps, ConnLatency:
+		str += fmt.Sprintf(" conns=%d avg_cps=%d", total, avg)
+	case Pps:
+		str += fmt.Sprintf(" packets=%d avg_pps=%d", total, avg)
+	case PingPong:
+		size := uint64(test.testParam.BufferSize)
+		str += fmt.Sprintf(" transactions=%d avg_tps=%d bytes=%d avg_bps=%d",
+			total, avg, total*size, avg*size*8)
+	case Latency:
+		str += fmt.Sprintf(" latency_ns=%d", atomic.LoadUint64(&test.testResult.lastLatencyNs))
+		if n, owd, _, _ := test.getOneWayDelay(); n > 0 {
+			str += fmt.Sprintf(" one_way_delay_ns=%d", int64(owd))
+		}
+	}
+	ui.printMsg("%s", str)
+	outputLine([]string{str})
+}
+
+var resultLineTestName = map[EthrTestType]string{
+	Bandwidth:   "bandwidth",
+	Cps:         "cps",
+	Pps:         "pps",
+	Latency:     "latency",
+	Download:    "download",
+	PingPong:    "pingpong",
+	ConnLatency: "connlatency",
+	Echo:        "echo",
+}
+
+//
+// Sizes of the UDP packets received in a packets/s test are counted in
+// buckets, to show the distribution when testing with packets around or
+// above the path MTU. The bucket at 1472 bytes is the largest IPv4 UDP
+// payload that fits in a 1500 byte MTU, and 8972 the one for 9000 byte
+// jumbo frames.
+//
+var udpSizeBuckets = []int{64, 128, 256, 512, 1024, 1472, 4096, 8972, 16384, 32768, maxUdpPayload}
+
+func (test *ethrTest) addUdpSize(size int) {
+	if test.udpSizes == nil {
+		return
+	}
+	i := sort.SearchInts(udpSizeBuckets, size)
+	if i == len(udpSizeBuckets) {
+		i--
+	}
+	atomic.AddUint64(&test.udpSizes[i], 1)
+}
+
+//
+// Each pkt/s handler on the server counts the packets it received in its own
+// slot of handlerPps, so that the breakdown shows if a few of them get most
+// of the packets, e.g. as RSS steers the flows of the test to a few CPUs.
+// With "-pps-affinity", handler i runs on CPU i, otherwise the handlers are
+// not tied to CPUs.
+//
+func (test *ethrTest) addHandlerPacket(handler int) {
+	if handler < len(test.handlerPps) {
+		atomic.AddUint64(&test.handlerPps[handler], 1)
+	}
+}
+
+func emitPpsHandlers(s *ethrSession, proto EthrProtocol) {
+	test, found := s.tests[EthrTestId{proto, Pps}]
+	if !found || !test.isActive || len(test.handlerPps) < 2 {
+		return
+	}
+	unit := "handler"
+	if gPpsAffinity {
+		unit = "CPU"
+	}
+	str := ""
+	busy := 0
+	for i := range test.handlerPps {
+		pps := atomic.SwapUint64(&test.handlerPps[i], 0)
+		if pps == 0 {
+			continue
+		}
+		busy++
+		str += fmt.Sprintf("  %d: %s", i, ppsToString(pps))
+	}
+	if busy == 0 {
+		return
+	}
+	ui.printMsg("%17sPkt/s by %s, %d of %d busy:%s", "", unit, busy, len(test.handlerPps), str)
+}
+
+//
+// A datagram larger than the receive buffer is truncated, and the rest of it
+// is discarded, so it is counted as a packet of the size received. This only
+// happens for IPv6, whose UDP payload can be a little larger than the largest
+// IPv4 one the buffer is sized for. The first one of a test is reported.
+//
+func (test *ethrTest) addUdpTruncated(size int) {
+	if atomic.AddUint64(&test.udpTrunc, 1) == 1 {
+		ui.printErr("Warning: received a UDP packet from %s larger than %d bytes, which was truncated.",
+			test.remoteWithId(), size)
+	}
+}
+
+func emitUdpSizeSummary(test *ethrTest) {
+	if test.udpSizes == nil {
+		return
+	}
+	str := ""
+	for i, bucket := range udpSizeBuckets {
+		count := atomic.LoadUint64(&test.udpSizes[i])
+		if count == 0 {
+			continue
+		}
+		str += fmt.Sprintf(" <=%d: %d", bucket, count)
+	}
+	if str == "" {
+		return
+	}
+	ui.printMsg("UDP packet sizes (bytes) received from %s:%s", test.remoteWithId(), str)
+	if trunc := atomic.LoadUint64(&test.udpTrunc); trunc > 0 {
+		ui.printMsg("%d UDP packets received from %s were truncated to %d bytes.", trunc,
+			test.remoteWithId(), maxUdpPayload)
+	}
+}
+
+//
+// Latency percentiles are computed over a sliding window of the most recent
+// samples. The window size is independent of the number of round trips
+// measured between two emitted results, so that results can be emitted often
+// while percentiles are still computed over a large number of samples.
+//
+type ethrLatencyWindow struct {
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyWindow(size uint32) *ethrLatencyWindow {
+	return &ethrLatencyWindow{samples: make([]time.Duration, size)}
+}
+
+func (w *ethrLatencyWindow) add(d time.Duration) {
+	w.samples[w.next] = d
+	w.next++
+	if w.next == len(w.samples) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+func (w *ethrLatencyWindow) values() []time.Duration {
+	if w.full {
+		return w.samples
+	}
+	return w.samples[:w.next]
+}
+
+//
+// With "-one-way", the client stamps each latency message with the time it
+// is sent, and the server subtracts it from the time the message is received.
+// This is only as accurate as the clocks of both hosts are synchronized, e.g.
+// with PTP or NTP, as any offset between them is added to, or subtracted
+// from, the delay, which can even become negative.
+//
+const oneWayStampLen = 8
+
+type ethrOneWayDelay struct {
+	sum   time.Duration
+	count uint64
+	min   time.Duration
+	max   time.Duration
+}
+
+func latencyMsgSize(testParam EthrTestParam) int {
+	if testParam.OneWay {
+		return oneWayStampLen
+	}
+	return 1
+}
+
+func stampLatencyMsg(msg []byte) {
+	binary.BigEndian.PutUint64(msg, uint64(time.Now().UnixNano()))
+}
+
+func oneWayDelay(msg []byte, received time.Time) time.Duration {
+	return time.Duration(received.UnixNano() - int64(binary.BigEndian.Uint64(msg)))
+}
+
+func emitDiscardedSummary(test *ethrTest) {
+	n := atomic.LoadUint64(&test.testResult.discarded)
+	if n > 0 {
+		ui.printMsg("Latency test from %s: %d samples discarded, as the client stalled in the middle of a message.",
+			test.remoteWithId(), n)
+	}
+	n = atomic.LoadUint64(&test.testResult.timeouts)
+	if n > 0 {
+		ui.printMsg("Latency test from %s: %d round trips timed out, with no reply within %v, and were not counted.",
+			test.remoteWithId(), n, gLatencyTimeout)
+	}
+}
+
+func (test *ethrTest) addOneWayDelays(samples []time.Duration) {
+	gSessionLock.Lock()
+	defer gSessionLock.Unlock()
+	owd := &test.oneWay
+	for _, d := range samples {
+		if owd.count == 0 || d < owd.min {
+			owd.min = d
+		}
+		if owd.count == 0 || d > owd.max {
+			owd.max = d
+		}
+		owd.sum += d
+		owd.count++
+	}
+}
+
+func (test *ethrTest) getOneWayDelay() (n uint64, avg, min, max time.Duration) {
+	gSessionLock.RLock()
+	defer gSessionLock.RUnlock()
+	owd := test.oneWay
+	if owd.count == 0 {
+		return
+	}
+	return owd.count, owd.sum / time.Duration(owd.count), owd.min, owd.max
+}
+
+func emitOneWayDelaySummary(test *ethrTest) {
+	if !test.testParam.OneWay {
+		return
+	}
+	n, avg, min, max := test.getOneWayDelay()
+	if n == 0 {
+		return
+	}
+	ui.printMsg("%s one-way delay from %s over %d messages: avg %s, min %s, max %s "+
+		"(assumes synchronized clocks)", protoToString(test.testParam.TestId.Protocol),
+		test.remoteWithId(), n, latencyToString(avg), latencyToString(min), latencyToString(max))
+}
+
+//
+// By default, percentiles are the sample at the nearest rank. With
+// "-percentile-method linear", they are interpolated between the two closest
+// ranks instead, as done by e.g. iperf and wrk, which makes a difference when
+// the number of samples is small.
+//
+var gPercentileLinear bool
+
+func percentileLinear(sorted []time.Duration, q float64) time.Duration {
+	pos := q * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	frac := pos - float64(i)
+	return sorted[i] + time.Duration(frac*float64(sorted[i+1]-sorted[i]))
+}
+
+//
+// The standard deviation is that of the population of samples, computed in
+// the same pass as the average.
+//
+func calcLatencyResults(samples []time.Duration) (
+	avg, min, max, p50, p90, p95, p99, p999, p9999, stddev time.Duration) {
+	n := uint32(len(samples))
+	sorted := make([]time.Duration, n)
+	copy(sorted, samples)
+	sum := int64(0)
+	sumSq := float64(0)
+	for _, d := range sorted {
+		sum += d.Nanoseconds()
+		sumSq += float64(d) * float64(d)
+	}
+	avg = time.Duration(sum / int64(n))
+	mean := float64(sum) / float64(n)
+	if variance := sumSq/float64(n) - mean*mean; variance > 0 {
+		stddev = time.Duration(math.Sqrt(variance))
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	//
+	// Special handling for n == 1. This prevents negative index in the
+	// sorted samples. The other option is to use roundUpToZero() but that
+	// is more expensive.
+	//
+	min = sorted[0]
+	max = sorted[n-1]
+	if gPercentileLinear {
+		p50 = percentileLinear(sorted, 0.5)
+		p90 = percentileLinear(sorted, 0.9)
+		p95 = percentileLinear(sorted, 0.95)
+		p99 = percentileLinear(sorted, 0.99)
+		p999 = percentileLinear(sorted, 0.999)
+		p9999 = percentileLinear(sorted, 0.9999)
+		return
+	}
+	nFixed := n
+	if nFixed == 1 {
+		nFixed = 2
+	}
+	p50 = sorted[((nFixed*50)/100)-1]
+	p90 = sorted[((nFixed*90)/100)-1]
+	p95 = sorted[((nFixed*95)/100)-1]
+	p99 = sorted[((nFixed*99)/100)-1]
+	p999 = sorted[uint64(((float64(nFixed)*99.9)/100)-1)]
+	p9999 = sorted[uint64(((float64(nFixed)*99.99)/100)-1)]
+	return
+}
+
+//
+// The coefficient of variation, the standard deviation relative to the
+// average, shows how jittery a path is, even when the median looks fine.
+//
+func latencyCv(avg, stddev time.Duration) float64 {
+	if avg <= 0 {
+		return 0
+	}
+	return float64(stddev) / float64(avg)
+}
+
+//
+// If "-hdr" is specified, each batch of latency measurements is recorded into
+// an HdrHistogram that is appended to the histogram log, and the reported
+// percentiles are computed from the same histogram, so that both agree.
+// Values are recorded in nanoseconds.
+//
+var gHdrLogFile *os.File
+var gHdrLogWriter *hdrhistogram.HistogramLogWriter
+var gHdrLogLock sync.Mutex
+
+const (
+	hdrLowestLatency  = 1
+	hdrHighestLatency = int64(time.Hour)
+	hdrSigFigs        = 3
+)
+
+func hdrInit(fileName string) error {
+	if fileName == "" {
+		return nil
+	}
+	f, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	w := hdrhistogram.NewHistogramLogWriter(f)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	w.SetBaseTime(now)
+	w.OutputLogFormatVersion()
+	w.OutputStartTime(now)
+	w.OutputBaseTime(now)
+	w.OutputLegend()
+	gHdrLogLock.Lock()
+	gHdrLogFile = f
+	gHdrLogWriter = w
+	gHdrLogLock.Unlock()
+	return nil
+}
+
+func hdrFini() {
+	gHdrLogLock.Lock()
+	defer gHdrLogLock.Unlock()
+	if gHdrLogFile != nil {
+		gHdrLogFile.Close()
+		gHdrLogFile = nil
+		gHdrLogWriter = nil
+	}
+}
+
+func hdrEnabled() bool {
+	gHdrLogLock.Lock()
+	defer gHdrLogLock.Unlock()
+	return gHdrLogWriter != nil
+}
+
+//
+// The batch of samples measured since the last result is written to the log
+// as an interval histogram, while the returned values are computed from a
+// histogram of the latency window.
+//
+func hdrRecordLatency(remoteAddr string, start time.Time, batch, window []time.Duration) (
+	avg, min, max, p50, p90, p95, p99, p999, p9999, stddev time.Duration) {
+	h := newHdrHistogram(batch)
+	h.SetStartTimeMs(start.UnixNano() / int64(time.Millisecond))
+	h.SetEndTimeMs(time.Now().UnixNano() / int64(time.Millisecond))
+	h.SetTag(remoteAddr)
+	gHdrLogLock.Lock()
+	if gHdrLogWriter != nil {
+		err := gHdrLogWriter.OutputIntervalHistogram(h)
+		if err != nil {
+			ui.printDbg("Error writing latency histogram: %v", err)
+		}
+	}
+	gHdrLogLock.Unlock()
+	h = newHdrHistogram(window)
+	avg = time.Duration(h.Mean())
+	min = time.Duration(h.Min())
+	max = time.Duration(h.Max())
+	p50 = time.Duration(h.ValueAtQuantile(50))
+	p90 = time.Duration(h.ValueAtQuantile(90))
+	p95 = time.Duration(h.ValueAtQuantile(95))
+	p99 = time.Duration(h.ValueAtQuantile(99))
+	p999 = time.Duration(h.ValueAtQuantile(99.9))
+	p9999 = time.Duration(h.ValueAtQuantile(99.99))
+	stddev = time.Duration(h.StdDev())
+	return
+}
+
+func newHdrHistogram(samples []time.Duration) *hdrhistogram.Histogram {
+	h := hdrhistogram.New(hdrLowestLatency, hdrHighestLatency, hdrSigFigs)
+	for _, d := range samples {
+		h.RecordValue(int64(d))
 	}
+	return h
 }
@@ -0,0 +1,134 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+//
+// With "-syslog", the server mirrors its messages and interval results to a
+// syslog server, in the format of log/syslog, which isn't available on
+// Windows. Over TCP, messages end with a newline, and the connection is
+// re-established on the next message after an error. Messages are sent by a
+// writer goroutine, so that a slow or unreachable syslog server doesn't hold
+// up the server, and are dropped if the writer falls too far behind.
+//
+const (
+	syslogFacilityDaemon = 3 << 3
+	syslogSevErr         = 3
+	syslogSevInfo        = 6
+	syslogTag            = "ethr"
+	syslogDialTimeout    = 5 * time.Second
+	syslogPendingMsgs    = 1024
+)
+
+var gSyslogAddr string
+
+var syslogLock sync.Mutex
+var syslogNetwork string
+var syslogHostPort string
+var syslogHost string
+var syslogChan chan string
+var syslogDone chan struct{}
+
+//
+// The address is udp://<host>:<port>, tcp://<host>:<port>, or <host>:<port>
+// for UDP.
+//
+func parseSyslogAddr(addr string) (network, hostPort string, err error) {
+	network, hostPort = protoUDP, addr
+	if u, perr := url.Parse(addr); perr == nil && u.Host != "" {
+		if u.Scheme != protoUDP && u.Scheme != protoTCP {
+			return "", "", fmt.Errorf("unsupported scheme \"%s\", use udp or tcp", u.Scheme)
+		}
+		network, hostPort = u.Scheme, u.Host
+	}
+	if _, _, err = net.SplitHostPort(hostPort); err != nil {
+		return "", "", err
+	}
+	return network, hostPort, nil
+}
+
+func syslogInit(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	network, hostPort, err := parseSyslogAddr(addr)
+	if err != nil {
+		return err
+	}
+	// The first connection is made here, so that the server can say if the
+	// syslog server is unreachable when it starts.
+	conn, err := net.DialTimeout(network, hostPort, syslogDialTimeout)
+	syslogLock.Lock()
+	defer syslogLock.Unlock()
+	syslogNetwork = network
+	syslogHostPort = hostPort
+	syslogHost, _ = os.Hostname()
+	syslogChan = make(chan string, syslogPendingMsgs)
+	syslogDone = make(chan struct{})
+	go runSyslogWriter(conn, syslogChan)
+	return err
+}
+
+func syslogFini() {
+	syslogLock.Lock()
+	if syslogChan == nil {
+		syslogLock.Unlock()
+		return
+	}
+	close(syslogChan)
+	syslogChan = nil
+	syslogLock.Unlock()
+	<-syslogDone
+}
+
+func syslogWrite(severity int, msg string) {
+	syslogLock.Lock()
+	defer syslogLock.Unlock()
+	if syslogChan == nil {
+		return
+	}
+	nl := ""
+	if syslogNetwork == protoTCP {
+		nl = "\n"
+	}
+	line := fmt.Sprintf("<%d>%s %s %s[%d]: %s%s",
+		syslogFacilityDaemon|severity, time.Now().Format(time.RFC3339),
+		syslogHost, syslogTag, os.Getpid(), msg, nl)
+	select {
+	case syslogChan <- line:
+	default:
+	}
+}
+
+func runSyslogWriter(conn net.Conn, lines chan string) {
+	defer close(syslogDone)
+	for line := range lines {
+		if conn == nil {
+			var err error
+			conn, err = net.DialTimeout(syslogNetwork, syslogHostPort, syslogDialTimeout)
+			if err != nil {
+				conn = nil
+				continue
+			}
+		}
+		_, err := conn.Write([]byte(line))
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}
+	if conn != nil {
+		conn.Close()
+	}
+}
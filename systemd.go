@@ -0,0 +1,94 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//
+// With "-systemd", the server runs as a Type=notify service. It tells systemd
+// that it is ready once all listeners are up, pings the watchdog at half the
+// interval of WatchdogSec, and that it is stopping when it exits. SIGTERM, as
+// sent by "systemctl stop", then shuts the server down like Ctrl-C in the UI,
+// flushing the outputs, rather than killing it. Messages are datagrams sent
+// to the socket in NOTIFY_SOCKET, which is an abstract socket if it starts
+// with '@'. Without NOTIFY_SOCKET, e.g. when not started by systemd, nothing
+// is sent.
+//
+var gSystemd bool
+
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if !gSystemd || name == "" {
+		return nil
+	}
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func sdNotifyReady() {
+	if !gSystemd {
+		return
+	}
+	err := sdNotify("READY=1")
+	if err != nil {
+		ui.printErr("Unable to notify systemd that the server is ready: %v", err)
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM)
+	go func() {
+		<-sigChan
+		ui.printMsg("Ethr server stopping, received SIGTERM.")
+		finiServer()
+		os.Exit(0)
+	}()
+	interval := sdWatchdogInterval()
+	if interval > 0 {
+		go func() {
+			for range time.Tick(interval) {
+				err := sdNotify("WATCHDOG=1")
+				if err != nil {
+					ui.printDbg("Unable to ping the systemd watchdog: %v", err)
+				}
+			}
+		}()
+	}
+}
+
+func sdNotifyStopping() {
+	sdNotify("STOPPING=1")
+}
+
+//
+// The watchdog is enabled for this process if WATCHDOG_USEC is set, and
+// WATCHDOG_PID is either unset or our pid.
+//
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec == 0 {
+		return 0
+	}
+	pid := os.Getenv("WATCHDOG_PID")
+	if pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
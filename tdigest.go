@@ -0,0 +1,181 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// With "-tdigest", every latency sample of a test is also added to a
+// t-digest, so that percentiles over the whole test can be reported in the
+// summary. The digest keeps a bounded number of centroids, regardless of the
+// duration of the test or the RTT count, and is most accurate at the tails,
+// which is where latency percentiles matter.
+//
+var gTDigest bool
+
+const tdigestCompression = 200
+
+type tdCentroid struct {
+	mean   float64
+	weight float64
+}
+
+//
+// This is the merging variant of the t-digest: samples are buffered, and
+// merged into the sorted centroids when the buffer is full, or before a
+// quantile is read. The k1 scale function limits the size of centroids, so
+// they are small near the tails.
+//
+type tDigest struct {
+	lock        sync.Mutex
+	compression float64
+	centroids   []tdCentroid
+	buffer      []tdCentroid
+	count       float64
+	sum         float64
+	min         float64
+	max         float64
+}
+
+func newTDigest(compression float64) *tDigest {
+	return &tDigest{
+		compression: compression,
+		buffer:      make([]tdCentroid, 0, 5*int(compression)),
+	}
+}
+
+func (td *tDigest) addSamples(samples []time.Duration) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	for _, d := range samples {
+		x := float64(d)
+		if td.count == 0 || x < td.min {
+			td.min = x
+		}
+		if td.count == 0 || x > td.max {
+			td.max = x
+		}
+		td.count++
+		td.sum += x
+		td.buffer = append(td.buffer, tdCentroid{x, 1})
+		if len(td.buffer) == cap(td.buffer) {
+			td.merge()
+		}
+	}
+}
+
+func (td *tDigest) qToK(q float64) float64 {
+	return td.compression / (2 * math.Pi) * math.Asin(2*q-1)
+}
+
+func (td *tDigest) kToQ(k float64) float64 {
+	return (math.Sin(k*2*math.Pi/td.compression) + 1) / 2
+}
+
+func (td *tDigest) merge() {
+	if len(td.buffer) == 0 {
+		return
+	}
+	all := append(td.buffer, td.centroids...)
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].mean < all[j].mean
+	})
+	merged := make([]tdCentroid, 0, len(td.centroids)+1)
+	cur := all[0]
+	weightSoFar := float64(0)
+	qLimit := td.kToQ(td.qToK(0) + 1)
+	for _, c := range all[1:] {
+		if (weightSoFar+cur.weight+c.weight)/td.count <= qLimit {
+			cur.mean += (c.mean - cur.mean) * c.weight / (cur.weight + c.weight)
+			cur.weight += c.weight
+			continue
+		}
+		merged = append(merged, cur)
+		weightSoFar += cur.weight
+		qLimit = td.kToQ(td.qToK(weightSoFar/td.count) + 1)
+		cur = c
+	}
+	td.centroids = append(merged, cur)
+	td.buffer = td.buffer[:0]
+}
+
+//
+// Each centroid is taken to be centered at the middle of its weight, and
+// quantiles in between are interpolated linearly, using the exact minimum
+// and maximum at the ends.
+//
+func (td *tDigest) quantile(q float64) time.Duration {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	if td.count == 0 {
+		return 0
+	}
+	td.merge()
+	target := q * td.count
+	prevMean, prevPos := td.min, float64(0)
+	weightSoFar := float64(0)
+	for _, c := range td.centroids {
+		pos := weightSoFar + c.weight/2
+		if target < pos {
+			return time.Duration(interpolate(prevMean, c.mean, prevPos, pos, target))
+		}
+		prevMean, prevPos = c.mean, pos
+		weightSoFar += c.weight
+	}
+	return time.Duration(interpolate(prevMean, td.max, prevPos, td.count, target))
+}
+
+func interpolate(x0, x1, pos0, pos1, pos float64) float64 {
+	if pos1 <= pos0 {
+		return x1
+	}
+	return x0 + (x1-x0)*(pos-pos0)/(pos1-pos0)
+}
+
+func (td *tDigest) summary() (n uint64, avg, min, max time.Duration) {
+	td.lock.Lock()
+	defer td.lock.Unlock()
+	if td.count == 0 {
+		return
+	}
+	return uint64(td.count), time.Duration(td.sum / td.count),
+		time.Duration(td.min), time.Duration(td.max)
+}
+
+func (test *ethrTest) addLatencySamples(samples []time.Duration) {
+	rawLatencyWrite(test, samples)
+	if test.digest != nil {
+		test.digest.addSamples(samples)
+	}
+}
+
+func emitLatencySummary(test *ethrTest) {
+	td := test.digest
+	if td == nil {
+		return
+	}
+	n, avg, min, max := td.summary()
+	if n == 0 {
+		return
+	}
+	name := "latency"
+	if test.testParam.TestId.Type == ConnLatency {
+		name = "connection latency"
+	}
+	ui.printMsg("%s %s with %s over %d samples: avg %s, min %s, p50 %s, p90 %s, "+
+		"p95 %s, p99 %s, p99.9 %s, p99.99 %s, max %s",
+		protoToString(test.testParam.TestId.Protocol), name, test.remoteWithId(), n,
+		latencyToString(avg), latencyToString(min),
+		latencyToString(td.quantile(0.5)), latencyToString(td.quantile(0.9)),
+		latencyToString(td.quantile(0.95)), latencyToString(td.quantile(0.99)),
+		latencyToString(td.quantile(0.999)), latencyToString(td.quantile(0.9999)),
+		latencyToString(max))
+}
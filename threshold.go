@@ -0,0 +1,63 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"time"
+)
+
+//
+// With "-min-bandwidth" or "-max-p99", the client checks the results over the
+// whole test against the given thresholds when it ends, and exits with status
+// 1 if one was not met, so that it can gate CI pipelines on network SLAs. The
+// average bandwidth is over the intervals reported, and p99 is taken from the
+// t-digest of all samples, which "-max-p99" turns on. A test that measured
+// nothing fails the check.
+//
+var gMinBandwidth uint64
+var gMaxP99 time.Duration
+
+func checkThresholds(test *ethrTest) bool {
+	passed := true
+	if gMinBandwidth > 0 {
+		n, _, avg, _, _ := getBandwidthSummary(test)
+		switch {
+		case n == 0:
+			ui.printErr("Threshold not met: no bandwidth was measured, the minimum is %s.",
+				bytesToRate(gMinBandwidth/8))
+			passed = false
+		case avg*8 < gMinBandwidth:
+			ui.printErr("Threshold not met: average bandwidth %s is below the minimum of %s.",
+				bytesToRate(avg), bytesToRate(gMinBandwidth/8))
+			passed = false
+		default:
+			ui.printMsg("Threshold met: average bandwidth %s is at least %s.",
+				bytesToRate(avg), bytesToRate(gMinBandwidth/8))
+		}
+	}
+	if gMaxP99 > 0 {
+		var n uint64
+		var p99 time.Duration
+		if test.digest != nil {
+			n, _, _, _ = test.digest.summary()
+			p99 = test.digest.quantile(0.99)
+		}
+		switch {
+		case n == 0:
+			ui.printErr("Threshold not met: no latency was measured, the maximum p99 is %s.",
+				latencyToString(gMaxP99))
+			passed = false
+		case p99 > gMaxP99:
+			ui.printErr("Threshold not met: p99 latency %s is above the maximum of %s.",
+				latencyToString(p99), latencyToString(gMaxP99))
+			passed = false
+		default:
+			ui.printMsg("Threshold met: p99 latency %s is at most %s.",
+				latencyToString(p99), latencyToString(gMaxP99))
+		}
+	}
+	return passed
+}
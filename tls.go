@@ -0,0 +1,80 @@
+//-----------------------------------------------------------------------------
+// Copyright (C) Microsoft. All rights reserved.
+// Licensed under the MIT license.
+// See LICENSE.txt file in the project root for full license information.
+//-----------------------------------------------------------------------------
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+//
+// With "-tls", the connections of TCP bandwidth and latency tests are wrapped
+// with TLS, so that the results include the overhead of encryption. The
+// server presents a self-signed certificate, see generateCertificate, which
+// is only created when the first TLS test arrives.
+//
+const tlsHandshakeTimeout = 5 * time.Second
+
+var tlsServerOnce sync.Once
+var tlsServerConfig *tls.Config
+var tlsServerErr error
+
+func getTlsServerConfig() (*tls.Config, error) {
+	tlsServerOnce.Do(func() {
+		cert, err := generateCertificate()
+		if err != nil {
+			tlsServerErr = err
+			return
+		}
+		tlsServerConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	})
+	return tlsServerConfig, tlsServerErr
+}
+
+//
+// The handshake runs on the first read of the handler, so it doesn't hold up
+// the accept loop.
+//
+func tlsServerConn(conn net.Conn, test *ethrTest) (net.Conn, error) {
+	if !test.testParam.Tls {
+		return conn, nil
+	}
+	config, err := getTlsServerConfig()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(conn, config), nil
+}
+
+//
+// The client completes the handshake before the test starts, so that the
+// first latency sample, or the first interval of a bandwidth test, doesn't
+// include it.
+//
+func tlsClientConn(conn net.Conn, test *ethrTest) (net.Conn, error) {
+	if !test.testParam.Tls {
+		return conn, nil
+	}
+	tc := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	tc.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	err := tc.Handshake()
+	if err != nil {
+		return nil, err
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+func tlsConnString(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tc.ConnectionState()
+	return tls.VersionName(state.Version) + " " + tls.CipherSuiteName(state.CipherSuite)
+}
@@ -217,7 +217,7 @@ type ethrUi interface {
 	paint()
 	emitTestHdr()
 	emitLatencyHdr()
-	emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999 time.Duration)
+	emitLatencyResults(remote, proto string, avg, min, max, p50, p90, p95, p99, p999, p9999, stddev time.Duration)
 	emitTestResultBegin()
 	emitTestResult(s *ethrSession, proto EthrProtocol)
 	printTestResults(s []string)
@@ -6,6 +6,15 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math"
+	"math/big"
 	"net"
 	"strconv"
 	"strings"
@@ -15,8 +24,13 @@ import (
 	"unicode/utf8"
 )
 
-const (
-	hostAddr          = ""
+//
+// Ports are only changed before any listener is started, by the self-test,
+// see selfTestPorts, and with "-port", and by listeners bound to port 0, see
+// setBoundPort. Clients take the data ports from the server, see
+// useServerPort.
+//
+var (
 	ctrlPort          = "9991"
 	tcpBandwidthPort  = "9999"
 	tcpCpsPort        = "9998"
@@ -24,8 +38,17 @@ const (
 	tcpLatencyPort    = "9996"
 	udpPpsPort        = "9997"
 	httpBandwidthPort = "8080"
-	protoTCP          = "tcp"
-	protoUDP          = "udp"
+	quicBandwidthPort = "9995"
+	grpcPort          = "9994"
+	sctpBandwidthPort = "9993"
+	sctpLatencyPort   = "9992"
+	tcpPingPongPort   = "9990"
+)
+
+const (
+	protoTCP      = "tcp"
+	protoUDP      = "udp"
+	maxUdpPayload = 65507
 )
 
 var gDone = false
@@ -127,10 +150,79 @@ func durationToString(d time.Duration) string {
 	return d.String()
 }
 
+//
+// With "-latency-unit", latency is always shown in the given unit, rather
+// than in the unit that best fits the value.
+//
+var gLatencyUnit time.Duration
+
+func latencyToString(d time.Duration) string {
+	switch gLatencyUnit {
+	case time.Nanosecond:
+		return strconv.FormatInt(int64(d), 10) + "ns"
+	case time.Microsecond:
+		return strconv.FormatFloat(float64(d)/float64(time.Microsecond), 'f', 2, 64) + "us"
+	case time.Millisecond:
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 2, 64) + "ms"
+	}
+	return durationToString(d)
+}
+
+//
+// All bandwidth results are formatted by bytesToRate, so that the console,
+// the output file and the JSON log agree. With "-units", bandwidth is shown
+// in bits/s with SI prefixes, the default, in bytes/s with SI prefixes, or
+// in bytes/s with IEC prefixes, which are powers of 1024 and marked with an
+// "i", e.g. 1.50Gi. With "-rate-scale", it is always shown with the given
+// prefix, rather than with the one that best fits the value.
+//
+const (
+	rateBits = iota
+	rateSi
+	rateIec
+)
+
+var gRateFormat = rateBits
+var gRateScale int
+
+var ratePrefixes = []string{"", "K", "M", "G", "T"}
+
 func bytesToRate(bytes uint64) string {
-	bits := bytes * 8
-	result := numberToUnit(bits)
-	return result
+	switch gRateFormat {
+	case rateSi:
+		return scaleRate(bytes, KILO, "")
+	case rateIec:
+		return scaleRate(bytes, 1024, "i")
+	}
+	return scaleRate(bytes*8, KILO, "")
+}
+
+func scaleRate(rate uint64, base float64, infix string) string {
+	value := float64(rate)
+	scale := gRateScale
+	if scale == 0 {
+		for scale < len(ratePrefixes)-1 && value >= base {
+			value /= base
+			scale++
+		}
+	} else {
+		value /= math.Pow(base, float64(scale))
+	}
+	result := strconv.FormatFloat(value, 'f', 2, 64)
+	if gRateScale == 0 {
+		result = strings.TrimSuffix(result, ".00")
+	}
+	if scale == 0 {
+		return result
+	}
+	return result + ratePrefixes[scale] + infix
+}
+
+func rateUnit() string {
+	if gRateFormat == rateBits {
+		return "Bits/s"
+	}
+	return "Bytes/s"
 }
 
 func cpsToString(cps uint64) string {
@@ -153,6 +245,14 @@ func testToString(testType EthrTestType) string {
 		return "Packets/s"
 	case Latency:
 		return "Latency"
+	case Download:
+		return "Download"
+	case PingPong:
+		return "Ping-pong"
+	case ConnLatency:
+		return "Connection latency"
+	case Echo:
+		return "Echo"
 	default:
 		return "Invalid"
 	}
@@ -170,6 +270,14 @@ func protoToString(proto EthrProtocol) string {
 		return "HTTPS"
 	case Icmp:
 		return "ICMP"
+	case Quic:
+		return "QUIC"
+	case Dns:
+		return "DNS"
+	case Grpc:
+		return "GRPC"
+	case Sctp:
+		return "SCTP"
 	}
 	return ""
 }
@@ -219,16 +327,190 @@ func roundUpToZero(n int64) int64 {
 	return (n ^ y) - y
 }
 
+func getInterfaceMtu(ip net.IP) int {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return 0
+	}
+	for _, ifi := range ifs {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if ok && ipnet.IP.Equal(ip) {
+				return ifi.MTU
+			}
+		}
+	}
+	return 0
+}
+
+//
+// With "-family", the client resolves the server's name to an address of the
+// given family up front, and connects to that address for all connections of
+// the test, so that they don't end up on different families.
+//
+const (
+	familyAny = iota
+	family4
+	family6
+	familyBoth
+)
+
+var gAddrFamily = familyAny
+
+func familyToString(family int) string {
+	if family == family6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+//
+// IPv4 addresses mapped to IPv6, as seen on dual-stack sockets, are IPv4 on
+// the wire, so they are reported as such.
+//
+func addrFamily(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return familyToString(family6)
+	}
+	return familyToString(family4)
+}
+
+//
+// It joins the server, a name or an address, bracketed or not, with a port,
+// bracketing IPv6 addresses.
+//
+func joinHostPort(server, port string) string {
+	return net.JoinHostPort(trimBrackets(server), port)
+}
+
+func trimBrackets(server string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(server, "["), "]")
+}
+
+//
+// It returns an address of the given family for the server.
+//
+func resolveFamily(server string, family int) (string, error) {
+	host := trimBrackets(server)
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, ip := range ips {
+		is4 := ip.To4() != nil
+		if is4 && family == family4 {
+			return ip.String(), nil
+		}
+		if !is4 && family == family6 {
+			return ip.String(), nil
+		}
+	}
+	return "", errors.New("no " + familyToString(family) + " address for " + host)
+}
+
+//
+// With "-numeric", the server's name is resolved once, to the address the
+// resolver returns first, which is the one a dial would try first. Otherwise
+// each connection looks the name up again, which adds up in conn/s tests, and
+// results are shown for the name.
+//
+var gNumeric bool
+
+func resolveNumeric(server string) (string, error) {
+	host := trimBrackets(server)
+	ip := net.ParseIP(host)
+	if ip == nil {
+		ips, err := net.LookupIP(host)
+		if err != nil {
+			return "", err
+		}
+		ip = ips[0]
+	}
+	return ip.String(), nil
+}
+
+func setNoDelay(conn net.Conn, noDelay bool) error {
+	tcpconn, ok := baseConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpconn.SetNoDelay(noDelay)
+}
+
+func setKeepAlive(conn net.Conn, period time.Duration) error {
+	tcpconn, ok := baseConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if period == 0 {
+		return tcpconn.SetKeepAlive(false)
+	}
+	err := tcpconn.SetKeepAlive(true)
+	if err != nil {
+		return err
+	}
+	return tcpconn.SetKeepAlivePeriod(period)
+}
+
+//
+// With "-port 0", the server binds all listeners to ports chosen by the
+// system, and keeps the ones chosen, so that they are reported, and sent to
+// clients in the Ack of each test.
+//
+func setBoundPort(port *string, addr net.Addr) {
+	_, p, err := net.SplitHostPort(addr.String())
+	if err == nil {
+		*port = p
+	}
+}
+
+//
+// The keepalive period of data connections for net.Dialer and
+// net.ListenConfig, for which 0 means the default period, not none.
+//
+func dataKeepAlivePeriod() time.Duration {
+	if gDataKeepAlive == 0 {
+		return -1
+	}
+	return gDataKeepAlive
+}
+
 func getFd(conn net.Conn) uintptr {
 	var fd uintptr
 	var rc syscall.RawConn
 	var err error
-	switch ct := conn.(type) {
+	switch ct := baseConn(conn).(type) {
 	case *net.TCPConn:
 		rc, err = ct.SyscallConn()
 		if err != nil {
 			return 0
 		}
+	case *net.UDPConn:
+		rc, err = ct.SyscallConn()
+		if err != nil {
+			return 0
+		}
+	case *net.IPConn:
+		rc, err = ct.SyscallConn()
+		if err != nil {
+			return 0
+		}
 	default:
 		return 0
 	}
@@ -238,3 +520,28 @@ func getFd(conn net.Conn) uintptr {
 	rc.Control(fn)
 	return fd
 }
+
+//
+// Self-signed certificate for the data plane protocols that require TLS, such
+// as QUIC. Clients don't verify it, as Ethr measures performance, not identity.
+//
+func generateCertificate() (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"Ethr"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}